@@ -0,0 +1,1052 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
+)
+
+const (
+	cfAPIAuto = "auto"
+	cfAPIV2   = "v2"
+	cfAPIV3   = "v3"
+)
+
+var cfAPIVersions = []string{cfAPIAuto, cfAPIV2, cfAPIV3}
+
+//serviceAPI is the part of the CF API used to find and manage autoscaler
+// service instances and their bindings, and to look up the orgs, spaces, and
+// apps they belong to. Results are returned as cfclient's v2 types with only
+// the fields we use filled in, whichever API version is behind it.
+type serviceAPI interface {
+	CheckServiceBroker(brokerGUID string) error
+	//Fails unless exactly one broker offers the service
+	FindBrokerGUIDForService(name string) (string, error)
+	ListServicePlans(brokerGUID string) ([]cfclient.ServicePlan, error)
+	ListServiceInstancesForPlan(planGUID string) ([]cfclient.ServiceInstance, error)
+	//Includes user-provided service instances
+	ListServiceInstanceNamesInSpace(spaceGUID string) ([]string, error)
+	FindServiceInstanceInSpace(spaceGUID, name string) (*cfclient.ServiceInstance, error)
+	//appGUID may be empty to list bindings to all apps
+	ListBindings(instanceGUID, appGUID string) ([]cfclient.ServiceBinding, error)
+	PlanVisibleToOrg(plan cfclient.ServicePlan, orgGUID string) (bool, error)
+	OrgGUIDForSpace(spaceGUID string) (string, error)
+	//Fills in Guid, Name, and OrganizationGuid
+	GetSpace(spaceGUID string) (cfclient.Space, error)
+	GetOrgName(orgGUID string) (string, error)
+	//Fills in Guid, Name, State, and the web process's Instances. Returns nil
+	// if there is no app with the GUID.
+	GetApp(appGUID string) (*cfclient.App, error)
+	//Apps are filled in as by GetApp
+	ListAppsInSpace(spaceGUID string) ([]cfclient.App, error)
+	FindOrgGUIDsByName(name string) ([]string, error)
+	FindSpaceGUIDsByName(orgGUID, name string) ([]string, error)
+	//Returns once the broker has finished provisioning the instance
+	CreateServiceInstance(name, spaceGUID, planGUID string) (cfclient.ServiceInstance, error)
+	//Waits for any operation in progress on an existing instance, and fails if
+	// the instance never finished being created
+	WaitForServiceInstance(instance cfclient.ServiceInstance) error
+	//parameters may be nil
+	CreateBinding(appGUID, instanceGUID string, parameters interface{}) error
+	//Fails if the broker doesn't support fetching bindings
+	GetBindingParameters(bindingGUID string) (json.RawMessage, error)
+}
+
+//newServiceAPI picks the API version to use from the --cf-api flag, or by
+// checking which versions the API root advertises.
+func newServiceAPI(cf *cfclient.Client) (serviceAPI, error) {
+	version := cfAPIAuto
+	if globalCFAPI != nil {
+		version = *globalCFAPI
+	}
+
+	if version == cfAPIAuto {
+		var err error
+		version, err = detectCFAPIVersion(cf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	poll := asyncPoller{interval: defaultAsyncPollInterval, timeout: defaultAsyncTimeout}
+	if globalAsyncPollInterval != nil && *globalAsyncPollInterval > 0 {
+		poll.interval = *globalAsyncPollInterval
+	}
+	if globalAsyncTimeout != nil && *globalAsyncTimeout > 0 {
+		poll.timeout = *globalAsyncTimeout
+	}
+
+	logger.WithFields(logger.Fields{"cf_api": version}).Debugf("Using CF API version")
+	if version == cfAPIV3 {
+		return &cfV3Services{cf: cf, poll: poll}, nil
+	}
+
+	return &cfV2Services{cf: cf, poll: poll}, nil
+}
+
+//How often and how long to wait for asynchronous broker operations and v3 jobs
+// to finish, unless overridden with --async-poll-interval and --async-timeout
+const (
+	defaultAsyncPollInterval = 2 * time.Second
+	defaultAsyncTimeout      = 10 * time.Minute
+)
+
+//Values of last_operation.state
+const (
+	lastOperationInProgress = "in progress"
+	lastOperationSucceeded  = "succeeded"
+	lastOperationFailed     = "failed"
+)
+
+type asyncPoller struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+//Calls check until it reports done or fails, or until the timeout passes.
+// what describes the operation for the timeout error.
+func (p asyncPoller) wait(what string, check func() (bool, error)) error {
+	deadline := time.Now().Add(p.timeout)
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %s waiting for %s", p.timeout, what)
+		}
+
+		time.Sleep(p.interval)
+	}
+}
+
+//Checks a last_operation from either API version. The error includes the
+// broker's description of what went wrong.
+func lastOperationDone(what string, op cfclient.LastOperation) (bool, error) {
+	switch op.State {
+	case lastOperationInProgress:
+		return false, nil
+
+	case lastOperationFailed:
+		//A failed update or delete leaves a usable instance behind
+		if op.Type != "" && op.Type != "create" {
+			logger.WithFields(logger.Fields{"operation": op.Type}).Warnf("Last operation on %s failed: %s", what, op.Description)
+			return true, nil
+		}
+
+		return false, fmt.Errorf("Broker failed to create %s: %s", what, op.Description)
+	}
+
+	return true, nil
+}
+
+//cfRoot is the API root document. Reading it needs no auth.
+type cfRoot struct {
+	Links map[string]*struct {
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+func readCFRoot(httpClient *http.Client, apiAddress string) (cfRoot, error) {
+	root := cfRoot{}
+	resp, err := httpClient.Get(strings.TrimRight(apiAddress, "/") + "/")
+	if err != nil {
+		return root, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return root, fmt.Errorf("Unexpected response code %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return root, fmt.Errorf("Error decoding CF API root: %s", err)
+	}
+
+	return root, nil
+}
+
+//Returns an empty string if the root has no such link.
+func (r cfRoot) href(name string) string {
+	link := r.Links[name]
+	if link == nil {
+		return ""
+	}
+
+	return strings.TrimRight(link.Href, "/")
+}
+
+//Prefers v2 while it is still available, since that is what this tool has
+// always used.
+func (r cfRoot) version() string {
+	if r.Links["cloud_controller_v2"] == nil && r.Links["cloud_controller_v3"] != nil {
+		return cfAPIV3
+	}
+
+	return cfAPIV2
+}
+
+func detectCFAPIVersion(cf *cfclient.Client) (string, error) {
+	root := cfRoot{}
+	resp, err := cf.DoRequest(cf.NewRequest("GET", "/"))
+	if err != nil {
+		return "", fmt.Errorf("Error reading CF API root: %s", err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding CF API root: %s", err)
+	}
+
+	return root.version(), nil
+}
+
+type cfV2Services struct {
+	cf   *cfclient.Client
+	poll asyncPoller
+}
+
+func (c *cfV2Services) CheckServiceBroker(brokerGUID string) error {
+	_, err := c.cf.GetServiceBrokerByGuid(brokerGUID)
+	return err
+}
+
+func (c *cfV2Services) FindBrokerGUIDForService(name string) (string, error) {
+	query := url.Values{}
+	query.Add("q", "label:"+name)
+	services, err := c.cf.ListServicesByQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	brokers := []string{}
+	for _, service := range services {
+		brokers = append(brokers, service.ServiceBrokerGuid)
+	}
+
+	return onlyBroker(name, brokers)
+}
+
+func onlyBroker(serviceName string, brokerGUIDs []string) (string, error) {
+	if len(brokerGUIDs) == 0 {
+		return "", fmt.Errorf("No service named `%s' found", serviceName)
+	}
+
+	if len(brokerGUIDs) > 1 {
+		return "", fmt.Errorf("%d brokers offer a service named `%s' (%s)", len(brokerGUIDs), serviceName, strings.Join(brokerGUIDs, ", "))
+	}
+
+	return brokerGUIDs[0], nil
+}
+
+func (c *cfV2Services) ListServicePlans(brokerGUID string) ([]cfclient.ServicePlan, error) {
+	query := url.Values{}
+	query.Add("q", "service_broker_guid:"+brokerGUID)
+	return c.cf.ListServicePlansByQuery(query)
+}
+
+func (c *cfV2Services) ListServiceInstancesForPlan(planGUID string) ([]cfclient.ServiceInstance, error) {
+	query := url.Values{}
+	query.Add("q", "service_plan_guid:"+planGUID)
+	return c.cf.ListServiceInstancesByQuery(query)
+}
+
+func (c *cfV2Services) ListServiceInstanceNamesInSpace(spaceGUID string) ([]string, error) {
+	query := url.Values{}
+	query.Add("q", "space_guid:"+spaceGUID)
+	instances, err := c.cf.ListServiceInstancesByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	userProvided, err := c.cf.ListUserProvidedServiceInstancesByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, instance := range instances {
+		ret = append(ret, instance.Name)
+	}
+	for _, instance := range userProvided {
+		ret = append(ret, instance.Name)
+	}
+
+	return ret, nil
+}
+
+func (c *cfV2Services) FindServiceInstanceInSpace(spaceGUID, name string) (*cfclient.ServiceInstance, error) {
+	query := url.Values{}
+	query.Add("q", "space_guid:"+spaceGUID)
+	query.Add("q", "name:"+name)
+	instances, err := c.cf.ListServiceInstancesByQuery(query)
+	if err != nil || len(instances) == 0 {
+		return nil, err
+	}
+
+	return &instances[0], nil
+}
+
+func (c *cfV2Services) ListBindings(instanceGUID, appGUID string) ([]cfclient.ServiceBinding, error) {
+	query := url.Values{}
+	if appGUID != "" {
+		query.Add("q", "app_guid:"+appGUID)
+	}
+	query.Add("q", "service_instance_guid:"+instanceGUID)
+	return c.cf.ListServiceBindingsByQuery(query)
+}
+
+func (c *cfV2Services) PlanVisibleToOrg(plan cfclient.ServicePlan, orgGUID string) (bool, error) {
+	if plan.Public {
+		return true, nil
+	}
+
+	query := url.Values{}
+	query.Add("q", "service_plan_guid:"+plan.Guid)
+	query.Add("q", "organization_guid:"+orgGUID)
+	visibilities, err := c.cf.ListServicePlanVisibilitiesByQuery(query)
+	if err != nil {
+		return false, err
+	}
+
+	return len(visibilities) > 0, nil
+}
+
+func (c *cfV2Services) OrgGUIDForSpace(spaceGUID string) (string, error) {
+	space, err := c.cf.GetSpaceByGuid(spaceGUID)
+	if err != nil {
+		return "", err
+	}
+
+	return space.OrganizationGuid, nil
+}
+
+func (c *cfV2Services) GetSpace(spaceGUID string) (cfclient.Space, error) {
+	return c.cf.GetSpaceByGuid(spaceGUID)
+}
+
+func (c *cfV2Services) GetOrgName(orgGUID string) (string, error) {
+	org, err := c.cf.GetOrgByGuid(orgGUID)
+	if err != nil {
+		return "", err
+	}
+
+	return org.Name, nil
+}
+
+func (c *cfV2Services) GetApp(appGUID string) (*cfclient.App, error) {
+	app, err := c.cf.GetAppByGuid(appGUID)
+	if cfclient.IsAppNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+func (c *cfV2Services) ListAppsInSpace(spaceGUID string) ([]cfclient.App, error) {
+	query := url.Values{}
+	query.Add("q", "space_guid:"+spaceGUID)
+	return c.cf.ListAppsByQuery(query)
+}
+
+func (c *cfV2Services) FindOrgGUIDsByName(name string) ([]string, error) {
+	query := url.Values{}
+	query.Add("q", "name:"+name)
+	orgs, err := c.cf.ListOrgsByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, org := range orgs {
+		ret = append(ret, org.Guid)
+	}
+
+	return ret, nil
+}
+
+func (c *cfV2Services) FindSpaceGUIDsByName(orgGUID, name string) ([]string, error) {
+	query := url.Values{}
+	query.Add("q", "organization_guid:"+orgGUID)
+	query.Add("q", "name:"+name)
+	spaces, err := c.cf.ListSpacesByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, space := range spaces {
+		ret = append(ret, space.Guid)
+	}
+
+	return ret, nil
+}
+
+//cfclient asks for accepts_incomplete, so the broker may still be
+// provisioning when this returns from CF.
+func (c *cfV2Services) CreateServiceInstance(name, spaceGUID, planGUID string) (cfclient.ServiceInstance, error) {
+	instance, err := c.cf.CreateServiceInstance(cfclient.ServiceInstanceRequest{
+		Name:            name,
+		SpaceGuid:       spaceGUID,
+		ServicePlanGuid: planGUID,
+	})
+	if err != nil {
+		return instance, err
+	}
+
+	return instance, c.WaitForServiceInstance(instance)
+}
+
+func (c *cfV2Services) WaitForServiceInstance(instance cfclient.ServiceInstance) error {
+	what := fmt.Sprintf("service instance `%s'", instance.Guid)
+	done, err := lastOperationDone(what, instance.LastOperation)
+	if err != nil || done {
+		return err
+	}
+
+	return c.poll.wait(what, func() (bool, error) {
+		current, err := c.cf.GetServiceInstanceByGuid(instance.Guid)
+		if err != nil {
+			return false, fmt.Errorf("Error checking %s: %s", what, err)
+		}
+
+		return lastOperationDone(what, current.LastOperation)
+	})
+}
+
+type v2BindingResource struct {
+	Metadata struct {
+		GUID string `json:"guid"`
+	} `json:"metadata"`
+	Entity struct {
+		LastOperation cfclient.LastOperation `json:"last_operation"`
+	} `json:"entity"`
+}
+
+func (c *cfV2Services) CreateBinding(appGUID, instanceGUID string, parameters interface{}) error {
+	request := map[string]interface{}{
+		"app_guid":              appGUID,
+		"service_instance_guid": instanceGUID,
+	}
+	if parameters != nil {
+		request["parameters"] = parameters
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.cf.DoRequest(c.cf.NewRequestWithBody("POST", "/v2/service_bindings?accepts_incomplete=true", bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Unexpected response code %d", resp.StatusCode)
+	}
+
+	binding := v2BindingResource{}
+	err = json.NewDecoder(resp.Body).Decode(&binding)
+	if err != nil {
+		return fmt.Errorf("Error decoding service binding: %s", err)
+	}
+
+	what := fmt.Sprintf("service binding `%s'", binding.Metadata.GUID)
+	done, err := lastOperationDone(what, binding.Entity.LastOperation)
+	if err != nil || done || resp.StatusCode != http.StatusAccepted {
+		return err
+	}
+
+	return c.poll.wait(what, func() (bool, error) {
+		current := v2BindingResource{}
+		resp, err := c.cf.DoRequest(c.cf.NewRequest("GET", "/v2/service_bindings/"+binding.Metadata.GUID))
+		if err != nil {
+			return false, fmt.Errorf("Error checking %s: %s", what, err)
+		}
+		defer resp.Body.Close()
+
+		err = json.NewDecoder(resp.Body).Decode(&current)
+		if err != nil {
+			return false, fmt.Errorf("Error decoding %s: %s", what, err)
+		}
+
+		return lastOperationDone(what, current.Entity.LastOperation)
+	})
+}
+
+func (c *cfV2Services) GetBindingParameters(bindingGUID string) (json.RawMessage, error) {
+	return getRaw(c.cf, "/v2/service_bindings/"+bindingGUID+"/parameters")
+}
+
+func getRaw(cf *cfclient.Client, path string) (json.RawMessage, error) {
+	resp, err := cf.DoRequest(cf.NewRequest("GET", path))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+type cfV3Services struct {
+	cf   *cfclient.Client
+	poll asyncPoller
+}
+
+type v3Relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3ServicePlan struct {
+	GUID           string `json:"guid"`
+	Name           string `json:"name"`
+	VisibilityType string `json:"visibility_type"`
+}
+
+type v3ServiceInstance struct {
+	GUID          string                 `json:"guid"`
+	Name          string                 `json:"name"`
+	LastOperation cfclient.LastOperation `json:"last_operation"`
+	Relationships struct {
+		Space       v3Relationship `json:"space"`
+		ServicePlan v3Relationship `json:"service_plan"`
+	} `json:"relationships"`
+}
+
+func (s v3ServiceInstance) toV2() cfclient.ServiceInstance {
+	return cfclient.ServiceInstance{
+		Guid:            s.GUID,
+		Name:            s.Name,
+		SpaceGuid:       s.Relationships.Space.Data.GUID,
+		ServicePlanGuid: s.Relationships.ServicePlan.Data.GUID,
+		LastOperation:   s.LastOperation,
+	}
+}
+
+type v3CredentialBinding struct {
+	GUID          string `json:"guid"`
+	Relationships struct {
+		App             v3Relationship `json:"app"`
+		ServiceInstance v3Relationship `json:"service_instance"`
+	} `json:"relationships"`
+}
+
+type v3App struct {
+	GUID  string `json:"guid"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+func (a v3App) toV2(instances int) cfclient.App {
+	return cfclient.App{
+		Guid:      a.GUID,
+		Name:      a.Name,
+		State:     a.State,
+		Instances: instances,
+	}
+}
+
+type v3Process struct {
+	Instances     int `json:"instances"`
+	Relationships struct {
+		App v3Relationship `json:"app"`
+	} `json:"relationships"`
+}
+
+type v3Job struct {
+	GUID   string `json:"guid"`
+	State  string `json:"state"`
+	Errors []struct {
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+func (c *cfV3Services) CheckServiceBroker(brokerGUID string) error {
+	return c.get("/v3/service_brokers/"+brokerGUID, nil)
+}
+
+func (c *cfV3Services) FindBrokerGUIDForService(name string) (string, error) {
+	query := url.Values{}
+	query.Set("names", name)
+	brokers := []string{}
+	err := c.list("/v3/service_offerings", query, func(raw json.RawMessage) error {
+		offering := struct {
+			Relationships struct {
+				ServiceBroker v3Relationship `json:"service_broker"`
+			} `json:"relationships"`
+		}{}
+		err := json.Unmarshal(raw, &offering)
+		if err != nil {
+			return err
+		}
+
+		brokers = append(brokers, offering.Relationships.ServiceBroker.Data.GUID)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return onlyBroker(name, brokers)
+}
+
+func (c *cfV3Services) ListServicePlans(brokerGUID string) ([]cfclient.ServicePlan, error) {
+	query := url.Values{}
+	query.Set("service_broker_guids", brokerGUID)
+	ret := []cfclient.ServicePlan{}
+	err := c.list("/v3/service_plans", query, func(raw json.RawMessage) error {
+		plan := v3ServicePlan{}
+		err := json.Unmarshal(raw, &plan)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, cfclient.ServicePlan{
+			Guid:   plan.GUID,
+			Name:   plan.Name,
+			Public: plan.VisibilityType == "public",
+		})
+		return nil
+	})
+
+	return ret, err
+}
+
+func (c *cfV3Services) listServiceInstances(query url.Values) ([]cfclient.ServiceInstance, error) {
+	ret := []cfclient.ServiceInstance{}
+	err := c.list("/v3/service_instances", query, func(raw json.RawMessage) error {
+		instance := v3ServiceInstance{}
+		err := json.Unmarshal(raw, &instance)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, instance.toV2())
+		return nil
+	})
+
+	return ret, err
+}
+
+func (c *cfV3Services) ListServiceInstancesForPlan(planGUID string) ([]cfclient.ServiceInstance, error) {
+	query := url.Values{}
+	query.Set("service_plan_guids", planGUID)
+	return c.listServiceInstances(query)
+}
+
+func (c *cfV3Services) ListServiceInstanceNamesInSpace(spaceGUID string) ([]string, error) {
+	query := url.Values{}
+	query.Set("space_guids", spaceGUID)
+	instances, err := c.listServiceInstances(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, instance := range instances {
+		ret = append(ret, instance.Name)
+	}
+
+	return ret, nil
+}
+
+func (c *cfV3Services) FindServiceInstanceInSpace(spaceGUID, name string) (*cfclient.ServiceInstance, error) {
+	query := url.Values{}
+	query.Set("space_guids", spaceGUID)
+	query.Set("names", name)
+	instances, err := c.listServiceInstances(query)
+	if err != nil || len(instances) == 0 {
+		return nil, err
+	}
+
+	return &instances[0], nil
+}
+
+func (c *cfV3Services) ListBindings(instanceGUID, appGUID string) ([]cfclient.ServiceBinding, error) {
+	query := url.Values{}
+	query.Set("type", "app")
+	query.Set("service_instance_guids", instanceGUID)
+	if appGUID != "" {
+		query.Set("app_guids", appGUID)
+	}
+
+	ret := []cfclient.ServiceBinding{}
+	err := c.list("/v3/service_credential_bindings", query, func(raw json.RawMessage) error {
+		binding := v3CredentialBinding{}
+		err := json.Unmarshal(raw, &binding)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, cfclient.ServiceBinding{
+			Guid:                binding.GUID,
+			AppGuid:             binding.Relationships.App.Data.GUID,
+			ServiceInstanceGuid: binding.Relationships.ServiceInstance.Data.GUID,
+		})
+		return nil
+	})
+
+	return ret, err
+}
+
+func (c *cfV3Services) PlanVisibleToOrg(plan cfclient.ServicePlan, orgGUID string) (bool, error) {
+	if plan.Public {
+		return true, nil
+	}
+
+	visibility := struct {
+		Type          string `json:"type"`
+		Organizations []struct {
+			GUID string `json:"guid"`
+		} `json:"organizations"`
+	}{}
+	err := c.get("/v3/service_plans/"+plan.Guid+"/visibility", &visibility)
+	if err != nil {
+		return false, err
+	}
+
+	if visibility.Type == "public" {
+		return true, nil
+	}
+
+	for _, org := range visibility.Organizations {
+		if org.GUID == orgGUID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *cfV3Services) OrgGUIDForSpace(spaceGUID string) (string, error) {
+	space, err := c.GetSpace(spaceGUID)
+	if err != nil {
+		return "", err
+	}
+
+	return space.OrganizationGuid, nil
+}
+
+func (c *cfV3Services) GetSpace(spaceGUID string) (cfclient.Space, error) {
+	space := struct {
+		GUID          string `json:"guid"`
+		Name          string `json:"name"`
+		Relationships struct {
+			Organization v3Relationship `json:"organization"`
+		} `json:"relationships"`
+	}{}
+	err := c.get("/v3/spaces/"+spaceGUID, &space)
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+
+	return cfclient.Space{
+		Guid:             space.GUID,
+		Name:             space.Name,
+		OrganizationGuid: space.Relationships.Organization.Data.GUID,
+	}, nil
+}
+
+func (c *cfV3Services) GetOrgName(orgGUID string) (string, error) {
+	org := struct {
+		Name string `json:"name"`
+	}{}
+	err := c.get("/v3/organizations/"+orgGUID, &org)
+	return org.Name, err
+}
+
+//Instance counts belong to an app's processes in v3, so this takes a second
+// request for its web process.
+func (c *cfV3Services) GetApp(appGUID string) (*cfclient.App, error) {
+	app := v3App{}
+	err := c.get("/v3/apps/"+appGUID, &app)
+	if cfclient.IsResourceNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	web := v3Process{}
+	err = c.get("/v3/apps/"+appGUID+"/processes/web", &web)
+	//An app without a web process runs no instances of it
+	if err != nil && !cfclient.IsResourceNotFoundError(err) {
+		return nil, err
+	}
+
+	ret := app.toV2(web.Instances)
+	return &ret, nil
+}
+
+func (c *cfV3Services) ListAppsInSpace(spaceGUID string) ([]cfclient.App, error) {
+	processQuery := url.Values{}
+	processQuery.Set("space_guids", spaceGUID)
+	processQuery.Set("types", "web")
+	//app GUID -> web process instances
+	instances := map[string]int{}
+	err := c.list("/v3/processes", processQuery, func(raw json.RawMessage) error {
+		process := v3Process{}
+		err := json.Unmarshal(raw, &process)
+		if err != nil {
+			return err
+		}
+
+		instances[process.Relationships.App.Data.GUID] = process.Instances
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	appQuery := url.Values{}
+	appQuery.Set("space_guids", spaceGUID)
+	ret := []cfclient.App{}
+	err = c.list("/v3/apps", appQuery, func(raw json.RawMessage) error {
+		app := v3App{}
+		err := json.Unmarshal(raw, &app)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, app.toV2(instances[app.GUID]))
+		return nil
+	})
+
+	return ret, err
+}
+
+func (c *cfV3Services) FindOrgGUIDsByName(name string) ([]string, error) {
+	query := url.Values{}
+	query.Set("names", name)
+	return c.listGUIDs("/v3/organizations", query)
+}
+
+func (c *cfV3Services) FindSpaceGUIDsByName(orgGUID, name string) ([]string, error) {
+	query := url.Values{}
+	query.Set("organization_guids", orgGUID)
+	query.Set("names", name)
+	return c.listGUIDs("/v3/spaces", query)
+}
+
+func (c *cfV3Services) listGUIDs(path string, query url.Values) ([]string, error) {
+	ret := []string{}
+	err := c.list(path, query, func(raw json.RawMessage) error {
+		resource := struct {
+			GUID string `json:"guid"`
+		}{}
+		err := json.Unmarshal(raw, &resource)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, resource.GUID)
+		return nil
+	})
+
+	return ret, err
+}
+
+//Creating a managed service instance is asynchronous in v3, so this waits for
+// the job and then looks the new instance up by name.
+func (c *cfV3Services) CreateServiceInstance(name, spaceGUID, planGUID string) (cfclient.ServiceInstance, error) {
+	body := map[string]interface{}{
+		"type": "managed",
+		"name": name,
+		"relationships": map[string]interface{}{
+			"space":        map[string]interface{}{"data": map[string]string{"guid": spaceGUID}},
+			"service_plan": map[string]interface{}{"data": map[string]string{"guid": planGUID}},
+		},
+	}
+
+	err := c.postAndWait("/v3/service_instances", body)
+	if err != nil {
+		return cfclient.ServiceInstance{}, err
+	}
+
+	instance, err := c.FindServiceInstanceInSpace(spaceGUID, name)
+	if err != nil {
+		return cfclient.ServiceInstance{}, err
+	}
+	if instance == nil {
+		return cfclient.ServiceInstance{}, fmt.Errorf("Service instance `%s' was not found after creating it", name)
+	}
+
+	//The job only covers CF's side; the broker may still be provisioning
+	return *instance, c.WaitForServiceInstance(*instance)
+}
+
+func (c *cfV3Services) WaitForServiceInstance(instance cfclient.ServiceInstance) error {
+	what := fmt.Sprintf("service instance `%s'", instance.Guid)
+	done, err := lastOperationDone(what, instance.LastOperation)
+	if err != nil || done {
+		return err
+	}
+
+	return c.poll.wait(what, func() (bool, error) {
+		current := v3ServiceInstance{}
+		err := c.get("/v3/service_instances/"+instance.Guid, &current)
+		if err != nil {
+			return false, fmt.Errorf("Error checking %s: %s", what, err)
+		}
+
+		return lastOperationDone(what, current.LastOperation)
+	})
+}
+
+func (c *cfV3Services) CreateBinding(appGUID, instanceGUID string, parameters interface{}) error {
+	body := map[string]interface{}{
+		"type": "app",
+		"relationships": map[string]interface{}{
+			"app":              map[string]interface{}{"data": map[string]string{"guid": appGUID}},
+			"service_instance": map[string]interface{}{"data": map[string]string{"guid": instanceGUID}},
+		},
+	}
+	if parameters != nil {
+		body["parameters"] = parameters
+	}
+
+	return c.postAndWait("/v3/service_credential_bindings", body)
+}
+
+func (c *cfV3Services) GetBindingParameters(bindingGUID string) (json.RawMessage, error) {
+	return getRaw(c.cf, "/v3/service_credential_bindings/"+bindingGUID+"/parameters")
+}
+
+//out may be nil if the response body isn't needed.
+func (c *cfV3Services) get(path string, out interface{}) error {
+	resp, err := c.cf.DoRequest(c.cf.NewRequest("GET", path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("Error decoding response from `%s': %s", path, err)
+	}
+
+	return nil
+}
+
+//Calls fn with each resource on every page of the list.
+func (c *cfV3Services) list(path string, query url.Values, fn func(json.RawMessage) error) error {
+	query.Set("per_page", "5000")
+	next := path + "?" + query.Encode()
+	for next != "" {
+		page := struct {
+			Pagination struct {
+				Next *struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			Resources []json.RawMessage `json:"resources"`
+		}{}
+
+		err := c.get(next, &page)
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range page.Resources {
+			err = fn(resource)
+			if err != nil {
+				return err
+			}
+		}
+
+		next = ""
+		if page.Pagination.Next != nil && page.Pagination.Next.Href != "" {
+			nextURL, err := url.Parse(page.Pagination.Next.Href)
+			if err != nil {
+				return fmt.Errorf("Error parsing next page URL: %s", err)
+			}
+
+			next = nextURL.RequestURI()
+		}
+	}
+
+	return nil
+}
+
+func (c *cfV3Services) postAndWait(path string, body interface{}) error {
+	return c.sendAndWait("POST", path, body)
+}
+
+//Sends body to path. If the API responds with a job, waits for it to finish.
+func (c *cfV3Services) sendAndWait(method, path string, body interface{}) error {
+	req := c.cf.NewRequest(method, path)
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		req = c.cf.NewRequestWithBody(method, path, bytes.NewReader(encoded))
+	}
+
+	resp, err := c.cf.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return nil
+	}
+
+	jobURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || jobURL.Path == "" {
+		return fmt.Errorf("API accepted `%s' without a job to wait for", path)
+	}
+
+	return c.waitForJob(jobURL.RequestURI())
+}
+
+//Failed jobs carry the broker's description of what went wrong in their
+// errors.
+func (c *cfV3Services) waitForJob(path string) error {
+	return c.poll.wait(fmt.Sprintf("job `%s'", path), func() (bool, error) {
+		job := v3Job{}
+		err := c.get(path, &job)
+		if err != nil {
+			return false, fmt.Errorf("Error checking job: %s", err)
+		}
+
+		switch job.State {
+		case "COMPLETE":
+			return true, nil
+
+		case "FAILED":
+			details := []string{}
+			for _, jobErr := range job.Errors {
+				details = append(details, jobErr.Detail)
+			}
+			return false, fmt.Errorf("Job `%s' failed: %s", job.GUID, strings.Join(details, "; "))
+		}
+
+		return false, nil
+	})
+}
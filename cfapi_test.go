@@ -0,0 +1,703 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+//fakeServices is an in-memory serviceAPI for one broker.
+type fakeServices struct {
+	lock  sync.Mutex
+	plans []cfclient.ServicePlan
+	//plan GUID + "/" + org GUID -> visible, for plans which aren't public
+	visible map[string]bool
+	//space GUID -> org GUID
+	spaceOrgs map[string]string
+	//space or org GUID -> name
+	names map[string]string
+	//Apps with SpaceGuid set to the space they are in
+	apps      []cfclient.App
+	instances []cfclient.ServiceInstance
+	//space GUID -> names of service instances of other services
+	otherInstances map[string][]string
+	bindings       []fakeBinding
+	nextGUID       int
+
+	//Set to make the matching call fail
+	createBindingErr error
+	//binding GUID -> error
+	bindingParamsErr map[string]error
+	//Every mutating call, in order
+	calls []string
+}
+
+type fakeBinding struct {
+	cfclient.ServiceBinding
+	parameters json.RawMessage
+}
+
+func (f *fakeServices) guid(prefix string) string {
+	f.nextGUID++
+	return fmt.Sprintf("%s-%d", prefix, f.nextGUID)
+}
+
+func (f *fakeServices) CheckServiceBroker(brokerGUID string) error {
+	return nil
+}
+
+func (f *fakeServices) FindBrokerGUIDForService(name string) (string, error) {
+	return "broker", nil
+}
+
+func (f *fakeServices) ListServicePlans(brokerGUID string) ([]cfclient.ServicePlan, error) {
+	return f.plans, nil
+}
+
+func (f *fakeServices) ListServiceInstancesForPlan(planGUID string) ([]cfclient.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := []cfclient.ServiceInstance{}
+	for _, instance := range f.instances {
+		if instance.ServicePlanGuid == planGUID {
+			ret = append(ret, instance)
+		}
+	}
+
+	return ret, nil
+}
+
+func (f *fakeServices) ListServiceInstanceNamesInSpace(spaceGUID string) ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := append([]string{}, f.otherInstances[spaceGUID]...)
+	for _, instance := range f.instances {
+		if instance.SpaceGuid == spaceGUID {
+			ret = append(ret, instance.Name)
+		}
+	}
+
+	return ret, nil
+}
+
+func (f *fakeServices) FindServiceInstanceInSpace(spaceGUID, name string) (*cfclient.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i := range f.instances {
+		if f.instances[i].SpaceGuid == spaceGUID && f.instances[i].Name == name {
+			instance := f.instances[i]
+			return &instance, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (f *fakeServices) ListBindings(instanceGUID, appGUID string) ([]cfclient.ServiceBinding, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := []cfclient.ServiceBinding{}
+	for _, binding := range f.bindings {
+		if binding.ServiceInstanceGuid == instanceGUID && (appGUID == "" || binding.AppGuid == appGUID) {
+			ret = append(ret, binding.ServiceBinding)
+		}
+	}
+
+	return ret, nil
+}
+
+func (f *fakeServices) PlanVisibleToOrg(plan cfclient.ServicePlan, orgGUID string) (bool, error) {
+	return plan.Public || f.visible[plan.Guid+"/"+orgGUID], nil
+}
+
+func (f *fakeServices) OrgGUIDForSpace(spaceGUID string) (string, error) {
+	orgGUID, found := f.spaceOrgs[spaceGUID]
+	if !found {
+		return "", fmt.Errorf("no space with GUID `%s'", spaceGUID)
+	}
+
+	return orgGUID, nil
+}
+
+func (f *fakeServices) GetSpace(spaceGUID string) (cfclient.Space, error) {
+	orgGUID, err := f.OrgGUIDForSpace(spaceGUID)
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+
+	return cfclient.Space{Guid: spaceGUID, Name: f.names[spaceGUID], OrganizationGuid: orgGUID}, nil
+}
+
+func (f *fakeServices) GetOrgName(orgGUID string) (string, error) {
+	return f.names[orgGUID], nil
+}
+
+func (f *fakeServices) GetApp(appGUID string) (*cfclient.App, error) {
+	for i := range f.apps {
+		if f.apps[i].Guid == appGUID {
+			app := f.apps[i]
+			return &app, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (f *fakeServices) ListAppsInSpace(spaceGUID string) ([]cfclient.App, error) {
+	ret := []cfclient.App{}
+	for _, app := range f.apps {
+		if app.SpaceGuid == spaceGUID {
+			ret = append(ret, app)
+		}
+	}
+
+	return ret, nil
+}
+
+func (f *fakeServices) FindOrgGUIDsByName(name string) ([]string, error) {
+	found := map[string]bool{}
+	for _, orgGUID := range f.spaceOrgs {
+		if f.names[orgGUID] == name {
+			found[orgGUID] = true
+		}
+	}
+
+	return sortedKeys(found), nil
+}
+
+func (f *fakeServices) FindSpaceGUIDsByName(orgGUID, name string) ([]string, error) {
+	found := map[string]bool{}
+	for spaceGUID, spaceOrgGUID := range f.spaceOrgs {
+		if spaceOrgGUID == orgGUID && f.names[spaceGUID] == name {
+			found[spaceGUID] = true
+		}
+	}
+
+	return sortedKeys(found), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	ret := []string{}
+	for key := range m {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+func (f *fakeServices) CreateServiceInstance(name, spaceGUID, planGUID string) (cfclient.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, "create-service "+name)
+	instance := cfclient.ServiceInstance{
+		Guid:            f.guid("instance"),
+		Name:            name,
+		SpaceGuid:       spaceGUID,
+		ServicePlanGuid: planGUID,
+	}
+	f.instances = append(f.instances, instance)
+	return instance, nil
+}
+
+func (f *fakeServices) WaitForServiceInstance(instance cfclient.ServiceInstance) error {
+	return nil
+}
+
+func (f *fakeServices) CreateBinding(appGUID, instanceGUID string, parameters interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, "bind "+appGUID)
+	if f.createBindingErr != nil {
+		return f.createBindingErr
+	}
+
+	binding := fakeBinding{ServiceBinding: cfclient.ServiceBinding{
+		Guid:                f.guid("binding"),
+		AppGuid:             appGUID,
+		ServiceInstanceGuid: instanceGUID,
+	}}
+	if parameters != nil {
+		var err error
+		binding.parameters, err = json.Marshal(parameters)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.bindings = append(f.bindings, binding)
+	return nil
+}
+
+func (f *fakeServices) GetBindingParameters(bindingGUID string) (json.RawMessage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.bindingParamsErr[bindingGUID]; err != nil {
+		return nil, err
+	}
+
+	for _, binding := range f.bindings {
+		if binding.Guid == bindingGUID {
+			if binding.parameters == nil {
+				return json.RawMessage("{}"), nil
+			}
+			return binding.parameters, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no binding with GUID `%s'", bindingGUID)
+}
+
+//v3Server serves canned responses keyed by method and path, and records every
+// request it gets. Responses for a key are used in order, and the last one is
+// repeated. Anything without a response is not found.
+type v3Server struct {
+	responses map[string][]v3Response
+	//Method and request URI of each request
+	requests []string
+	//Method and path -> body of the last request
+	bodies map[string]string
+}
+
+type v3Response struct {
+	status   int
+	location string
+	body     string
+}
+
+func (s *v3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies[key] = string(body)
+
+	responses := s.responses[key]
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors": [{"code": 10010, "title": "CF-ResourceNotFound", "detail": "Not found"}]}`))
+		return
+	}
+
+	resp := responses[0]
+	if len(responses) > 1 {
+		s.responses[key] = responses[1:]
+	}
+
+	if resp.location != "" {
+		w.Header().Set("Location", resp.location)
+	}
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+func testV3Services(t *testing.T, responses map[string][]v3Response) (*cfV3Services, *v3Server) {
+	server := &v3Server{responses: responses, bodies: map[string]string{}}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+
+	cf := &cfclient.Client{Config: cfclient.Config{ApiAddress: srv.URL, HttpClient: srv.Client(), UserAgent: "test"}}
+	return &cfV3Services{cf: cf, poll: asyncPoller{interval: time.Millisecond, timeout: 50 * time.Millisecond}}, server
+}
+
+func TestCFV3ServicesLookups(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string][]v3Response
+		//Describes the result in the fields that are filled in
+		call         func(c *cfV3Services) (string, error)
+		want         string
+		wantRequests []string
+	}{
+		{
+			name: "service instances for a plan over two pages",
+			responses: map[string][]v3Response{
+				"GET /v3/service_instances": {
+					{body: `{
+						"pagination": {"next": {"href": "https://api.example.com/v3/service_instances?page=2&per_page=5000&service_plan_guids=plan-1"}},
+						"resources": [{"guid": "instance-1", "name": "autoscaler", "last_operation": {"type": "create", "state": "succeeded"},
+							"relationships": {"space": {"data": {"guid": "space-1"}}, "service_plan": {"data": {"guid": "plan-1"}}}}]
+					}`},
+					{body: `{
+						"pagination": {"next": null},
+						"resources": [{"guid": "instance-2", "name": "autoscaler",
+							"relationships": {"space": {"data": {"guid": "space-2"}}, "service_plan": {"data": {"guid": "plan-1"}}}}]
+					}`},
+				},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				instances, err := c.ListServiceInstancesForPlan("plan-1")
+				ret := []string{}
+				for _, instance := range instances {
+					ret = append(ret, fmt.Sprintf("%s %s %s %s %s", instance.Guid, instance.Name, instance.SpaceGuid, instance.ServicePlanGuid, instance.LastOperation.State))
+				}
+				return strings.Join(ret, ", "), err
+			},
+			want: "instance-1 autoscaler space-1 plan-1 succeeded, instance-2 autoscaler space-2 plan-1 ",
+			wantRequests: []string{
+				"GET /v3/service_instances?per_page=5000&service_plan_guids=plan-1",
+				"GET /v3/service_instances?page=2&per_page=5000&service_plan_guids=plan-1",
+			},
+		},
+		{
+			name: "app bindings of an instance",
+			responses: map[string][]v3Response{
+				"GET /v3/service_credential_bindings": {{body: `{"resources": [
+					{"guid": "binding-1", "relationships": {"app": {"data": {"guid": "app-1"}}, "service_instance": {"data": {"guid": "instance-1"}}}}
+				]}`}},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				bindings, err := c.ListBindings("instance-1", "app-1")
+				ret := []string{}
+				for _, binding := range bindings {
+					ret = append(ret, fmt.Sprintf("%s %s %s", binding.Guid, binding.AppGuid, binding.ServiceInstanceGuid))
+				}
+				return strings.Join(ret, ", "), err
+			},
+			want:         "binding-1 app-1 instance-1",
+			wantRequests: []string{"GET /v3/service_credential_bindings?app_guids=app-1&per_page=5000&service_instance_guids=instance-1&type=app"},
+		},
+		{
+			name: "apps in a space with their web instances",
+			responses: map[string][]v3Response{
+				"GET /v3/processes": {{body: `{"resources": [
+					{"type": "web", "instances": 3, "relationships": {"app": {"data": {"guid": "app-1"}}}}
+				]}`}},
+				"GET /v3/apps": {{body: `{"resources": [
+					{"guid": "app-1", "name": "web", "state": "STARTED"},
+					{"guid": "app-2", "name": "worker", "state": "STOPPED"}
+				]}`}},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				apps, err := c.ListAppsInSpace("space-1")
+				ret := []string{}
+				for _, app := range apps {
+					ret = append(ret, fmt.Sprintf("%s %s %s %d", app.Guid, app.Name, app.State, app.Instances))
+				}
+				return strings.Join(ret, ", "), err
+			},
+			want: "app-1 web STARTED 3, app-2 worker STOPPED 0",
+			wantRequests: []string{
+				"GET /v3/processes?per_page=5000&space_guids=space-1&types=web",
+				"GET /v3/apps?per_page=5000&space_guids=space-1",
+			},
+		},
+		{
+			name: "app by GUID",
+			responses: map[string][]v3Response{
+				"GET /v3/apps/app-1":               {{body: `{"guid": "app-1", "name": "web", "state": "STARTED"}`}},
+				"GET /v3/apps/app-1/processes/web": {{body: `{"type": "web", "instances": 2}`}},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				app, err := c.GetApp("app-1")
+				if app == nil {
+					return "nil", err
+				}
+				return fmt.Sprintf("%s %s %s %d", app.Guid, app.Name, app.State, app.Instances), err
+			},
+			want:         "app-1 web STARTED 2",
+			wantRequests: []string{"GET /v3/apps/app-1", "GET /v3/apps/app-1/processes/web"},
+		},
+		{
+			name: "app which doesn't exist",
+			call: func(c *cfV3Services) (string, error) {
+				app, err := c.GetApp("app-1")
+				if app == nil {
+					return "nil", err
+				}
+				return app.Guid, err
+			},
+			want:         "nil",
+			wantRequests: []string{"GET /v3/apps/app-1"},
+		},
+		{
+			name: "space and its org",
+			responses: map[string][]v3Response{
+				"GET /v3/spaces/space-1":      {{body: `{"guid": "space-1", "name": "one", "relationships": {"organization": {"data": {"guid": "org-1"}}}}`}},
+				"GET /v3/organizations/org-1": {{body: `{"guid": "org-1", "name": "a"}`}},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				space, err := c.GetSpace("space-1")
+				if err != nil {
+					return "", err
+				}
+				orgName, err := c.GetOrgName(space.OrganizationGuid)
+				return fmt.Sprintf("%s %s %s %s", space.Guid, space.Name, space.OrganizationGuid, orgName), err
+			},
+			want:         "space-1 one org-1 a",
+			wantRequests: []string{"GET /v3/spaces/space-1", "GET /v3/organizations/org-1"},
+		},
+		{
+			name: "orgs and spaces by name",
+			responses: map[string][]v3Response{
+				"GET /v3/organizations": {{body: `{"resources": [{"guid": "org-1"}]}`}},
+				"GET /v3/spaces":        {{body: `{"resources": [{"guid": "space-1"}, {"guid": "space-2"}]}`}},
+			},
+			call: func(c *cfV3Services) (string, error) {
+				orgs, err := c.FindOrgGUIDsByName("a")
+				if err != nil {
+					return "", err
+				}
+				spaces, err := c.FindSpaceGUIDsByName(orgs[0], "one")
+				return fmt.Sprint(orgs, spaces), err
+			},
+			want: "[org-1] [space-1 space-2]",
+			wantRequests: []string{
+				"GET /v3/organizations?names=a&per_page=5000",
+				"GET /v3/spaces?names=one&organization_guids=org-1&per_page=5000",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, server := testV3Services(t, test.responses)
+			got, err := test.call(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if fmt.Sprint(server.requests) != fmt.Sprint(test.wantRequests) {
+				t.Errorf("got requests %v, want %v", server.requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCFV3ServicesCreateBinding(t *testing.T) {
+	accepted := v3Response{status: http.StatusAccepted, location: "https://api.example.com/v3/jobs/job-1"}
+	processing := v3Response{body: `{"guid": "job-1", "state": "PROCESSING"}`}
+
+	tests := []struct {
+		name       string
+		parameters interface{}
+		responses  map[string][]v3Response
+		wantBody   string
+		//Number of times the job is checked
+		wantPolls int
+		wantErr   string
+	}{
+		{
+			name:       "job completes",
+			parameters: map[string]int{"instance_min_count": 1},
+			responses: map[string][]v3Response{
+				"POST /v3/service_credential_bindings": {accepted},
+				"GET /v3/jobs/job-1":                   {processing, {body: `{"guid": "job-1", "state": "COMPLETE"}`}},
+			},
+			wantBody: `{"type": "app", "parameters": {"instance_min_count": 1}, "relationships": {
+				"app": {"data": {"guid": "app-1"}}, "service_instance": {"data": {"guid": "instance-1"}}}}`,
+			wantPolls: 2,
+		},
+		{
+			name: "created without a job",
+			responses: map[string][]v3Response{
+				"POST /v3/service_credential_bindings": {{status: http.StatusCreated, body: `{"guid": "binding-1"}`}},
+			},
+			wantBody: `{"type": "app", "relationships": {
+				"app": {"data": {"guid": "app-1"}}, "service_instance": {"data": {"guid": "instance-1"}}}}`,
+		},
+		{
+			name: "job fails",
+			responses: map[string][]v3Response{
+				"POST /v3/service_credential_bindings": {accepted},
+				"GET /v3/jobs/job-1": {processing, {body: `{"guid": "job-1", "state": "FAILED",
+					"errors": [{"detail": "Service broker error: bad policy"}, {"detail": "try again"}]}`}},
+			},
+			wantPolls: 2,
+			wantErr:   "Job `job-1' failed: Service broker error: bad policy; try again",
+		},
+		{
+			name: "job never finishes",
+			responses: map[string][]v3Response{
+				"POST /v3/service_credential_bindings": {accepted},
+				"GET /v3/jobs/job-1":                   {processing},
+			},
+			wantErr: "Timed out after 50ms waiting for job `/v3/jobs/job-1'",
+		},
+		{
+			name: "accepted without a job",
+			responses: map[string][]v3Response{
+				"POST /v3/service_credential_bindings": {{status: http.StatusAccepted}},
+			},
+			wantErr: "API accepted `/v3/service_credential_bindings' without a job to wait for",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, server := testV3Services(t, test.responses)
+			err := c.CreateBinding("app-1", "instance-1", test.parameters)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.wantBody != "" {
+				assertSameJSON(t, server.bodies["POST /v3/service_credential_bindings"], test.wantBody)
+			}
+
+			polls := 0
+			for _, request := range server.requests {
+				if request == "GET /v3/jobs/job-1" {
+					polls++
+				}
+			}
+			//A timeout polls as often as it can, so only check the count if
+			// the job finished
+			if test.wantPolls != 0 && polls != test.wantPolls {
+				t.Errorf("got %d job checks, want %d", polls, test.wantPolls)
+			}
+		})
+	}
+}
+
+func TestCFV3ServicesCreateServiceInstance(t *testing.T) {
+	c, server := testV3Services(t, map[string][]v3Response{
+		"POST /v3/service_instances": {{status: http.StatusAccepted, location: "https://api.example.com/v3/jobs/job-1"}},
+		"GET /v3/jobs/job-1":         {{body: `{"guid": "job-1", "state": "COMPLETE"}`}},
+		"GET /v3/service_instances": {{body: `{"resources": [{"guid": "instance-1", "name": "autoscaler",
+			"last_operation": {"type": "create", "state": "in progress"},
+			"relationships": {"space": {"data": {"guid": "space-1"}}, "service_plan": {"data": {"guid": "plan-1"}}}}]}`}},
+		"GET /v3/service_instances/instance-1": {{body: `{"guid": "instance-1", "last_operation": {"type": "create", "state": "succeeded"}}`}},
+	})
+
+	instance, err := c.CreateServiceInstance("autoscaler", "space-1", "plan-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Guid != "instance-1" || instance.SpaceGuid != "space-1" || instance.ServicePlanGuid != "plan-1" {
+		t.Errorf("got instance %+v, want instance-1 in space-1 on plan-1", instance)
+	}
+
+	assertSameJSON(t, server.bodies["POST /v3/service_instances"], `{"type": "managed", "name": "autoscaler", "relationships": {
+		"space": {"data": {"guid": "space-1"}}, "service_plan": {"data": {"guid": "plan-1"}}}}`)
+
+	want := []string{
+		"POST /v3/service_instances",
+		"GET /v3/jobs/job-1",
+		"GET /v3/service_instances?names=autoscaler&per_page=5000&space_guids=space-1",
+		//The broker was still provisioning after the job finished
+		"GET /v3/service_instances/instance-1",
+	}
+	if fmt.Sprint(server.requests) != fmt.Sprint(want) {
+		t.Errorf("got requests %v, want %v", server.requests, want)
+	}
+}
+
+func assertSameJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	err := json.Unmarshal([]byte(got), &gotValue)
+	if err != nil {
+		t.Fatalf("Error decoding %q: %s", got, err)
+	}
+	err = json.Unmarshal([]byte(want), &wantValue)
+	if err != nil {
+		t.Fatalf("Error decoding %q: %s", want, err)
+	}
+
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestNewCFClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		rootLinks   string
+		wantVersion string
+		wantV2Info  bool
+	}{
+		{
+			name:        "v2 and v3",
+			rootLinks:   `"cloud_controller_v2": {"href": "%[1]s/v2"}, "cloud_controller_v3": {"href": "%[1]s/v3"}, "uaa": {"href": "%[1]s"}`,
+			wantVersion: cfAPIV2,
+			wantV2Info:  true,
+		},
+		{
+			name:        "v3 only",
+			rootLinks:   `"cloud_controller_v2": null, "cloud_controller_v3": {"href": "%[1]s/v3"}, "uaa": {"href": "%[1]s/"}`,
+			wantVersion: cfAPIV3,
+		},
+		{
+			name:        "v3 only with just a login link",
+			rootLinks:   `"cloud_controller_v3": {"href": "%[1]s/v3"}, "login": {"href": "%[1]s"}`,
+			wantVersion: cfAPIV3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotV2Info := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				base := "http://" + r.Host
+				switch r.URL.Path {
+				case "/":
+					fmt.Fprintf(w, `{"links": {`+test.rootLinks+`}}`, base)
+				case "/v2/info":
+					gotV2Info = true
+					fmt.Fprintf(w, `{"token_endpoint": "%s"}`, base)
+				case "/oauth/token":
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"access_token": "token-1", "token_type": "bearer", "expires_in": 3600}`))
+				case "/v3/spaces/space-1":
+					if r.Header.Get("Authorization") != "Bearer token-1" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.Write([]byte(`{"guid": "space-1", "name": "one"}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			cf, err := newCFClient(&cfclient.Config{
+				ApiAddress:   srv.URL,
+				ClientID:     "as2as",
+				ClientSecret: "secret",
+				HttpClient:   srv.Client(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotV2Info != test.wantV2Info {
+				t.Errorf("got /v2/info read %t, want %t", gotV2Info, test.wantV2Info)
+			}
+
+			token, err := cf.GetToken()
+			if err != nil || token != "bearer token-1" {
+				t.Errorf("got token %q and error %v, want bearer token-1", token, err)
+			}
+
+			version, err := detectCFAPIVersion(cf)
+			if err != nil || version != test.wantVersion {
+				t.Errorf("got API version %q and error %v, want %s", version, err, test.wantVersion)
+			}
+
+			services := &cfV3Services{cf: cf}
+			space, err := services.GetSpace("space-1")
+			if err != nil || space.Name != "one" {
+				t.Errorf("got space %+v and error %v from an authed request, want space one", space, err)
+			}
+		})
+	}
+}
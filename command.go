@@ -1,6 +1,10 @@
 package main
 
-import "gopkg.in/alecthomas/kingpin.v2"
+import (
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/trace"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
 
 type command interface {
 	Run() error
@@ -9,3 +13,15 @@ type command interface {
 var app = kingpin.New("as2as", "PCF Autoscaler to OCF Autoscaler Migration Tool")
 var cmdIndex = map[string]command{}
 var globalTrace = app.Flag("trace", "Show HTTP trace").Short('T').Bool()
+var globalTraceFile = app.Flag("trace-file", "Write the HTTP trace to this file instead of stderr. Implies --trace").String()
+var globalTraceFormat = app.Flag("trace-format", "The format to write the HTTP trace in (text, har)").Default(string(trace.FormatText)).Enum(string(trace.FormatText), string(trace.FormatHAR))
+var globalLogLevel = app.Flag("log-level", "The minimum level of log messages to show (debug, info, warn, error)").Default("info").Enum("debug", "info", "warn", "error")
+var globalLogFormat = app.Flag("log-format", "The format to write log messages in (text, json)").Default(string(logger.FormatText)).Enum(string(logger.FormatText), string(logger.FormatJSON))
+var globalNoProgress = app.Flag("no-progress", "Do not show progress while dumping or syncing").Bool()
+var globalProgressInterval = app.Flag("progress-interval", "How often to log a progress summary when stderr is not a terminal").Default("10s").Duration()
+var globalTraceUnredacted = app.Flag("trace-unredacted", "Do not redact auth headers and credentials in the HTTP trace").Bool()
+var globalAsyncPollInterval = app.Flag("async-poll-interval", "How often to check on asynchronous service instance and binding operations").Default(defaultAsyncPollInterval.String()).Duration()
+var globalAsyncTimeout = app.Flag("async-timeout", "How long to wait for an asynchronous service instance or binding operation to finish").Default(defaultAsyncTimeout.String()).Duration()
+var globalCFAPI = app.Flag("cf-api", "The CF API version to look up orgs, spaces, and apps and manage service instances and bindings with (auto, v2, v3). auto uses v2 unless the API root only offers v3").Default(cfAPIAuto).Enum(cfAPIVersions...)
+
+var version = "dev"
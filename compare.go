@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+//compareScalingCmd lines up the PCF scaling history recorded in a dump from
+// before cutover with the OCF scaling history after cutover. The windows are a
+// whole number of weeks apart so that both cover the same days and times of the
+// week, and the OCF window is cut short at the present, with the PCF window cut
+// to match.
+type compareScalingCmd struct {
+	InputFile    **os.File
+	InputFormat  *string
+	Force        *bool
+	ClientID     *string
+	ClientSecret *string
+	CFHost       *string
+	OCFASHost    *string
+	RemapByName  *bool
+	Cutover      *string
+	Weeks        *int
+	//How many more or fewer events OCF can have than PCF before an app is
+	// reported as scaling differently
+	Tolerance *int
+	//Metric types to average over the OCF window. PCF history has no metrics
+	Metrics      *[]string
+	OutputFormat *string
+
+	stdoutWriter
+	//Defaults to time.Now
+	now func() time.Time
+}
+
+const week = 7 * 24 * time.Hour
+
+type scalingComparisonReport struct {
+	PCFWindow scalingWindow            `json:"pcf_window"`
+	OCFWindow scalingWindow            `json:"ocf_window"`
+	Differing int                      `json:"differing"`
+	Apps      []scalingComparisonEntry `json:"apps"`
+}
+
+type scalingWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type scalingComparisonEntry struct {
+	OrgName    string             `json:"org_name,omitempty"`
+	SpaceName  string             `json:"space_name,omitempty"`
+	AppName    string             `json:"app_name,omitempty"`
+	PCFAppGUID string             `json:"pcf_app_guid"`
+	OCFAppGUID string             `json:"ocf_app_guid"`
+	PCF        scalingWindowStats `json:"pcf"`
+	OCF        scalingWindowStats `json:"ocf"`
+	//OCF minus PCF. Instance deltas are left out unless both sides scaled
+	EventsDelta       int    `json:"events_delta"`
+	MinInstancesDelta *int64 `json:"min_instances_delta,omitempty"`
+	MaxInstancesDelta *int64 `json:"max_instances_delta,omitempty"`
+	Differs           bool   `json:"differs"`
+}
+
+type scalingWindowStats struct {
+	Events       int     `json:"events"`
+	ScaleUps     int     `json:"scale_ups"`
+	ScaleDowns   int     `json:"scale_downs"`
+	EventsPerDay float64 `json:"events_per_day"`
+	//The range of instance counts seen in scaling events. Unset if the app
+	// didn't scale
+	MinInstances *int64 `json:"min_instances,omitempty"`
+	MaxInstances *int64 `json:"max_instances,omitempty"`
+	//metric type -> mean value
+	MetricMeans map[string]float64 `json:"metric_means,omitempty"`
+}
+
+func (s *scalingWindowStats) add(oldInstances, newInstances int64) {
+	s.Events++
+	switch {
+	case newInstances > oldInstances:
+		s.ScaleUps++
+	case newInstances < oldInstances:
+		s.ScaleDowns++
+	}
+
+	for _, count := range []int64{oldInstances, newInstances} {
+		count := count
+		if s.MinInstances == nil || count < *s.MinInstances {
+			s.MinInstances = &count
+		}
+		if s.MaxInstances == nil || count > *s.MaxInstances {
+			s.MaxInstances = &count
+		}
+	}
+}
+
+func (s *scalingWindowStats) finish(length time.Duration) {
+	s.EventsPerDay = float64(s.Events) / (float64(length) / float64(24*time.Hour))
+}
+
+func (c *compareScalingCmd) Run() error {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+
+	cutover, err := time.Parse(time.RFC3339, *c.Cutover)
+	if err != nil {
+		return fmt.Errorf("Error parsing --cutover: %s", err)
+	}
+
+	if *c.Weeks < 1 {
+		return fmt.Errorf("--weeks must be at least 1")
+	}
+
+	if *c.Tolerance < 0 {
+		return fmt.Errorf("--tolerance cannot be negative")
+	}
+
+	ocfStart := cutover
+	ocfEnd := cutover.Add(time.Duration(*c.Weeks) * week)
+	if ocfEnd.After(now()) {
+		ocfEnd = now()
+	}
+	length := ocfEnd.Sub(ocfStart)
+	if length <= 0 {
+		return fmt.Errorf("Cutover time `%s' is in the future", *c.Cutover)
+	}
+
+	pcfStart := cutover.Add(-time.Duration(*c.Weeks) * week)
+	pcfEnd := pcfStart.Add(length)
+
+	inputFormat := detectInputFormat(*c.InputFormat, (*c.InputFile).Name())
+	header, err := verifyInput(*c.InputFile, inputFormat, models.KindDump, *c.Force)
+	if err != nil {
+		return err
+	}
+
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "compare"})
+	if header != nil {
+		if header.HistorySince == nil {
+			return fmt.Errorf("Input has no scaling history. Dump it with --with-history")
+		}
+
+		if header.HistorySince.After(pcfStart) {
+			log.Warnf("Input only has scaling history since %s, so the PCF window starting %s is incomplete",
+				header.HistorySince.Format(time.RFC3339), pcfStart.Format(time.RFC3339))
+		}
+	}
+
+	cf, err := buildCFClient(*c.CFHost, *c.ClientID, *c.ClientSecret)
+	if err != nil {
+		return err
+	}
+
+	err = discoverASHost(cf, c.OCFASHost, ocfASHostPrefix)
+	if err != nil {
+		return err
+	}
+
+	token, err := cf.GetToken()
+	if err != nil {
+		return fmt.Errorf("Error retrieving auth token: %s", err)
+	}
+
+	as := ocfas.NewClient(*c.OCFASHost, strings.TrimPrefix(token, "bearer "))
+	tracer, err := getTracer()
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		as.TraceTo(tracer)
+	}
+
+	services, err := newServiceAPI(cf)
+	if err != nil {
+		return err
+	}
+
+	var remapper *nameRemapper
+	if *c.RemapByName {
+		remapper = newNameRemapper(services)
+	}
+
+	report := scalingComparisonReport{
+		PCFWindow: scalingWindow{Start: pcfStart.UTC().Format(time.RFC3339), End: pcfEnd.UTC().Format(time.RFC3339)},
+		OCFWindow: scalingWindow{Start: ocfStart.UTC().Format(time.RFC3339), End: ocfEnd.UTC().Format(time.RFC3339)},
+		Apps:      []scalingComparisonEntry{},
+	}
+
+	err = readDumpSpaces(*c.InputFile, inputFormat, *c.Force, func(space models.Space) error {
+		//PCF app GUID -> OCF app GUID
+		ocfGUIDs, err := c.ocfAppGUIDs(remapper, space)
+		if err != nil {
+			return err
+		}
+
+		for _, app := range space.Apps {
+			ocfGUID, found := ocfGUIDs[app.GUID]
+			if !found {
+				continue
+			}
+
+			entry := scalingComparisonEntry{
+				OrgName:    space.OrgName,
+				SpaceName:  space.Name,
+				AppName:    app.Name,
+				PCFAppGUID: app.GUID,
+				OCFAppGUID: ocfGUID,
+			}
+
+			for _, event := range app.ScalingHistory {
+				if !event.Timestamp.Before(pcfStart) && event.Timestamp.Before(pcfEnd) {
+					entry.PCF.add(event.OldInstances, event.NewInstances)
+				}
+			}
+			entry.PCF.finish(length)
+
+			entry.OCF, err = c.ocfStats(as, ocfGUID, ocfStart, ocfEnd)
+			if err != nil {
+				return err
+			}
+			entry.OCF.finish(length)
+
+			entry.compare(*c.Tolerance)
+			if entry.Differs {
+				report.Differing++
+				log.WithFields(logger.Fields{
+					logger.FieldOrgName:   entry.OrgName,
+					logger.FieldSpaceName: entry.SpaceName,
+					logger.FieldAppName:   entry.AppName,
+					logger.FieldAppGUID:   entry.OCFAppGUID,
+				}).Infof("Scaled %d times on PCF and %d times on OCF", entry.PCF.Events, entry.OCF.Events)
+			}
+
+			report.Apps = append(report.Apps, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*c.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	if remapper != nil {
+		remapper.Report.Print()
+	}
+
+	log.Infof("Compared %d apps over %s before and after cutover; %d scaled differently", len(report.Apps), length, report.Differing)
+
+	err = encodeDocument(c.output(), *c.OutputFormat, &report)
+	if err != nil {
+		return fmt.Errorf("Error writing scaling comparison: %s", err)
+	}
+
+	return nil
+}
+
+//Without remapping, apps keep their GUIDs across foundations
+func (c *compareScalingCmd) ocfAppGUIDs(remapper *nameRemapper, space models.Space) (map[string]string, error) {
+	ret := map[string]string{}
+	if remapper == nil {
+		for _, app := range space.Apps {
+			ret[app.GUID] = app.GUID
+		}
+
+		return ret, nil
+	}
+
+	toRemap := models.ConvertedSpace{GUID: space.GUID, Name: space.Name, OrgName: space.OrgName}
+	for _, app := range space.Apps {
+		toRemap.Apps = append(toRemap.Apps, models.ConvertedPolicyToApp{GUID: app.GUID, Name: app.Name})
+	}
+
+	remapped, found, err := remapper.Remap(toRemap)
+	if err != nil || !found {
+		return ret, err
+	}
+
+	//Remapping leaves out apps with no name or a name shared in the space, so
+	// the rest are unique by name. Dumps from before names were recorded have
+	// none to key by
+	pcfGUIDs := map[string]string{}
+	for _, app := range space.Apps {
+		if app.Name != "" {
+			pcfGUIDs[app.Name] = app.GUID
+		}
+	}
+
+	for _, app := range remapped.Apps {
+		pcfGUID, found := pcfGUIDs[app.Name]
+		if !found {
+			continue
+		}
+
+		ret[pcfGUID] = app.GUID
+	}
+
+	return ret, nil
+}
+
+func (c *compareScalingCmd) ocfStats(as *ocfas.Client, appGUID string, start, end time.Time) (scalingWindowStats, error) {
+	ret := scalingWindowStats{}
+	history, err := as.ScalingHistoryForAppWithGUID(appGUID, start, end)
+	if err != nil {
+		return ret, fmt.Errorf("Error getting scaling history for app with GUID `%s': %s", appGUID, err)
+	}
+
+	for _, event := range history {
+		if event.Status == ocfas.ScalingStatusSucceeded {
+			ret.add(event.OldInstances, event.NewInstances)
+		}
+	}
+
+	for _, metricType := range *c.Metrics {
+		metrics, err := as.AggregatedMetricHistoryForAppWithGUID(appGUID, metricType, start, end)
+		if err != nil {
+			return ret, fmt.Errorf("Error getting %s metrics for app with GUID `%s': %s", metricType, appGUID, err)
+		}
+
+		if len(metrics) == 0 {
+			continue
+		}
+
+		var sum float64
+		for _, metric := range metrics {
+			value, err := strconv.ParseFloat(metric.Value, 64)
+			if err != nil {
+				return ret, fmt.Errorf("Error parsing %s metric value `%s' for app with GUID `%s': %s", metricType, metric.Value, appGUID, err)
+			}
+
+			sum += value
+		}
+
+		if ret.MetricMeans == nil {
+			ret.MetricMeans = map[string]float64{}
+		}
+		ret.MetricMeans[metricType] = sum / float64(len(metrics))
+	}
+
+	return ret, nil
+}
+
+//compare fills in the deltas. The app differs if the event counts are more
+// than tolerance apart, or if the range of instance counts isn't the same.
+func (e *scalingComparisonEntry) compare(tolerance int) {
+	e.EventsDelta = e.OCF.Events - e.PCF.Events
+	e.Differs = e.EventsDelta > tolerance || -e.EventsDelta > tolerance
+
+	if e.PCF.MinInstances != nil && e.OCF.MinInstances != nil {
+		minDelta := *e.OCF.MinInstances - *e.PCF.MinInstances
+		maxDelta := *e.OCF.MaxInstances - *e.PCF.MaxInstances
+		e.MinInstancesDelta, e.MaxInstancesDelta = &minDelta, &maxDelta
+		e.Differs = e.Differs || minDelta != 0 || maxDelta != 0
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScalingComparisonEntryCompare(t *testing.T) {
+	//Each pair is one scaling event from the first count to the second
+	stats := func(events ...[2]int64) scalingWindowStats {
+		ret := scalingWindowStats{}
+		for _, event := range events {
+			ret.add(event[0], event[1])
+		}
+		return ret
+	}
+	up, down := [2]int64{2, 3}, [2]int64{3, 2}
+
+	tests := []struct {
+		name      string
+		pcf       scalingWindowStats
+		ocf       scalingWindowStats
+		tolerance int
+		wantDelta int
+		//Min and max instance deltas as "min/max", or empty if there are none
+		wantInstanceDeltas string
+		wantDiffers        bool
+	}{
+		{
+			name: "neither scaled",
+		},
+		{
+			name:               "same events",
+			pcf:                stats(up, down),
+			ocf:                stats(up, down),
+			wantInstanceDeltas: "0/0",
+		},
+		{
+			name:               "one more event on OCF",
+			pcf:                stats(up, down),
+			ocf:                stats(up, down, up),
+			wantDelta:          1,
+			wantInstanceDeltas: "0/0",
+			wantDiffers:        true,
+		},
+		{
+			name:               "one more event on OCF within tolerance",
+			pcf:                stats(up, down),
+			ocf:                stats(up, down, up),
+			tolerance:          1,
+			wantDelta:          1,
+			wantInstanceDeltas: "0/0",
+		},
+		{
+			name:               "fewer events on OCF within tolerance",
+			pcf:                stats(up, down, up, down),
+			ocf:                stats(up, down),
+			tolerance:          2,
+			wantDelta:          -2,
+			wantInstanceDeltas: "0/0",
+		},
+		{
+			name:               "fewer events on OCF beyond tolerance",
+			pcf:                stats(up, down, up, down),
+			ocf:                stats(up),
+			tolerance:          2,
+			wantDelta:          -3,
+			wantInstanceDeltas: "0/0",
+			wantDiffers:        true,
+		},
+		{
+			name:               "same events over a different range",
+			pcf:                stats(up, down),
+			ocf:                stats([2]int64{2, 4}, [2]int64{4, 2}),
+			tolerance:          1,
+			wantInstanceDeltas: "0/1",
+			wantDiffers:        true,
+		},
+		{
+			name:      "only PCF scaled",
+			pcf:       stats(up),
+			tolerance: 1,
+			wantDelta: -1,
+		},
+		{
+			name:        "only OCF scaled",
+			ocf:         stats(up, down),
+			wantDelta:   2,
+			wantDiffers: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := scalingComparisonEntry{PCF: test.pcf, OCF: test.ocf}
+			entry.compare(test.tolerance)
+
+			if entry.EventsDelta != test.wantDelta {
+				t.Errorf("got events delta %d, want %d", entry.EventsDelta, test.wantDelta)
+			}
+			instanceDeltas := ""
+			if entry.MinInstancesDelta != nil {
+				instanceDeltas = fmt.Sprintf("%d/%d", *entry.MinInstancesDelta, *entry.MaxInstancesDelta)
+			}
+			if instanceDeltas != test.wantInstanceDeltas {
+				t.Errorf("got instance deltas %q, want %q", instanceDeltas, test.wantInstanceDeltas)
+			}
+			if entry.Differs != test.wantDiffers {
+				t.Errorf("got differs %t, want %t", entry.Differs, test.wantDiffers)
+			}
+		})
+	}
+}
@@ -1,62 +1,170 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
+	"github.com/thomasmitchell/as2as/logger"
 	"github.com/thomasmitchell/as2as/models"
 )
 
 type convertCmd struct {
-	InputFile **os.File
+	InputFile    **os.File
+	InputFormat  *string
+	OutputFormat *string
+	Force        *bool
+	OutputDir    *string
+	Overrides    **os.File
+	//One of models.InitialCountStrategies. Defaults to current
+	InitialCount *string
+
+	stdoutWriter
+	stats convertStats
 }
 
-func (c *convertCmd) Run() error {
-	jDecoder := json.NewDecoder(*c.InputFile)
+type convertStats struct {
+	Spaces    int `json:"spaces"`
+	Apps      int `json:"apps"`
+	Policies  int `json:"policies"`
+	Overrides int `json:"overrides"`
+}
 
-	dumpModel := models.Dump{}
-	err := jDecoder.Decode(&dumpModel)
+func (c *convertCmd) Run() error {
+	inputFormat := detectInputFormat(*c.InputFormat, (*c.InputFile).Name())
+	inputHeader, err := verifyInput(*c.InputFile, inputFormat, models.KindDump, *c.Force)
 	if err != nil {
-		return fmt.Errorf("Error decoding file input")
+		return err
 	}
 
-	err = (*c.InputFile).Close()
-	if err != nil {
-		return fmt.Errorf("Error closing input file")
+	//The source foundation is carried through so that sync can check it
+	header := newHeader(models.KindConverted, "", "")
+	if inputHeader != nil {
+		header.CFHost = inputHeader.CFHost
+		header.BrokerGUID = inputHeader.BrokerGUID
+	}
+
+	var policyOverrides *overrides
+	if c.Overrides != nil && *c.Overrides != nil {
+		policyOverrides, err = loadOverrides(*c.Overrides)
+		if err != nil {
+			return err
+		}
 	}
 
-	output := models.Converted{}
+	initialCount := models.InitialCountCurrent
+	if c.InitialCount != nil {
+		initialCount = *c.InitialCount
+	}
 
-	for _, space := range dumpModel.Spaces {
+	output := models.Converted{Header: &header}
+	var ndjson *ndjsonWriter
+	var policyDir *policyDirWriter
+	if c.OutputDir != nil && *c.OutputDir != "" {
+		policyDir, err = newPolicyDirWriter(*c.OutputDir, header)
+		if err != nil {
+			return err
+		}
+	} else if *c.OutputFormat == formatNDJSON {
+		ndjson, err = newNDJSONWriter(c.output(), header)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = readDumpSpaces(*c.InputFile, inputFormat, *c.Force, func(space models.Space) error {
+		space.Sort()
 		appList := []models.ConvertedPolicyToApp{}
 
 		for _, app := range space.Apps {
-			policy, err := app.ToOCFPolicy()
+			policy, err := app.ToOCFPolicy(initialCount)
 			if err != nil {
 				return fmt.Errorf("Error constructing policy for app with GUID `%s' in space with GUID `%s': %s", app.GUID, space.GUID, err)
 			}
 
 			appList = append(appList, models.ConvertedPolicyToApp{
 				GUID:   app.GUID,
+				Name:   app.Name,
 				Policy: policy,
 			})
 		}
 
-		output.Spaces = append(output.Spaces,
-			models.ConvertedSpace{
-				GUID: space.GUID,
-				Apps: appList,
-			},
-		)
+		c.stats.Spaces++
+		convertedSpace := models.ConvertedSpace{
+			GUID:    space.GUID,
+			Name:    space.Name,
+			OrgName: space.OrgName,
+			Apps:    appList,
+		}
+
+		for i := range convertedSpace.Apps {
+			if policyOverrides != nil {
+				app, err := policyOverrides.Apply(convertedSpace, convertedSpace.Apps[i])
+				if err != nil {
+					return err
+				}
+
+				if app.Override != nil {
+					c.stats.Overrides++
+				}
+				convertedSpace.Apps[i] = app
+			}
+
+			c.stats.Apps++
+			if convertedSpace.Apps[i].Policy != nil {
+				c.stats.Policies++
+			}
+		}
+
+		if policyDir != nil {
+			return policyDir.Write(&convertedSpace)
+		}
+
+		if *c.OutputFormat == formatNDJSON {
+			return ndjson.Write(&convertedSpace)
+		}
+
+		output.Spaces = append(output.Spaces, convertedSpace)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*c.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	if policyOverrides != nil {
+		for _, key := range policyOverrides.Unused() {
+			logger.WithFields(logger.Fields{"override": key}).Warnf("Policy override did not match any app")
+		}
+		logger.Infof("Applied %d policy overrides", c.stats.Overrides)
+	}
+
+	if policyDir != nil {
+		err = policyDir.Close()
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("Wrote %d policy files to `%s'", c.stats.Policies, *c.OutputDir)
+		return nil
+	}
+
+	if *c.OutputFormat == formatNDJSON {
+		return ndjson.Close()
+	}
+
+	output.Sort()
+	header.Checksum, err = output.Checksum()
+	if err != nil {
+		return fmt.Errorf("Error computing checksum: %s", err)
 	}
 
-	jEncoder := json.NewEncoder(os.Stdout)
-	jEncoder.SetIndent("", "  ")
-	jEncoder.SetEscapeHTML(false)
-	err = jEncoder.Encode(&output)
+	err = encodeDocument(c.output(), *c.OutputFormat, &output)
 	if err != nil {
-		return fmt.Errorf("Error encoding JSON to stdout: %s", err)
+		return fmt.Errorf("Error encoding output: %s", err)
 	}
 
 	return nil
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
+)
+
+//Service offerings the autoscaler brokers are found by, unless overridden
+const (
+	defaultPCFServiceName = "app-autoscaler"
+	defaultOCFServiceName = "autoscaler"
+)
+
+//The autoscaler APIs are routed under these hostnames in the system domain
+const (
+	pcfASHostPrefix = "autoscale"
+	ocfASHostPrefix = "autoscaler"
+)
+
+//Sets *guid to the GUID of the broker offering serviceName, unless it is
+// already set.
+func discoverBrokerGUID(services serviceAPI, guid *string, serviceName string) error {
+	if *guid != "" {
+		return nil
+	}
+
+	found, err := services.FindBrokerGUIDForService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Error discovering service broker for service `%s'; set its GUID explicitly: %s", serviceName, err)
+	}
+
+	logger.WithFields(logger.Fields{"service": serviceName, "broker_guid": found}).Infof("Discovered service broker")
+	*guid = found
+	return nil
+}
+
+//Sets *host to prefix under the CF system domain, unless it is already set.
+func discoverASHost(cf *cfclient.Client, host *string, prefix string) error {
+	if *host != "" {
+		return nil
+	}
+
+	domain, err := systemDomain(cf)
+	if err != nil {
+		return fmt.Errorf("Error discovering autoscaler API host; set it explicitly: %s", err)
+	}
+
+	*host = prefix + "." + domain
+	logger.WithFields(logger.Fields{"host": *host}).Infof("Discovered autoscaler API host")
+	return nil
+}
+
+//The system domain is where the UAA lives, so it is the UAA's host, as linked
+// from the CF API root, without its first label. The root is read rather than
+// /v2/info so that this works on foundations with only the v3 API. Failing
+// that, the API itself is conventionally api.<system domain>.
+func systemDomain(cf *cfclient.Client) (string, error) {
+	root, err := getRaw(cf, "/")
+	if err != nil {
+		logger.Debugf("Error reading CF API root; inferring system domain from the API address: %s", err)
+	}
+
+	return systemDomainFromRoot(root, cf.Config.ApiAddress)
+}
+
+func systemDomainFromRoot(root json.RawMessage, apiAddress string) (string, error) {
+	links := struct {
+		Links map[string]*struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	//A root which doesn't parse is treated as having no links
+	json.Unmarshal(root, &links)
+
+	for _, name := range []string{"uaa", "login"} {
+		link := links.Links[name]
+		if link == nil || link.Href == "" {
+			continue
+		}
+
+		linkURL, err := url.Parse(link.Href)
+		if err != nil {
+			return "", fmt.Errorf("Error parsing %s link `%s': %s", name, link.Href, err)
+		}
+
+		parts := strings.SplitN(linkURL.Hostname(), ".", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", fmt.Errorf("Cannot infer system domain from %s link `%s'", name, link.Href)
+		}
+
+		return parts[1], nil
+	}
+
+	apiURL, err := url.Parse(apiAddress)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing CF API address `%s': %s", apiAddress, err)
+	}
+
+	if !strings.HasPrefix(apiURL.Hostname(), "api.") {
+		return "", fmt.Errorf("Cannot infer system domain: the CF API root has no UAA link, and `%s' is not api.<system domain>", apiAddress)
+	}
+
+	return strings.TrimPrefix(apiURL.Hostname(), "api."), nil
+}
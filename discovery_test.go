@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSystemDomainFromRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		root       string
+		apiAddress string
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "v3 only root",
+			root: `{"links": {"self": {"href": "https://api.sys.example.com"}, "cloud_controller_v2": null,
+				"cloud_controller_v3": {"href": "https://api.sys.example.com/v3", "meta": {"version": "3.100.0"}},
+				"login": {"href": "https://login.sys.example.com"}, "uaa": {"href": "https://uaa.sys.example.com"}}}`,
+			apiAddress: "https://cf.example.com",
+			want:       "sys.example.com",
+		},
+		{
+			name:       "login link only",
+			root:       `{"links": {"login": {"href": "https://login.system.example.org:443"}}}`,
+			apiAddress: "https://cf.example.com",
+			want:       "system.example.org",
+		},
+		{
+			name:       "no links falls back to the API address",
+			root:       `{"links": {}}`,
+			apiAddress: "https://api.sys.example.com",
+			want:       "sys.example.com",
+		},
+		{
+			name:       "unreadable root falls back to the API address",
+			root:       ``,
+			apiAddress: "https://api.sys.example.com",
+			want:       "sys.example.com",
+		},
+		{
+			name:       "API address not under the system domain",
+			root:       `<html>`,
+			apiAddress: "https://cf.example.com",
+			wantErr:    "is not api.<system domain>",
+		},
+		{
+			name:       "UAA without a domain",
+			root:       `{"links": {"uaa": {"href": "https://uaa"}}}`,
+			apiAddress: "https://api.sys.example.com",
+			wantErr:    "Cannot infer system domain from uaa link",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := systemDomainFromRoot([]byte(test.root), test.apiAddress)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/url"
-	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
 	"github.com/thomasmitchell/as2as/models"
 	"github.com/thomasmitchell/as2as/pcfas"
+	"github.com/thomasmitchell/as2as/progress"
 )
 
 type dumpCmd struct {
@@ -19,6 +20,34 @@ type dumpCmd struct {
 	CFHost       *string
 	PCFASHost    *string
 	BrokerGUID   *string
+	//Used to discover BrokerGUID if it isn't set
+	ServiceName *string
+	Format      *string
+	//Tuning for PCF autoscaler lists. Nil means the client's defaults
+	PageSize      *int
+	ParallelPages *int
+	WithHistory   *bool
+	//How far back to dump scaling history
+	Since *time.Duration
+
+	stdoutWriter
+	stats dumpStats
+	//Set if history is being dumped
+	historySince *time.Time
+}
+
+type dumpStats struct {
+	Spaces  int `json:"spaces"`
+	Apps    int `json:"apps"`
+	Orphans int `json:"orphans"`
+}
+
+func (d *dumpCmd) serviceName() string {
+	if d.ServiceName == nil || *d.ServiceName == "" {
+		return defaultPCFServiceName
+	}
+
+	return *d.ServiceName
 }
 
 func (d *dumpCmd) Run() error {
@@ -27,64 +56,162 @@ func (d *dumpCmd) Run() error {
 		return err
 	}
 
+	if d.WithHistory != nil && *d.WithHistory {
+		since := time.Now().UTC().Add(-*d.Since)
+		d.historySince = &since
+	}
+
 	errChan := make(chan error)
 
-	spaceGUIDChan, err := d.fetchSpaceGUIDsToScrape(cf, errChan)
+	reporter := newProgressReporter()
+	defer reporter.Stop()
+	spacesTracker := reporter.Track("spaces scraped", 0)
+
+	services, err := newServiceAPI(cf)
+	if err != nil {
+		return err
+	}
+
+	err = discoverBrokerGUID(services, d.BrokerGUID, d.serviceName())
+	if err != nil {
+		return err
+	}
+
+	err = discoverASHost(cf, d.PCFASHost, pcfASHostPrefix)
+	if err != nil {
+		return err
+	}
+
+	spaceGUIDChan, err := d.fetchSpaceGUIDsToScrape(services, errChan, reporter, spacesTracker)
+	if err != nil {
+		return err
+	}
+
+	//Spaces are scraped in parallel but written out in GUID order, so that
+	// dumps of an unchanged foundation are the same line for line
+	spaceGUIDs, err := collectSpaceGUIDs(spaceGUIDChan, errChan)
 	if err != nil {
 		return err
 	}
 
+	indexedGUIDChan := make(chan indexedSpaceGUID, len(spaceGUIDs))
+	for i, spaceGUID := range spaceGUIDs {
+		indexedGUIDChan <- indexedSpaceGUID{index: i, guid: spaceGUID}
+	}
+	close(indexedGUIDChan)
+
 	token, err := cf.GetToken()
 	if err != nil {
-		return fmt.Errorf("Error retrieving auth token: %s")
+		return fmt.Errorf("Error retrieving auth token: %s", err)
 	}
 
 	token = strings.TrimPrefix(token, "bearer ")
 
 	pcfasClient := pcfas.NewClient(*d.PCFASHost, token)
-	if globalTrace != nil && *globalTrace {
-		pcfasClient.TraceTo(os.Stderr)
+	if d.PageSize != nil {
+		pcfasClient.SetPageSize(*d.PageSize)
+	}
+	if d.ParallelPages != nil {
+		pcfasClient.SetParallelPages(*d.ParallelPages)
+	}
+	tracer, err := getTracer()
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		pcfasClient.TraceTo(tracer)
 	}
 
-	outputSpaceChan := make(chan models.Space, 10)
+	outputSpaceChan := make(chan indexedSpace, 10)
 
 	doneChan := make(chan bool)
 	const numWorkers = 8
 
-	fmt.Fprintf(os.Stderr, "Scraping autoscaler for all known apps\n")
+	scrapeLog := logger.WithFields(logger.Fields{logger.FieldStage: "scrape"})
+	scrapeLog.Infof("Scraping autoscaler for all known apps")
+	scrapeStart := time.Now()
 	scrapeWait := sync.WaitGroup{}
 	scrapeWait.Add(numWorkers)
 
 	scrapeSpaces := func() {
-		for spaceGUID := range spaceGUIDChan {
+		for next := range indexedGUIDChan {
+			spaceGUID := next.guid
+			spaceStart := time.Now()
+			cfSpace, err := services.GetSpace(spaceGUID)
+			if err != nil {
+				errChan <- fmt.Errorf("Error getting space with GUID `%s': %s", spaceGUID, err)
+				return
+			}
+
+			orgName, err := services.GetOrgName(cfSpace.OrganizationGuid)
+			if err != nil {
+				errChan <- fmt.Errorf("Error getting org with GUID `%s': %s", cfSpace.OrganizationGuid, err)
+				return
+			}
+
 			appsForSpace, err := pcfasClient.AppsForSpaceWithGUID(spaceGUID)
 			if err != nil {
 				errChan <- fmt.Errorf("Error getting apps for space with GUID `%s': %s", spaceGUID, err)
 				return
 			}
 
-			var modelApps []models.App
+			var modelApps, orphans []models.App
 			for j := range appsForSpace {
-				_, err := cf.GetAppByGuid(appsForSpace[j].GUID)
+				cfApp, err := services.GetApp(appsForSpace[j].GUID)
 				if err != nil {
-					if cfclient.IsAppNotFoundError(err) {
-						continue
-					}
-
 					errChan <- fmt.Errorf("Error querying CF for existence of app with GUID `%s': %s", appsForSpace[j].GUID, err)
 					return
 				}
-				thisModelApp, err := d.scrapeApp(appsForSpace[j], pcfasClient)
-				if err != nil {
-					errChan <- err
+
+				thisModelApp, scrapeErr := d.scrapeApp(appsForSpace[j], pcfasClient)
+				if cfApp == nil {
+					//Recorded so that prune-pcf can clean them up. Leftovers of
+					// deleted apps are often broken, so failing to scrape one
+					// shouldn't stop the dump
+					orphanLog := scrapeLog.WithFields(logger.Fields{
+						logger.FieldSpaceGUID: spaceGUID,
+						logger.FieldAppGUID:   appsForSpace[j].GUID,
+					})
+					switch {
+					case scrapeErr != nil:
+						orphanLog.Warnf("Skipping orphaned autoscaler app unknown to CF which could not be scraped: %s", scrapeErr)
+					case alreadyPruned(thisModelApp):
+						orphanLog.Debugf("Skipping orphaned autoscaler app which prune-pcf already cleaned")
+					default:
+						orphanLog.Warnf("Recording orphaned autoscaler app unknown to CF")
+						orphans = append(orphans, thisModelApp)
+					}
+					continue
+				}
+
+				if scrapeErr != nil {
+					errChan <- scrapeErr
+					return
 				}
+				thisModelApp.Name = cfApp.Name
+				instances := int64(cfApp.Instances)
+				thisModelApp.CurrentInstances = &instances
 				modelApps = append(modelApps, thisModelApp)
 			}
 
-			outputSpaceChan <- models.Space{
-				GUID: spaceGUID,
-				Apps: modelApps,
+			scrapeLog.WithFields(logger.Fields{
+				logger.FieldOrgName:   orgName,
+				logger.FieldSpaceName: cfSpace.Name,
+				logger.FieldSpaceGUID: spaceGUID,
+				logger.FieldDuration:  time.Since(spaceStart),
+			}).Debugf("Scraped %d apps in space", len(modelApps))
+
+			outputSpaceChan <- indexedSpace{
+				index: next.index,
+				space: models.Space{
+					GUID:    spaceGUID,
+					Name:    cfSpace.Name,
+					OrgName: orgName,
+					Apps:    modelApps,
+					Orphans: orphans,
+				},
 			}
+			spacesTracker.Increment()
 		}
 
 		scrapeWait.Done()
@@ -94,18 +221,48 @@ func (d *dumpCmd) Run() error {
 	}
 	go func() {
 		scrapeWait.Wait()
-		fmt.Fprintf(os.Stderr, "All space scrape workers done\n")
+		scrapeLog.WithFields(logger.Fields{
+			logger.FieldDuration: time.Since(scrapeStart),
+		}).Infof("All space scrape workers done")
 		close(outputSpaceChan)
 	}()
 
-	outputDump := &models.Dump{}
+	header := newHeader(models.KindDump, *d.CFHost, *d.BrokerGUID)
+	header.HistorySince = d.historySince
+	outputDump := &models.Dump{Header: &header}
+	var ndjson *ndjsonWriter
+	if *d.Format == formatNDJSON {
+		ndjson, err = newNDJSONWriter(d.output(), header)
+		if err != nil {
+			return err
+		}
+	}
 
 	go func() {
-		for space := range outputSpaceChan {
-			outputDump.Spaces = append(outputDump.Spaces, space)
+		reorder := newSpaceReorderer()
+		for scraped := range outputSpaceChan {
+			for _, space := range reorder.add(scraped.index, scraped.space) {
+				d.stats.Spaces++
+				d.stats.Apps += len(space.Apps)
+				d.stats.Orphans += len(space.Orphans)
+				space.Sort()
+				if *d.Format == formatNDJSON {
+					//Write each space as soon as those before it are written so
+					// that a crash doesn't lose everything scraped so far
+					err := ndjson.Write(&space)
+					if err != nil {
+						errChan <- err
+						return
+					}
+
+					continue
+				}
+
+				outputDump.Spaces = append(outputDump.Spaces, space)
+			}
 		}
 
-		fmt.Fprintf(os.Stderr, "Output builder done\n")
+		logger.Debugf("Output builder done")
 		doneChan <- true
 	}()
 
@@ -116,32 +273,46 @@ func (d *dumpCmd) Run() error {
 	case <-doneChan:
 	}
 
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	enc.SetEscapeHTML(false)
-	err = enc.Encode(&outputDump)
+	reporter.Stop()
+	if d.stats.Orphans > 0 {
+		logger.Warnf("Recorded %d autoscaler apps unknown to CF as orphans; clean them out of the PCF autoscaler with prune-pcf", d.stats.Orphans)
+	}
+
+	if *d.Format == formatNDJSON {
+		return ndjson.Close()
+	}
+
+	outputDump.Sort()
+	header.Checksum, err = outputDump.Checksum()
 	if err != nil {
-		return fmt.Errorf("Could not encode JSON: %s", err)
+		return fmt.Errorf("Could not compute checksum: %s", err)
+	}
+
+	err = encodeDocument(d.output(), *d.Format, &outputDump)
+	if err != nil {
+		return fmt.Errorf("Could not encode output: %s", err)
 	}
 
 	return nil
 }
 
-func (d *dumpCmd) fetchSpaceGUIDsToScrape(cf *cfclient.Client, errChan chan<- error) (<-chan string, error) {
+func (d *dumpCmd) fetchSpaceGUIDsToScrape(
+	services serviceAPI,
+	errChan chan<- error,
+	reporter *progress.Reporter,
+	spacesTracker *progress.Tracker,
+) (<-chan string, error) {
 	const numWorkers = 4
-	fmt.Fprintf(os.Stderr, "Listing plans for broker with GUID `%s'\n", *d.BrokerGUID)
-	servicesQuery := url.Values{}
-	servicesQuery.Add("q", fmt.Sprintf("service_broker_guid:%s", *d.BrokerGUID))
-	plansForBroker, err := cf.ListServicePlansByQuery(servicesQuery)
+	discoverLog := logger.WithFields(logger.Fields{logger.FieldStage: "discover"})
+	discoverLog.Infof("Listing plans for broker with GUID `%s'", *d.BrokerGUID)
+	plansForBroker, err := services.ListServicePlans(*d.BrokerGUID)
 	if err != nil {
 		return nil, fmt.Errorf("Error listing service plans for broker with GUID `%s': %s", *d.BrokerGUID, err)
 	}
 
 	var allServiceInstances []cfclient.ServiceInstance
 	for _, plan := range plansForBroker {
-		serviceInstancesQuery := url.Values{}
-		serviceInstancesQuery.Add("q", "service_plan_guid:"+plan.Guid)
-		serviceInstances, err := cf.ListServiceInstancesByQuery(serviceInstancesQuery)
+		serviceInstances, err := services.ListServiceInstancesForPlan(plan.Guid)
 		if err != nil {
 			return nil, fmt.Errorf("Error listing service instances for plan `%s': %s", plan.Guid, err)
 		}
@@ -163,21 +334,43 @@ func (d *dumpCmd) fetchSpaceGUIDsToScrape(cf *cfclient.Client, errChan chan<- er
 	wait := sync.WaitGroup{}
 	wait.Add(numWorkers)
 
-	fmt.Fprintf(os.Stderr, "Querying service bindings\n")
+	//A space with several bound instances must still only be scraped once
+	seenSpacesLock := sync.Mutex{}
+	seenSpaces := map[string]bool{}
+	firstSighting := func(spaceGUID string) bool {
+		seenSpacesLock.Lock()
+		defer seenSpacesLock.Unlock()
+		if seenSpaces[spaceGUID] {
+			return false
+		}
+
+		seenSpaces[spaceGUID] = true
+		return true
+	}
+
+	discoverLog.Infof("Querying service bindings for %d service instances", len(allServiceInstances))
+	discoverStart := time.Now()
+	instancesTracker := reporter.Track("instances checked", len(allServiceInstances))
+	reporter.Start()
 	for i := 0; i < numWorkers; i++ {
 		go func() {
 			for serviceInstance := range serviceInstanceChan {
-				bindingsQuery := url.Values{}
-				bindingsQuery.Add("q", "service_instance_guid:"+serviceInstance.Guid)
-				bindings, err := cf.ListServiceBindingsByQuery(bindingsQuery)
+				bindings, err := services.ListBindings(serviceInstance.Guid, "")
 				if err != nil {
 					errChan <- fmt.Errorf("Error checking service bindings for service instance with GUID `%s': %s", serviceInstance.Guid, err)
 					return
 				}
 
-				if len(bindings) > 0 {
+				discoverLog.WithFields(logger.Fields{
+					logger.FieldSpaceGUID:           serviceInstance.SpaceGuid,
+					logger.FieldServiceInstanceGUID: serviceInstance.Guid,
+				}).Debugf("Found %d bindings for service instance", len(bindings))
+
+				if len(bindings) > 0 && firstSighting(serviceInstance.SpaceGuid) {
+					spacesTracker.AddTotal(1)
 					validSpacesChan <- serviceInstance.SpaceGuid
 				}
+				instancesTracker.Increment()
 			}
 
 			wait.Done()
@@ -186,13 +379,71 @@ func (d *dumpCmd) fetchSpaceGUIDsToScrape(cf *cfclient.Client, errChan chan<- er
 
 	go func() {
 		wait.Wait()
-		fmt.Fprintf(os.Stderr, "Done querying service bindings\n")
+		discoverLog.WithFields(logger.Fields{
+			logger.FieldDuration: time.Since(discoverStart),
+		}).Infof("Done querying service bindings")
 		close(validSpacesChan)
 	}()
 
 	return validSpacesChan, nil
 }
 
+type indexedSpaceGUID struct {
+	index int
+	guid  string
+}
+
+type indexedSpace struct {
+	index int
+	space models.Space
+}
+
+//Waits for discovery to finish and returns the space GUIDs it found, sorted
+func collectSpaceGUIDs(spaceGUIDChan <-chan string, errChan <-chan error) ([]string, error) {
+	ret := []string{}
+	for {
+		select {
+		case spaceGUID, ok := <-spaceGUIDChan:
+			if !ok {
+				sort.Strings(ret)
+				return ret, nil
+			}
+
+			ret = append(ret, spaceGUID)
+
+		case err := <-errChan:
+			return nil, err
+		}
+	}
+}
+
+//spaceReorderer holds spaces which finished scraping early until every space
+// before them has finished too.
+type spaceReorderer struct {
+	next    int
+	pending map[int]models.Space
+}
+
+func newSpaceReorderer() *spaceReorderer {
+	return &spaceReorderer{pending: map[int]models.Space{}}
+}
+
+//Returns the spaces which are now ready, in order
+func (s *spaceReorderer) add(index int, space models.Space) []models.Space {
+	s.pending[index] = space
+	var ret []models.Space
+	for {
+		space, found := s.pending[s.next]
+		if !found {
+			return ret
+		}
+
+		ret = append(ret, space)
+		delete(s.pending, s.next)
+		s.next++
+	}
+}
+
 func (d *dumpCmd) scrapeApp(app pcfas.App, pcfasClient *pcfas.Client) (models.App, error) {
 	ret := models.App{}
 	rules, err := pcfasClient.RulesForAppWithGUID(app.GUID)
@@ -220,5 +471,17 @@ func (d *dumpCmd) scrapeApp(app pcfas.App, pcfasClient *pcfas.Client) (models.Ap
 			fmt.Errorf("Error transforming app data to intermediate representation: %s", err)
 	}
 
+	if d.historySince != nil {
+		events, err := pcfasClient.EventsForAppWithGUID(app.GUID, *d.historySince)
+		if err != nil {
+			return ret, fmt.Errorf("Error getting scaling events for app with GUID `%s': %s", app.GUID, err)
+		}
+
+		ret.ScalingHistory, err = models.ConstructScalingHistory(events, rules)
+		if err != nil {
+			return ret, fmt.Errorf("Error transforming scaling events for app with GUID `%s': %s", app.GUID, err)
+		}
+	}
+
 	return ret, nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/thomasmitchell/as2as/models"
+)
+
+func TestSpaceReorderer(t *testing.T) {
+	tests := []struct {
+		name string
+		//Indexes in the order they finish scraping
+		finished []int
+		//The spaces released after each one, as GUIDs joined by commas
+		want []string
+	}{
+		{
+			name:     "in order",
+			finished: []int{0, 1, 2},
+			want:     []string{"space-0", "space-1", "space-2"},
+		},
+		{
+			name:     "reversed",
+			finished: []int{2, 1, 0},
+			want:     []string{"", "", "space-0,space-1,space-2"},
+		},
+		{
+			name:     "first held up",
+			finished: []int{1, 3, 0, 2},
+			want:     []string{"", "", "space-0,space-1", "space-2,space-3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reorder := newSpaceReorderer()
+			for i, index := range test.finished {
+				guids := []string{}
+				for _, space := range reorder.add(index, models.Space{GUID: fmt.Sprintf("space-%d", index)}) {
+					guids = append(guids, space.GUID)
+				}
+
+				if strings.Join(guids, ",") != test.want[i] {
+					t.Errorf("after space %d finished, got %v released, want %s", index, guids, test.want[i])
+				}
+			}
+
+			if len(reorder.pending) != 0 {
+				t.Errorf("spaces left pending: %v", reorder.pending)
+			}
+		})
+	}
+}
+
+func TestCollectSpaceGUIDs(t *testing.T) {
+	spaceGUIDChan := make(chan string, 3)
+	spaceGUIDChan <- "space-c"
+	spaceGUIDChan <- "space-a"
+	spaceGUIDChan <- "space-b"
+	close(spaceGUIDChan)
+
+	got, err := collectSpaceGUIDs(spaceGUIDChan, make(chan error))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "space-a,space-b,space-c" {
+		t.Errorf("got %v, want them sorted", got)
+	}
+
+	errChan := make(chan error, 1)
+	errChan <- fmt.Errorf("listing bindings failed")
+	_, err = collectSpaceGUIDs(make(chan string), errChan)
+	if err == nil || err.Error() != "listing bindings failed" {
+		t.Errorf("got error %v, want the discovery error", err)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+const (
+	formatAuto   = "auto"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatYAML   = "yaml"
+)
+
+var outputFormats = []string{formatJSON, formatNDJSON, formatYAML}
+var inputFormats = []string{formatAuto, formatJSON, formatNDJSON, formatYAML}
+
+//Determines the format of an input file from its extension if the given
+// format is auto.
+func detectInputFormat(format, filename string) string {
+	if format != formatAuto {
+		return format
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".yml", ".yaml":
+		return formatYAML
+	}
+
+	return formatJSON
+}
+
+func newJSONEncoder(w io.Writer, format string) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if format != formatNDJSON {
+		enc.SetIndent("", "  ")
+	}
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+//Writes v as a single document. NDJSON streams are written with an
+// ndjsonWriter instead.
+func encodeDocument(w io.Writer, format string, v interface{}) error {
+	if format != formatYAML {
+		return newJSONEncoder(w, format).Encode(v)
+	}
+
+	buf := bytes.Buffer{}
+	err := newJSONEncoder(&buf, formatJSON).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	out, err := jsonToYAML(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+//Reads a whole JSON or YAML document from r into v.
+func decodeDocument(r io.Reader, format string, v interface{}) error {
+	if format != formatYAML {
+		err := json.NewDecoder(r).Decode(v)
+		if err != nil {
+			return fmt.Errorf("Error decoding JSON: %s", err)
+		}
+
+		return nil
+	}
+
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	jsonDoc, err := yamlToJSON(in)
+	if err != nil {
+		return fmt.Errorf("Error decoding YAML: %s", err)
+	}
+
+	err = json.Unmarshal(jsonDoc, v)
+	if err != nil {
+		return fmt.Errorf("Error decoding YAML: %s", err)
+	}
+
+	return nil
+}
+
+func newHeader(kind, cfHost, brokerGUID string) models.Header {
+	return models.Header{
+		SchemaVersion: models.SchemaVersion,
+		Kind:          kind,
+		ToolVersion:   version,
+		CFHost:        cfHost,
+		BrokerGUID:    brokerGUID,
+		CreatedAt:     time.Now().UTC(),
+	}
+}
+
+//ndjsonWriter writes the header line when it is created, then one line per
+// space, then a trailer line with the checksum when it is closed.
+type ndjsonWriter struct {
+	enc *json.Encoder
+	sum *models.Checksummer
+}
+
+func newNDJSONWriter(w io.Writer, header models.Header) (*ndjsonWriter, error) {
+	ret := &ndjsonWriter{
+		enc: newJSONEncoder(w, formatNDJSON),
+		sum: models.NewChecksummer(),
+	}
+
+	err := ret.enc.Encode(&models.NDJSONEnvelope{Header: &header})
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode NDJSON header: %s", err)
+	}
+
+	return ret, nil
+}
+
+func (n *ndjsonWriter) Write(space interface{}) error {
+	err := n.enc.Encode(space)
+	if err != nil {
+		return fmt.Errorf("Could not encode NDJSON: %s", err)
+	}
+
+	return n.sum.Add(space)
+}
+
+func (n *ndjsonWriter) Close() error {
+	err := n.enc.Encode(&models.NDJSONEnvelope{
+		Trailer: &models.Trailer{
+			Checksum: n.sum.Sum(),
+			Count:    n.sum.Count(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not encode NDJSON trailer: %s", err)
+	}
+
+	return nil
+}
+
+//Calls fn with the header or trailer if the line is one, and returns whether
+// it was.
+func decodeNDJSONEnvelope(line json.RawMessage, fn func(models.NDJSONEnvelope)) (bool, error) {
+	envelope := models.NDJSONEnvelope{}
+	err := json.Unmarshal(line, &envelope)
+	if err != nil {
+		return false, err
+	}
+
+	if envelope.Header == nil && envelope.Trailer == nil {
+		return false, nil
+	}
+
+	if fn != nil {
+		fn(envelope)
+	}
+
+	return true, nil
+}
+
+//In NDJSON format, each line of the input is one space, and the trailer
+// checksum is verified once the last space has been read. Otherwise, the whole
+// JSON or YAML document is read before fn is called on each space.
+func readDumpSpaces(r io.Reader, format string, force bool, fn func(models.Space) error) error {
+	if format != formatNDJSON {
+		doc := models.Dump{}
+		err := decodeDocument(r, format, &doc)
+		if err != nil {
+			return err
+		}
+
+		for _, space := range doc.Spaces {
+			err = fn(space)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return readNDJSONSpaces(r, force, func() interface{} { return &models.Space{} }, func(space interface{}) error {
+		return fn(*(space.(*models.Space)))
+	})
+}
+
+//In NDJSON format, each line of the input is one space, and the trailer
+// checksum is verified once the last space has been read. Otherwise, the whole
+// JSON or YAML document is read before fn is called on each space.
+func readConvertedSpaces(r io.Reader, format string, force bool, fn func(models.ConvertedSpace) error) error {
+	if format != formatNDJSON {
+		doc := models.Converted{}
+		err := decodeDocument(r, format, &doc)
+		if err != nil {
+			return err
+		}
+
+		for _, space := range doc.Spaces {
+			err = fn(space)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return readNDJSONSpaces(r, force, func() interface{} { return &models.ConvertedSpace{} }, func(space interface{}) error {
+		return fn(*(space.(*models.ConvertedSpace)))
+	})
+}
+
+//Checksums and counts the spaces as they are streamed to fn, so that the
+// input is only read once. newSpace returns a pointer to decode each line into.
+func readNDJSONSpaces(r io.Reader, force bool, newSpace func() interface{}, fn func(interface{}) error) error {
+	var header *models.Header
+	var trailer *models.Trailer
+	sum := models.NewChecksummer()
+	err := readNDJSON(json.NewDecoder(r),
+		func(envelope models.NDJSONEnvelope) {
+			if envelope.Header != nil {
+				header = envelope.Header
+			}
+			if envelope.Trailer != nil {
+				trailer = envelope.Trailer
+			}
+		},
+		func(line json.RawMessage) error {
+			space := newSpace()
+			err := json.Unmarshal(line, space)
+			if err != nil {
+				return err
+			}
+
+			err = sum.Add(space)
+			if err != nil {
+				return err
+			}
+
+			return fn(space)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	//Files from before headers were added have no trailer either
+	if header == nil {
+		return nil
+	}
+
+	log := logger.WithFields(logger.Fields{"format": formatNDJSON})
+	if trailer == nil {
+		if force {
+			log.Warnf("Input has no trailer, so it may be truncated; continuing because of --force")
+			return nil
+		}
+
+		return fmt.Errorf("Input has no trailer, so it may be truncated; use --force to continue anyway")
+	}
+
+	if trailer.Count != sum.Count() {
+		if !force {
+			return fmt.Errorf("Input trailer counts %d spaces, but %d were read. The file may be truncated or edited; use --force to continue anyway",
+				trailer.Count, sum.Count())
+		}
+
+		log.Warnf("Input trailer counts %d spaces, but %d were read; continuing because of --force", trailer.Count, sum.Count())
+	}
+
+	if trailer.Checksum != sum.Sum() {
+		return checksumMismatch(trailer.Checksum, sum.Sum(), force, log)
+	}
+
+	return nil
+}
+
+func readNDJSON(dec *json.Decoder, envelopeFn func(models.NDJSONEnvelope), fn func(json.RawMessage) error) error {
+	for line := 1; ; line++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error decoding NDJSON record %d: %s", line, err)
+		}
+
+		isEnvelope, err := decodeNDJSONEnvelope(raw, envelopeFn)
+		if err != nil {
+			return fmt.Errorf("Error decoding NDJSON record %d: %s", line, err)
+		}
+
+		if isEnvelope {
+			continue
+		}
+
+		err = fn(raw)
+		if err != nil {
+			return fmt.Errorf("Error processing NDJSON record %d: %s", line, err)
+		}
+	}
+}
+
+//verifyInput checks the input file's header and then rewinds it so that it can
+// be read again for real. JSON and YAML files are read through to check their
+// checksum here. NDJSON files are streamed, so only their header line is read
+// here, and their trailer checksum is checked by readDumpSpaces or
+// readConvertedSpaces as the spaces are read. The returned header is nil if
+// the file has none. If force is set, problems which would otherwise be errors
+// are logged as warnings instead.
+func verifyInput(f *os.File, format, kind string, force bool) (*models.Header, error) {
+	log := logger.WithFields(logger.Fields{"file": f.Name()})
+	_, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		log.Warnf("Input is not seekable; skipping header and checksum verification")
+		return nil, nil
+	}
+
+	var header *models.Header
+	var actualChecksum string
+
+	if format == formatNDJSON {
+		var first json.RawMessage
+		err = json.NewDecoder(f).Decode(&first)
+		if err == io.EOF {
+			err = nil
+		} else if err == nil {
+			_, err = decodeNDJSONEnvelope(first, func(envelope models.NDJSONEnvelope) {
+				header = envelope.Header
+			})
+		}
+	} else if kind == models.KindConverted {
+		doc := models.Converted{}
+		err = decodeDocument(f, format, &doc)
+		if err == nil {
+			header = doc.Header
+			actualChecksum, err = doc.Checksum()
+		}
+	} else {
+		doc := models.Dump{}
+		err = decodeDocument(f, format, &doc)
+		if err == nil {
+			header = doc.Header
+			actualChecksum, err = doc.Checksum()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("Error rewinding input file: %s", err)
+	}
+
+	if header == nil {
+		log.Warnf("Input has no header; cannot verify where it came from")
+		return nil, nil
+	}
+
+	if header.SchemaVersion > models.SchemaVersion {
+		return nil, fmt.Errorf("Input has schema version %d, but this version of as2as only understands up to %d",
+			header.SchemaVersion, models.SchemaVersion)
+	}
+
+	if header.Kind != kind {
+		return nil, fmt.Errorf("Input is a `%s' file, but a `%s' file is required", header.Kind, kind)
+	}
+
+	if format == formatNDJSON {
+		return header, nil
+	}
+
+	if header.Checksum == "" {
+		log.Warnf("Input has no checksum; cannot verify that it is complete")
+	} else if header.Checksum != actualChecksum {
+		err = checksumMismatch(header.Checksum, actualChecksum, force, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return header, nil
+}
+
+func checksumMismatch(expected, actual string, force bool, log logger.Entry) error {
+	if force {
+		log.Warnf("Input checksum mismatch (expected %s, got %s); continuing because of --force", expected, actual)
+		return nil
+	}
+
+	return fmt.Errorf("Input checksum mismatch (expected %s, got %s). The file may be truncated or edited; use --force to continue anyway",
+		expected, actual)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thomasmitchell/as2as/models"
+)
+
+func writeTestNDJSON(t *testing.T, spaces []models.Space) string {
+	buf := &bytes.Buffer{}
+	w, err := newNDJSONWriter(buf, newHeader(models.KindDump, "api.example.com", "broker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range spaces {
+		err = w.Write(&spaces[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestReadDumpSpacesNDJSONVerification(t *testing.T) {
+	spaces := []models.Space{
+		{GUID: "space-1", Apps: []models.App{{GUID: "app-1"}}},
+		{GUID: "space-2", Apps: []models.App{{GUID: "app-2"}}},
+	}
+	good := writeTestNDJSON(t, spaces)
+	lines := strings.SplitAfter(good, "\n")
+	//A writer which skipped a line but still counted it
+	droppedWithTrailer := lines[0] + lines[2] + lines[3]
+
+	tests := []struct {
+		name    string
+		input   string
+		force   bool
+		wantErr string
+		//Spaces fn is called with, even when the check fails at the end
+		wantSpaces int
+	}{
+		{name: "intact", input: good, wantSpaces: 2},
+		{
+			name:       "truncated before trailer",
+			input:      strings.Join(lines[:3], ""),
+			wantErr:    "no trailer",
+			wantSpaces: 2,
+		},
+		{
+			name:       "truncated with force",
+			input:      strings.Join(lines[:2], ""),
+			force:      true,
+			wantSpaces: 1,
+		},
+		{
+			name:       "edited space",
+			input:      strings.Replace(good, "app-2", "app-3", 1),
+			wantErr:    "checksum mismatch",
+			wantSpaces: 2,
+		},
+		{
+			name:       "edited space with force",
+			input:      strings.Replace(good, "app-2", "app-3", 1),
+			force:      true,
+			wantSpaces: 2,
+		},
+		{
+			name:       "trailer count edited",
+			input:      strings.Replace(good, `"count":2`, `"count":3`, 1),
+			wantErr:    "trailer counts 3 spaces, but 2 were read",
+			wantSpaces: 2,
+		},
+		{
+			name:       "trailer count edited with force",
+			input:      strings.Replace(good, `"count":2`, `"count":3`, 1),
+			force:      true,
+			wantSpaces: 2,
+		},
+		{
+			name:       "space skipped by the writer",
+			input:      droppedWithTrailer,
+			wantErr:    "trailer counts 2 spaces, but 1 were read",
+			wantSpaces: 1,
+		},
+		{
+			name:       "no header or trailer",
+			input:      strings.Join(lines[1:3], ""),
+			wantSpaces: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := 0
+			err := readDumpSpaces(strings.NewReader(test.input), formatNDJSON, test.force, func(models.Space) error {
+				got++
+				return nil
+			})
+
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+			if got != test.wantSpaces {
+				t.Errorf("got %d spaces, want %d", got, test.wantSpaces)
+			}
+		})
+	}
+}
+
+func TestVerifyInputNDJSONReadsHeaderAndRewinds(t *testing.T) {
+	good := writeTestNDJSON(t, []models.Space{{GUID: "space-1"}})
+
+	f, err := ioutil.TempFile("", "as2as-*.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	//A broken record after the header must not be read by verifyInput
+	_, err = f.WriteString(good + "{broken\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := verifyInput(f, formatNDJSON, models.KindDump, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.CFHost != "api.example.com" {
+		t.Fatalf("got header %+v", header)
+	}
+
+	_, err = verifyInput(f, formatNDJSON, models.KindConverted, false)
+	if err == nil || !strings.Contains(err.Error(), "is required") {
+		t.Fatalf("got error %v, want kind mismatch", err)
+	}
+
+	offset, err := f.Seek(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 {
+		t.Errorf("file left at offset %d, want 0", offset)
+	}
+}
+
+func testDumpDocument() *models.Dump {
+	current := int64(3)
+	dump := &models.Dump{
+		Spaces: []models.Space{
+			{
+				GUID:    "space-1",
+				Name:    "yes",
+				OrgName: "null",
+				Apps: []models.App{
+					{
+						GUID:             "app-1",
+						Name:             "0123",
+						Enabled:          true,
+						InstanceLimits:   models.InstanceLimits{Min: 1, Max: 5},
+						CurrentInstances: &current,
+						Rules: []models.Rule{
+							{RuleType: models.RuleTypeCPUUtil, ThresholdMin: 0.5, ThresholdMax: 1e3},
+							{RuleType: models.RuleTypeRabbitMQDepth, QueueName: "a: b # c"},
+						},
+						ScheduledLimitChanges: models.ScheduledLimitChanges{
+							{Enabled: true, StartTime: models.TimeOfDay{Hour: 8}, Recurrence: 0x3e, InstanceLimits: models.InstanceLimits{Min: 2, Max: 4}},
+						},
+					},
+				},
+				Orphans: []models.App{{GUID: "orphan-1", Name: "1e3"}},
+			},
+			{GUID: "space-2", Name: "~"},
+		},
+	}
+	dump.Sort()
+
+	header := newHeader(models.KindDump, "api.example.com", "broker")
+	sum, _ := dump.Checksum()
+	header.Checksum = sum
+	dump.Header = &header
+	return dump
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	for _, format := range []string{formatJSON, formatYAML} {
+		t.Run(format, func(t *testing.T) {
+			in := testDumpDocument()
+			encoded := &bytes.Buffer{}
+			err := encodeDocument(encoded, format, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := &models.Dump{}
+			err = decodeDocument(bytes.NewReader(encoded.Bytes()), format, out)
+			if err != nil {
+				t.Fatalf("decoding %s: %s\n%s", format, err, encoded)
+			}
+
+			//Compare as JSON, since times lose their monotonic clock reading
+			wantJSON, _ := json.Marshal(in)
+			gotJSON, _ := json.Marshal(out)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("round trip changed the document:\ngot  %s\nwant %s", gotJSON, wantJSON)
+			}
+
+			sum, err := out.Checksum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != in.Header.Checksum {
+				t.Errorf("got checksum %s after round trip, want %s", sum, in.Header.Checksum)
+			}
+
+			reencoded := &bytes.Buffer{}
+			err = encodeDocument(reencoded, format, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reencoded.String() != encoded.String() {
+				t.Errorf("encoding is not stable:\n%s\nthen\n%s", encoded, reencoded)
+			}
+		})
+	}
+}
+
+func TestDocumentFormatsAgree(t *testing.T) {
+	in := testDumpDocument()
+	decoded := map[string]*models.Dump{}
+	for _, format := range []string{formatJSON, formatYAML} {
+		buf := &bytes.Buffer{}
+		err := encodeDocument(buf, format, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded[format] = &models.Dump{}
+		err = decodeDocument(buf, format, decoded[format])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fromJSON, _ := json.Marshal(decoded[formatJSON])
+	fromYAML, _ := json.Marshal(decoded[formatYAML])
+	if string(fromJSON) != string(fromYAML) {
+		t.Errorf("JSON and YAML decode differently:\n%s\n%s", fromJSON, fromYAML)
+	}
+}
+
+func TestVerifyInputDocumentChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		edit    func(string) string
+		force   bool
+		wantErr string
+	}{
+		{name: "json intact", format: formatJSON},
+		{name: "yaml intact", format: formatYAML},
+		{
+			name:    "json edited",
+			format:  formatJSON,
+			edit:    func(s string) string { return strings.Replace(s, "orphan-1", "orphan-2", 1) },
+			wantErr: "checksum mismatch",
+		},
+		{
+			name:    "yaml edited",
+			format:  formatYAML,
+			edit:    func(s string) string { return strings.Replace(s, "orphan-1", "orphan-2", 1) },
+			wantErr: "checksum mismatch",
+		},
+		{
+			name:   "yaml edited with force",
+			format: formatYAML,
+			edit:   func(s string) string { return strings.Replace(s, "orphan-1", "orphan-2", 1) },
+			force:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := encodeDocument(buf, test.format, testDumpDocument())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contents := buf.String()
+			if test.edit != nil {
+				contents = test.edit(contents)
+			}
+
+			f, err := ioutil.TempFile("", "as2as-*."+test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			_, err = f.WriteString(contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = verifyInput(f, test.format, models.KindDump, test.force)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
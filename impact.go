@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+//impactCmd predicts which apps OCF will scale as soon as their policy is
+// applied, by comparing each app's live instance count to the bounds its
+// policy will have at the cutover time.
+type impactCmd struct {
+	InputFile    **os.File
+	InputFormat  *string
+	Force        *bool
+	ClientID     *string
+	ClientSecret *string
+	CFHost       *string
+	RemapByName  *bool
+	At           *string
+	OutputFormat *string
+	All          *bool
+
+	stdoutWriter
+}
+
+const (
+	impactActionScaleUp   = "scale-up"
+	impactActionScaleDown = "scale-down"
+	impactActionNone      = "none"
+	//The app is stopped, so OCF won't scale it
+	impactActionStopped = "stopped"
+	//The app wasn't found on CF
+	impactActionUnknown = "unknown"
+)
+
+type impactReport struct {
+	CutoverTime string        `json:"cutover_time"`
+	ScaleUps    int           `json:"scale_ups"`
+	ScaleDowns  int           `json:"scale_downs"`
+	Unchanged   int           `json:"unchanged"`
+	Stopped     int           `json:"stopped"`
+	Unknown     int           `json:"unknown"`
+	Apps        []impactEntry `json:"apps"`
+}
+
+type impactEntry struct {
+	OrgName          string `json:"org_name,omitempty"`
+	SpaceName        string `json:"space_name,omitempty"`
+	SpaceGUID        string `json:"space_guid"`
+	AppName          string `json:"app_name,omitempty"`
+	AppGUID          string `json:"app_guid"`
+	CurrentInstances int64  `json:"current_instances"`
+	InstanceMinCount int64  `json:"instance_min_count"`
+	InstanceMaxCount int64  `json:"instance_max_count"`
+	//Which schedule sets the bounds at the cutover time, if any
+	Schedule        string `json:"schedule,omitempty"`
+	Action          string `json:"action"`
+	TargetInstances int64  `json:"target_instances"`
+}
+
+func (i *impactCmd) Run() error {
+	cutover := time.Now()
+	if *i.At != "" {
+		var err error
+		cutover, err = time.Parse(time.RFC3339, *i.At)
+		if err != nil {
+			return fmt.Errorf("Error parsing --at: %s", err)
+		}
+	}
+
+	inputFormat := detectInputFormat(*i.InputFormat, (*i.InputFile).Name())
+	_, err := verifyInput(*i.InputFile, inputFormat, models.KindConverted, *i.Force)
+	if err != nil {
+		return err
+	}
+
+	cf, err := buildCFClient(*i.CFHost, *i.ClientID, *i.ClientSecret)
+	if err != nil {
+		return err
+	}
+
+	services, err := newServiceAPI(cf)
+	if err != nil {
+		return err
+	}
+
+	var remapper *nameRemapper
+	if *i.RemapByName {
+		remapper = newNameRemapper(services)
+	}
+
+	report := impactReport{CutoverTime: cutover.Format(time.RFC3339), Apps: []impactEntry{}}
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "impact"})
+	err = readConvertedSpaces(*i.InputFile, inputFormat, *i.Force, func(space models.ConvertedSpace) error {
+		if remapper != nil {
+			var found bool
+			var err error
+			space, found, err = remapper.Remap(space)
+			if err != nil || !found {
+				return err
+			}
+		}
+
+		apps, err := liveAppsInSpace(services, space.GUID)
+		if err != nil {
+			return err
+		}
+
+		for _, app := range space.Apps {
+			if app.Policy == nil {
+				continue
+			}
+
+			entry, err := predictImpact(space, app, apps, cutover)
+			if err != nil {
+				return err
+			}
+
+			switch entry.Action {
+			case impactActionScaleUp:
+				report.ScaleUps++
+			case impactActionScaleDown:
+				report.ScaleDowns++
+			case impactActionStopped:
+				report.Stopped++
+			case impactActionUnknown:
+				report.Unknown++
+			default:
+				report.Unchanged++
+			}
+
+			if entry.Action == impactActionScaleUp || entry.Action == impactActionScaleDown {
+				log.WithFields(logger.Fields{
+					logger.FieldOrgName:   entry.OrgName,
+					logger.FieldSpaceName: entry.SpaceName,
+					logger.FieldAppName:   entry.AppName,
+					logger.FieldAppGUID:   entry.AppGUID,
+				}).Infof("Will %s from %d to %d instances", entry.Action, entry.CurrentInstances, entry.TargetInstances)
+			}
+
+			if *i.All || entry.Action != impactActionNone {
+				report.Apps = append(report.Apps, entry)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*i.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	if remapper != nil {
+		remapper.Report.Print()
+	}
+
+	log.Infof("At %s: %d apps will scale up, %d will scale down, %d unchanged, %d stopped, %d not found on CF",
+		report.CutoverTime, report.ScaleUps, report.ScaleDowns, report.Unchanged, report.Stopped, report.Unknown)
+
+	err = encodeDocument(i.output(), *i.OutputFormat, &report)
+	if err != nil {
+		return fmt.Errorf("Error writing impact report: %s", err)
+	}
+
+	return nil
+}
+
+//app GUID -> app
+func liveAppsInSpace(services serviceAPI, spaceGUID string) (map[string]cfclient.App, error) {
+	apps, err := services.ListAppsInSpace(spaceGUID)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing apps in space with GUID `%s': %s", spaceGUID, err)
+	}
+
+	ret := map[string]cfclient.App{}
+	for _, app := range apps {
+		ret[app.Guid] = app
+	}
+
+	return ret, nil
+}
+
+func predictImpact(space models.ConvertedSpace, app models.ConvertedPolicyToApp, live map[string]cfclient.App, at time.Time) (impactEntry, error) {
+	ret := impactEntry{
+		OrgName:   space.OrgName,
+		SpaceName: space.Name,
+		SpaceGUID: space.GUID,
+		AppName:   app.Name,
+		AppGUID:   app.GUID,
+	}
+
+	min, max, schedule, err := activeBounds(app.Policy, at)
+	if err != nil {
+		return ret, fmt.Errorf("Error checking schedules of app with GUID `%s': %s", app.GUID, err)
+	}
+	ret.InstanceMinCount, ret.InstanceMaxCount, ret.Schedule = min, max, schedule
+
+	liveApp, found := live[app.GUID]
+	if !found {
+		ret.Action = impactActionUnknown
+		return ret, nil
+	}
+
+	ret.CurrentInstances = int64(liveApp.Instances)
+	ret.TargetInstances = ret.CurrentInstances
+	switch {
+	case liveApp.State == "STOPPED":
+		ret.Action = impactActionStopped
+	case ret.CurrentInstances < min:
+		ret.Action = impactActionScaleUp
+		ret.TargetInstances = min
+	case ret.CurrentInstances > max:
+		ret.Action = impactActionScaleDown
+		ret.TargetInstances = max
+	default:
+		ret.Action = impactActionNone
+	}
+
+	return ret, nil
+}
+
+//OCF's format for specific date schedules
+const ocfDateTimeLayout = "2006-01-02T15:04"
+
+//Returns the bounds OCF enforces at the given time, and which schedule they
+// come from. Specific dates win over recurring schedules, as in OCF.
+func activeBounds(policy *ocfas.Policy, at time.Time) (int64, int64, string, error) {
+	if policy.Schedules == nil {
+		return policy.InstanceMinCount, policy.InstanceMaxCount, "", nil
+	}
+
+	loc, err := time.LoadLocation(policy.Schedules.Timezone)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	at = at.In(loc)
+
+	for _, sched := range policy.Schedules.SpecificDate {
+		start, err := time.ParseInLocation(ocfDateTimeLayout, sched.StartDateTime, loc)
+		if err != nil {
+			return 0, 0, "", err
+		}
+
+		end, err := time.ParseInLocation(ocfDateTimeLayout, sched.EndDateTime, loc)
+		if err != nil {
+			return 0, 0, "", err
+		}
+
+		//End times are inclusive to the minute
+		if !at.Before(start) && at.Before(end.Add(time.Minute)) {
+			return sched.InstanceMinCount, sched.InstanceMaxCount,
+				fmt.Sprintf("specific date %s to %s", sched.StartDateTime, sched.EndDateTime), nil
+		}
+	}
+
+	weekday := int8((at.Weekday()+6)%7) + 1
+	timeOfDay := at.Format("15:04")
+	for _, sched := range policy.Schedules.RecurringSchedule {
+		if timeOfDay < sched.StartTime || timeOfDay > sched.EndTime {
+			continue
+		}
+
+		for _, day := range sched.DaysOfWeek {
+			if day == weekday {
+				return sched.InstanceMinCount, sched.InstanceMaxCount,
+					fmt.Sprintf("recurring %s to %s on days %v", sched.StartTime, sched.EndTime, sched.DaysOfWeek), nil
+			}
+		}
+	}
+
+	return policy.InstanceMinCount, policy.InstanceMaxCount, "", nil
+}
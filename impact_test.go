@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+func TestActiveBounds(t *testing.T) {
+	policy := &ocfas.Policy{
+		InstanceMinCount: 1,
+		InstanceMaxCount: 10,
+		Schedules: &ocfas.Schedules{
+			Timezone: "America/New_York",
+			RecurringSchedule: []ocfas.RecurringSchedule{
+				{StartTime: "08:00", EndTime: "17:59", DaysOfWeek: ocfas.DaysOfWeek{1, 2, 3, 4, 5}, InstanceMinCount: 4, InstanceMaxCount: 8},
+				{StartTime: "00:00", EndTime: "23:59", DaysOfWeek: ocfas.DaysOfWeek{7}, InstanceMinCount: 2, InstanceMaxCount: 3},
+			},
+			SpecificDate: []ocfas.SpecificDate{
+				{StartDateTime: "2021-12-24T12:00", EndDateTime: "2021-12-26T08:00", InstanceMinCount: 6, InstanceMaxCount: 6},
+			},
+		},
+	}
+
+	//Times are in UTC, which is five hours ahead of New York in winter
+	tests := []struct {
+		name     string
+		policy   *ocfas.Policy
+		at       string
+		wantMin  int64
+		wantMax  int64
+		wantFrom string
+		wantErr  string
+	}{
+		{
+			name:    "no schedules",
+			policy:  &ocfas.Policy{InstanceMinCount: 1, InstanceMaxCount: 10},
+			at:      "2021-12-20T13:00:00Z",
+			wantMin: 1, wantMax: 10,
+		},
+		{
+			name:    "recurring start is inclusive",
+			at:      "2021-12-20T13:00:00Z",
+			wantMin: 4, wantMax: 8, wantFrom: "recurring 08:00",
+		},
+		{
+			name:    "recurring end is inclusive to the minute",
+			at:      "2021-12-20T22:59:59Z",
+			wantMin: 4, wantMax: 8, wantFrom: "recurring 08:00",
+		},
+		{
+			name:    "after recurring end",
+			at:      "2021-12-20T23:00:00Z",
+			wantMin: 1, wantMax: 10,
+		},
+		{
+			name:    "before recurring start in the schedule's timezone",
+			at:      "2021-12-20T12:59:00Z",
+			wantMin: 1, wantMax: 10,
+		},
+		{
+			name:    "Sunday is day 7",
+			at:      "2021-12-19T15:00:00Z",
+			wantMin: 2, wantMax: 3, wantFrom: "recurring 00:00",
+		},
+		{
+			name:    "weekday in UTC differs from the schedule's timezone",
+			at:      "2021-12-20T03:00:00Z",
+			wantMin: 2, wantMax: 3, wantFrom: "recurring 00:00",
+		},
+		{
+			name:    "specific date wins over recurring",
+			at:      "2021-12-24T17:00:00Z",
+			wantMin: 6, wantMax: 6, wantFrom: "specific date",
+		},
+		{
+			name:    "specific date end is inclusive to the minute",
+			at:      "2021-12-26T13:00:59Z",
+			wantMin: 6, wantMax: 6, wantFrom: "specific date",
+		},
+		{
+			name:    "after specific date",
+			at:      "2021-12-26T13:01:00Z",
+			wantMin: 2, wantMax: 3, wantFrom: "recurring 00:00",
+		},
+		{
+			name:    "unknown timezone",
+			policy:  &ocfas.Policy{Schedules: &ocfas.Schedules{Timezone: "Mars/Olympus_Mons"}},
+			at:      "2021-12-20T13:00:00Z",
+			wantErr: "unknown time zone",
+		},
+		{
+			name: "malformed specific date",
+			policy: &ocfas.Policy{Schedules: &ocfas.Schedules{
+				Timezone:     ocfas.TimezoneUTC,
+				SpecificDate: []ocfas.SpecificDate{{StartDateTime: "2021-12-24 12:00", EndDateTime: "2021-12-26T08:00"}},
+			}},
+			at:      "2021-12-20T13:00:00Z",
+			wantErr: "cannot parse",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, test.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := policy
+			if test.policy != nil {
+				p = test.policy
+			}
+
+			min, max, from, err := activeBounds(p, at)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if min != test.wantMin || max != test.wantMax {
+				t.Errorf("got bounds %d-%d, want %d-%d", min, max, test.wantMin, test.wantMax)
+			}
+			if (test.wantFrom == "") != (from == "") || !strings.HasPrefix(from, test.wantFrom) {
+				t.Errorf("got schedule %q, want one starting with %q", from, test.wantFrom)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+const (
+	//Use the autoscaler instance with the configured name, or the only
+	// autoscaler instance in the space
+	instanceStrategyByName = "by-name"
+	//Use the autoscaler instance most of the space's apps are already bound to
+	instanceStrategyBound = "bound"
+	//Use the autoscaler instance with the configured name, or else one an
+	// earlier run created, or else create one under a name nothing else in the
+	// space has
+	instanceStrategyUnique = "unique"
+)
+
+var instanceStrategies = []string{instanceStrategyByName, instanceStrategyBound, instanceStrategyUnique}
+
+const (
+	instanceActionCreated  = "created"
+	instanceActionExisting = "existing"
+)
+
+//instanceChoice records which service instance sync used for a space, and
+// why.
+type instanceChoice struct {
+	OrgName             string `json:"org_name,omitempty"`
+	SpaceName           string `json:"space_name,omitempty"`
+	SpaceGUID           string `json:"space_guid"`
+	ServiceInstanceGUID string `json:"service_instance_guid"`
+	ServiceInstanceName string `json:"service_instance_name"`
+	ServicePlan         string `json:"service_plan"`
+	Action              string `json:"action"`
+	Strategy            string `json:"strategy"`
+	//Set if the choice was not obvious, such as when there were several
+	// autoscaler instances to choose from
+	Conflict string `json:"conflict,omitempty"`
+}
+
+//instanceDecision is either an existing instance to use, or a name to create
+// a new instance under.
+type instanceDecision struct {
+	Existing   *cfclient.ServiceInstance
+	CreateName string
+	Conflict   string
+}
+
+type instanceResolver struct {
+	services serviceAPI
+	plans    *planSelector
+	name     string
+	strategy string
+	//Matches the names resolveUnique gives instances when name is taken
+	uniqueName *regexp.Regexp
+	//space GUID -> autoscaler service instances in that space
+	existing map[string][]cfclient.ServiceInstance
+
+	lock sync.Mutex
+	//space GUID -> decision, so that sync decides once when checking spaces
+	// up front and reuses it when creating instances
+	decisions map[string]instanceDecision
+}
+
+func newInstanceResolver(services serviceAPI, plans *planSelector, name, strategy string, existing map[string][]cfclient.ServiceInstance) *instanceResolver {
+	for spaceGUID := range existing {
+		sort.Slice(existing[spaceGUID], func(i, j int) bool {
+			return existing[spaceGUID][i].Guid < existing[spaceGUID][j].Guid
+		})
+	}
+
+	return &instanceResolver{
+		services:   services,
+		plans:      plans,
+		name:       name,
+		strategy:   strategy,
+		uniqueName: regexp.MustCompile("^" + regexp.QuoteMeta(name) + `-([0-9]+)$`),
+		existing:   existing,
+		decisions:  map[string]instanceDecision{},
+	}
+}
+
+func (r *instanceResolver) Resolve(space models.ConvertedSpace) (instanceDecision, error) {
+	r.lock.Lock()
+	decision, cached := r.decisions[space.GUID]
+	r.lock.Unlock()
+	if cached {
+		return decision, nil
+	}
+
+	decision, err := r.resolve(space)
+	if err != nil {
+		return decision, err
+	}
+
+	r.lock.Lock()
+	r.decisions[space.GUID] = decision
+	r.lock.Unlock()
+	return decision, nil
+}
+
+func (r *instanceResolver) resolve(space models.ConvertedSpace) (instanceDecision, error) {
+	candidates := r.existing[space.GUID]
+
+	var named *cfclient.ServiceInstance
+	for i := range candidates {
+		if candidates[i].Name == r.name {
+			named = &candidates[i]
+		}
+	}
+
+	conflict := ""
+	if len(candidates) > 1 {
+		conflict = fmt.Sprintf("%d autoscaler service instances in space", len(candidates))
+	}
+
+	switch r.strategy {
+	case instanceStrategyBound:
+		if len(candidates) > 1 {
+			return r.resolveBound(space, candidates, named, conflict)
+		}
+
+	case instanceStrategyUnique:
+		if named != nil {
+			return instanceDecision{Existing: named, Conflict: conflict}, nil
+		}
+
+		return r.resolveUnique(space, candidates, conflict)
+	}
+
+	return r.resolveByName(space, candidates, named, conflict)
+}
+
+func (r *instanceResolver) resolveByName(
+	space models.ConvertedSpace,
+	candidates []cfclient.ServiceInstance,
+	named *cfclient.ServiceInstance,
+	conflict string,
+) (instanceDecision, error) {
+	if named != nil {
+		return instanceDecision{Existing: named, Conflict: conflict}, nil
+	}
+
+	if len(candidates) == 1 {
+		return instanceDecision{Existing: &candidates[0]}, nil
+	}
+
+	if len(candidates) > 1 {
+		return instanceDecision{}, fmt.Errorf("Space with GUID `%s' has %d autoscaler service instances and none is named `%s'; choose one with --instance-strategy %s or %s",
+			space.GUID, len(candidates), r.name, instanceStrategyBound, instanceStrategyUnique)
+	}
+
+	taken, err := r.takenNames(space.GUID)
+	if err != nil {
+		return instanceDecision{}, err
+	}
+
+	if taken[r.name] {
+		return instanceDecision{}, fmt.Errorf("Space with GUID `%s' already has a service instance named `%s' which is not an autoscaler instance; use --instance-strategy %s or a different --service-instance-name",
+			space.GUID, r.name, instanceStrategyUnique)
+	}
+
+	return instanceDecision{CreateName: r.name}, nil
+}
+
+func (r *instanceResolver) resolveBound(
+	space models.ConvertedSpace,
+	candidates []cfclient.ServiceInstance,
+	named *cfclient.ServiceInstance,
+	conflict string,
+) (instanceDecision, error) {
+	counts, best, tied, err := r.countBound(space, candidates)
+	if err != nil {
+		return instanceDecision{}, err
+	}
+
+	if counts[best] == 0 {
+		return r.resolveByName(space, candidates, named, conflict+"; no apps bound to any of them")
+	}
+
+	if tied {
+		//Candidates are sorted by GUID, so the first with the most bindings
+		// is a stable choice
+		conflict += fmt.Sprintf("; several are bound to %d apps", counts[best])
+		if named != nil && counts[indexOfInstance(candidates, named.Guid)] == counts[best] {
+			return instanceDecision{Existing: named, Conflict: conflict}, nil
+		}
+	}
+
+	return instanceDecision{Existing: &candidates[best], Conflict: conflict}, nil
+}
+
+//Returns how many of the space's apps are bound to each candidate, and the
+// index of the first candidate with the most.
+func (r *instanceResolver) countBound(space models.ConvertedSpace, candidates []cfclient.ServiceInstance) ([]int, int, bool, error) {
+	inSpace := map[string]bool{}
+	for _, app := range space.Apps {
+		inSpace[app.GUID] = true
+	}
+
+	counts := make([]int, len(candidates))
+	best := -1
+	tied := false
+	for i := range candidates {
+		bindings, err := r.services.ListBindings(candidates[i].Guid, "")
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("Error checking service bindings for service instance with GUID `%s': %s", candidates[i].Guid, err)
+		}
+
+		for _, binding := range bindings {
+			if inSpace[binding.AppGuid] {
+				counts[i]++
+			}
+		}
+
+		switch {
+		case best == -1 || counts[i] > counts[best]:
+			best, tied = i, false
+		case counts[i] == counts[best]:
+			tied = true
+		}
+	}
+
+	return counts, best, tied, nil
+}
+
+//resolveUnique is only reached when no instance has the configured name. A
+// rerun must not create another instance, so an instance the apps are already
+// bound to, or one an earlier run created, is used before creating one.
+func (r *instanceResolver) resolveUnique(space models.ConvertedSpace, candidates []cfclient.ServiceInstance, conflict string) (instanceDecision, error) {
+	if len(candidates) > 0 {
+		counts, best, _, err := r.countBound(space, candidates)
+		if err != nil {
+			return instanceDecision{}, err
+		}
+
+		if counts[best] > 0 {
+			conflict = joinConflicts(conflict, fmt.Sprintf("no instance named `%s'; using the one %d apps are bound to", r.name, counts[best]))
+			return instanceDecision{Existing: &candidates[best], Conflict: conflict}, nil
+		}
+
+		created := r.createdByUnique(space, candidates)
+		if created != nil {
+			conflict = joinConflicts(conflict, fmt.Sprintf("name `%s' is taken; using `%s' from an earlier run", r.name, created.Name))
+			return instanceDecision{Existing: created, Conflict: conflict}, nil
+		}
+	}
+
+	taken, err := r.takenNames(space.GUID)
+	if err != nil {
+		return instanceDecision{}, err
+	}
+
+	name := r.name
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d", r.name, i)
+	}
+
+	if name != r.name {
+		conflict = joinConflicts(conflict, fmt.Sprintf("name `%s' is taken", r.name))
+	}
+
+	return instanceDecision{CreateName: name, Conflict: conflict}, nil
+}
+
+//Returns the candidate with the lowest `name-N' name and the plan a new
+// instance in the space would get, or nil if there is none. If no plan can be
+// chosen for the space, any plan will do, since nothing needs creating if a
+// candidate matches.
+func (r *instanceResolver) createdByUnique(space models.ConvertedSpace, candidates []cfclient.ServiceInstance) *cfclient.ServiceInstance {
+	planGUID := ""
+	plan, err := r.plans.PlanFor(space)
+	if err == nil {
+		planGUID = plan.Guid
+	}
+
+	var ret *cfclient.ServiceInstance
+	lowest := 0
+	for i := range candidates {
+		match := r.uniqueName.FindStringSubmatch(candidates[i].Name)
+		if match == nil || (planGUID != "" && candidates[i].ServicePlanGuid != planGUID) {
+			continue
+		}
+
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+
+		if ret == nil || n < lowest {
+			ret, lowest = &candidates[i], n
+		}
+	}
+
+	return ret
+}
+
+//Service instance names are unique per space across every broker and
+// user-provided instances.
+func (r *instanceResolver) takenNames(spaceGUID string) (map[string]bool, error) {
+	names, err := r.services.ListServiceInstanceNamesInSpace(spaceGUID)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing service instances in space with GUID `%s': %s", spaceGUID, err)
+	}
+
+	ret := map[string]bool{}
+	for _, name := range names {
+		ret[name] = true
+	}
+
+	return ret, nil
+}
+
+func indexOfInstance(instances []cfclient.ServiceInstance, guid string) int {
+	for i := range instances {
+		if instances[i].Guid == guid {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func joinConflicts(conflict, more string) string {
+	if conflict == "" {
+		return more
+	}
+
+	return conflict + "; " + more
+}
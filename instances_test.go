@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+//Resolves the space the way a sync run does, creating the instance if the
+// decision is to create one.
+func resolveAndCreate(t *testing.T, services *fakeServices, strategy string, space models.ConvertedSpace) instanceDecision {
+	plans, err := newPlanSelector(services, services.plans, "free", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := (&syncCmd{}).mapSpaceGUIDsToServiceInstances(services, services.plans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision, err := newInstanceResolver(services, plans, "autoscaler", strategy, existing).Resolve(space)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision.Existing == nil {
+		plan, err := plans.PlanFor(space)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = services.CreateServiceInstance(decision.CreateName, space.GUID, plan.Guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return decision
+}
+
+func TestResolveIsIdempotent(t *testing.T) {
+	space := models.ConvertedSpace{GUID: "space-b1", Apps: []models.ConvertedPolicyToApp{{GUID: "app-1"}}}
+	for _, strategy := range instanceStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			services := testPlanServices()
+			for run := 1; run <= 2; run++ {
+				resolveAndCreate(t, services, strategy, space)
+			}
+
+			if len(services.instances) != 1 {
+				t.Errorf("got %d instances after two runs, want 1: %+v", len(services.instances), services.instances)
+			}
+		})
+	}
+}
+
+func TestResolveUniqueReusesEarlierInstance(t *testing.T) {
+	space := models.ConvertedSpace{GUID: "space-b1", Apps: []models.ConvertedPolicyToApp{{GUID: "app-1"}}}
+	tests := []struct {
+		name string
+		//In space-b1, besides a user-provided instance named `autoscaler'
+		instances []cfclient.ServiceInstance
+		bindings  []fakeBinding
+		//Empty if a new instance should be created
+		wantGUID   string
+		wantCreate string
+	}{
+		{
+			name:       "nothing to reuse",
+			wantCreate: "autoscaler-2",
+		},
+		{
+			name: "created by an earlier run",
+			instances: []cfclient.ServiceInstance{
+				{Guid: "instance-a", Name: "autoscaler-3", ServicePlanGuid: "plan-free"},
+				{Guid: "instance-b", Name: "autoscaler-2", ServicePlanGuid: "plan-free"},
+			},
+			wantGUID: "instance-b",
+		},
+		{
+			name: "same name pattern but another plan",
+			instances: []cfclient.ServiceInstance{
+				{Guid: "instance-a", Name: "autoscaler-2", ServicePlanGuid: "plan-gold"},
+			},
+			wantCreate: "autoscaler-3",
+		},
+		{
+			name: "name outside the pattern",
+			instances: []cfclient.ServiceInstance{
+				{Guid: "instance-a", Name: "autoscaler-old", ServicePlanGuid: "plan-free"},
+			},
+			wantCreate: "autoscaler-2",
+		},
+		{
+			name: "apps already bound",
+			instances: []cfclient.ServiceInstance{
+				{Guid: "instance-a", Name: "autoscaler-2", ServicePlanGuid: "plan-free"},
+				{Guid: "instance-b", Name: "scaler", ServicePlanGuid: "plan-gold"},
+			},
+			bindings: []fakeBinding{
+				{ServiceBinding: cfclient.ServiceBinding{Guid: "binding-1", AppGuid: "app-1", ServiceInstanceGuid: "instance-b"}},
+			},
+			wantGUID: "instance-b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services := testPlanServices()
+			services.otherInstances = map[string][]string{"space-b1": {"autoscaler"}}
+			for _, instance := range test.instances {
+				instance.SpaceGuid = "space-b1"
+				services.instances = append(services.instances, instance)
+			}
+			services.bindings = test.bindings
+
+			decision := resolveAndCreate(t, services, instanceStrategyUnique, space)
+			if test.wantGUID != "" {
+				if decision.Existing == nil || decision.Existing.Guid != test.wantGUID {
+					t.Fatalf("got decision %+v, want existing instance %s", decision, test.wantGUID)
+				}
+				if !strings.Contains(decision.Conflict, "autoscaler") {
+					t.Errorf("conflict %q does not explain the choice", decision.Conflict)
+				}
+				return
+			}
+
+			if decision.CreateName != test.wantCreate {
+				t.Fatalf("got decision %+v, want to create %s", decision, test.wantCreate)
+			}
+
+			again := resolveAndCreate(t, services, instanceStrategyUnique, space)
+			if again.Existing == nil || again.Existing.Name != test.wantCreate {
+				t.Errorf("rerun got decision %+v, want the instance the first run created", again)
+			}
+			if len(services.instances) != len(test.instances)+1 {
+				t.Errorf("got %d instances, want %d", len(services.instances), len(test.instances)+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if name == strings.ToLower(s) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("Unknown log level `%s'", s)
+}
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+//Common field names, so that the same thing is searchable by the same key
+// no matter which stage logged it.
+const (
+	FieldStage               = "stage"
+	FieldOrgName             = "org_name"
+	FieldSpaceName           = "space_name"
+	FieldSpaceGUID           = "space_guid"
+	FieldAppName             = "app_name"
+	FieldAppGUID             = "app_guid"
+	FieldServiceInstanceGUID = "service_instance_guid"
+	FieldDuration            = "duration"
+	FieldHTTPMethod          = "http_method"
+	FieldHTTPURL             = "http_url"
+	FieldHTTPStatus          = "http_status"
+	FieldError               = "error"
+)
+
+type Fields map[string]interface{}
+
+type logger struct {
+	lock   sync.Mutex
+	out    io.Writer
+	level  Level
+	format Format
+}
+
+var std = &logger{
+	out:    os.Stderr,
+	level:  LevelInfo,
+	format: FormatText,
+}
+
+func Setup(out io.Writer, level Level, format Format) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.out = out
+	std.level = level
+	std.format = format
+}
+
+//Returns the previous output
+func SetOutput(out io.Writer) io.Writer {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	old := std.out
+	std.out = out
+	return old
+}
+
+func Enabled(level Level) bool {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	return level >= std.level
+}
+
+type Entry struct {
+	fields Fields
+}
+
+func WithFields(fields Fields) Entry {
+	return Entry{}.WithFields(fields)
+}
+
+func (e Entry) WithFields(fields Fields) Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return Entry{fields: merged}
+}
+
+func (e Entry) Debugf(f string, args ...interface{}) { std.log(LevelDebug, e.fields, f, args...) }
+func (e Entry) Infof(f string, args ...interface{})  { std.log(LevelInfo, e.fields, f, args...) }
+func (e Entry) Warnf(f string, args ...interface{})  { std.log(LevelWarn, e.fields, f, args...) }
+func (e Entry) Errorf(f string, args ...interface{}) { std.log(LevelError, e.fields, f, args...) }
+
+func Debugf(f string, args ...interface{}) { std.log(LevelDebug, nil, f, args...) }
+func Infof(f string, args ...interface{})  { std.log(LevelInfo, nil, f, args...) }
+func Warnf(f string, args ...interface{})  { std.log(LevelWarn, nil, f, args...) }
+func Errorf(f string, args ...interface{}) { std.log(LevelError, nil, f, args...) }
+
+func (l *logger) log(level Level, fields Fields, f string, args ...interface{}) {
+	l.lock.Lock()
+	minLevel, format := l.level, l.format
+	l.lock.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	msg := fmt.Sprintf(f, args...)
+	now := time.Now()
+
+	var line []byte
+	if format == FormatJSON {
+		line = jsonLine(now, level, msg, fields)
+	} else {
+		line = textLine(level, msg, fields)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+func jsonLine(now time.Time, level Level, msg string, fields Fields) []byte {
+	obj := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, isErr := v.(error); isErr {
+			v = err.Error()
+		}
+		if d, isDuration := v.(time.Duration); isDuration {
+			v = d.Seconds()
+		}
+		obj[k] = v
+	}
+
+	obj["time"] = now.UTC().Format(time.RFC3339Nano)
+	obj["level"] = level.String()
+	obj["msg"] = msg
+
+	ret, err := json.Marshal(obj)
+	if err != nil {
+		ret, _ = json.Marshal(map[string]interface{}{
+			"time":  obj["time"],
+			"level": obj["level"],
+			"msg":   msg,
+			"error": fmt.Sprintf("Could not encode log fields: %s", err),
+		})
+	}
+
+	return append(ret, '\n')
+}
+
+func textLine(level Level, msg string, fields Fields) []byte {
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("%-5s %s", strings.ToUpper(level.String()), msg))
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := fmt.Sprintf("%v", fields[k])
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+
+		b.WriteString(fmt.Sprintf(" %s=%s", k, v))
+	}
+
+	b.WriteString("\n")
+	return []byte(b.String())
+}
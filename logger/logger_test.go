@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Run with -race to catch unsynchronized access to the logger settings
+func TestConcurrentSetupAndLog(t *testing.T) {
+	defer Setup(ioutil.Discard, LevelInfo, FormatText)
+
+	wait := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				WithFields(Fields{FieldStage: "test"}).Infof("message %d", j)
+				Enabled(LevelDebug)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		Setup(ioutil.Discard, LevelDebug, FormatJSON)
+		Setup(ioutil.Discard, LevelInfo, FormatText)
+	}
+
+	wait.Wait()
+}
+
+func TestLevelsAndFormats(t *testing.T) {
+	defer Setup(ioutil.Discard, LevelInfo, FormatText)
+
+	tests := []struct {
+		name   string
+		level  Level
+		format Format
+		log    func()
+		want   string
+	}{
+		{"filtered", LevelWarn, FormatText, func() { Infof("hello") }, ""},
+		{"text", LevelInfo, FormatText, func() { WithFields(Fields{"b": "x y", "a": 1}).Warnf("hello") }, "WARN  hello a=1 b=\"x y\"\n"},
+		{"json", LevelDebug, FormatJSON, func() { Debugf("hello") }, `"level":"debug","msg":"hello"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			Setup(out, test.level, test.format)
+			test.log()
+
+			if test.want == "" {
+				if out.Len() != 0 {
+					t.Errorf("got %q, want nothing", out)
+				}
+				return
+			}
+
+			if !strings.Contains(out.String(), test.want) {
+				t.Errorf("got %q, want it to contain %q", out, test.want)
+			}
+		})
+	}
+}
@@ -3,51 +3,181 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/pcfas"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 func main() {
 	dumpCom := app.Command("dump", "Dump the autoscaling information out of the PCF server")
 	cmdIndex["dump"] = &dumpCmd{
-		ClientID:     dumpCom.Flag("client-id", "The client id to auth with").Required().String(),
-		ClientSecret: dumpCom.Flag("client-secret", "The client secret to auth with").Required().String(),
-		CFHost:       dumpCom.Flag("cf-host", "The CF API host to scrape from").Required().String(),
-		PCFASHost:    dumpCom.Flag("pcfas-host", "The PCF Autoscaler API to talk to").Required().String(),
-		BrokerGUID:   dumpCom.Flag("broker-guid", "The GUID of the autoscaler service broker").Required().String(),
+		ClientID:      dumpCom.Flag("client-id", "The client id to auth with").Required().String(),
+		ClientSecret:  dumpCom.Flag("client-secret", "The client secret to auth with").Required().String(),
+		CFHost:        dumpCom.Flag("cf-host", "The CF API host to scrape from").Required().String(),
+		PCFASHost:     dumpCom.Flag("pcfas-host", "The PCF Autoscaler API to talk to. Defaults to autoscale.<system domain>").String(),
+		BrokerGUID:    dumpCom.Flag("broker-guid", "The GUID of the autoscaler service broker. Discovered by --service if not given").String(),
+		ServiceName:   dumpCom.Flag("service", "The name of the PCF autoscaler service offering, to discover the broker by").Default(defaultPCFServiceName).String(),
+		Format:        dumpCom.Flag("format", "The format to write the dump in (json, ndjson, yaml)").Default(formatJSON).Enum(outputFormats...),
+		PageSize:      dumpCom.Flag("pcfas-page-size", "How many resources to ask the PCF Autoscaler API for per page").Default(strconv.Itoa(pcfas.DefaultPageSize)).Int(),
+		ParallelPages: dumpCom.Flag("pcfas-parallel-pages", "How many pages of a PCF Autoscaler API list to fetch at once").Default(strconv.Itoa(pcfas.DefaultParallelPages)).Int(),
+		WithHistory:   dumpCom.Flag("with-history", "Also dump each app's scaling events from the PCF autoscaler").Bool(),
+		Since:         dumpCom.Flag("since", "How far back to dump scaling events with --with-history").Default("168h").PlaceHolder("DURATION").Duration(),
 	}
 
 	convertCom := app.Command("convert", "Output OCF autoscaler converted rules")
 	cmdIndex["convert"] = &convertCmd{
-		InputFile: convertCom.Flag("input-file", "The file to read the exported data from").Short('f').Required().File(),
+		InputFile:    convertCom.Flag("input-file", "The file to read the exported data from").Short('f').Required().File(),
+		InputFormat:  convertCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		OutputFormat: convertCom.Flag("format", "The format to write the converted data in (json, ndjson, yaml)").Default(formatJSON).Enum(outputFormats...),
+		Force:        convertCom.Flag("force", "Convert the input even if its checksum does not match").Bool(),
+		Overrides:    convertCom.Flag("overrides", "A JSON or YAML file of per-app merge patches or replacement policies to apply to the converted policies").File(),
+		InitialCount: convertCom.Flag("initial-count", "How to pick the instance count schedules start at (current, midpoint). current uses the app's instance count at dump time, clamped to the schedule's limits").Default(models.InitialCountCurrent).Enum(models.InitialCountStrategies...),
+		OutputDir:    convertCom.Flag("output-dir", "Write each app's policy to DIR/org/space/app.json, with an index.json mapping paths to GUIDs, instead of writing to stdout").PlaceHolder("DIR").String(),
 	}
 
 	syncCom := app.Command("sync", "Take a convert file and apply it to a Cloud Foundry")
 	cmdIndex["sync"] = &syncCmd{
 		InputFile:           syncCom.Flag("input-file", "The file to read the converted data from").Short('f').Required().File(),
+		InputFormat:         syncCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
 		ClientID:            syncCom.Flag("client-id", "The client id to auth with").Required().String(),
 		ClientSecret:        syncCom.Flag("client-secret", "The client secret to auth with").Required().String(),
 		CFHost:              syncCom.Flag("cf-host", "The CF API host to scrape from").Required().String(),
-		OCFASHost:           syncCom.Flag("ocfas-host", "The OCF Autoscaler API to talk to").Required().String(),
-		BrokerGUID:          syncCom.Flag("broker-guid", "The GUID of the autoscaler service broker").Required().String(),
+		OCFASHost:           syncCom.Flag("ocfas-host", "The OCF Autoscaler API to talk to. Defaults to autoscaler.<system domain>; unused with --policy-via-binding").String(),
+		BrokerGUID:          syncCom.Flag("broker-guid", "The GUID of the autoscaler service broker. Discovered by --service if not given").String(),
+		ServiceName:         syncCom.Flag("service", "The name of the OCF autoscaler service offering, to discover the broker by").Default(defaultOCFServiceName).String(),
 		ServiceInstanceName: syncCom.Flag("service-instance-name", "The name of the service instance to create in each space").Default("autoscaler").String(),
+		ServicePlan:         syncCom.Flag("service-plan", "The name of the service plan to create new service instances with. Required if the broker has more than one plan and no --service-plan-map is given").String(),
+		ServicePlanMap:      syncCom.Flag("service-plan-map", "A JSON or YAML file mapping org names and org/space names or space GUIDs to service plan names, overriding --service-plan").File(),
+		InstanceStrategy:    syncCom.Flag("instance-strategy", "How to pick the service instance in spaces with several autoscaler instances, or where the name is taken (by-name, bound, unique)").Default(instanceStrategyByName).Enum(instanceStrategies...),
 		Workers:             syncCom.Flag("workers", "The number of concurrent workers").Default("8").Int(),
+		RemapByName:         syncCom.Flag("remap-by-name", "Resolve target GUIDs by org, space, and app name on the target foundation").Bool(),
+		PolicyViaBinding:    syncCom.Flag("policy-via-binding", "Attach policies as service binding parameters instead of through the OCF Autoscaler API. Existing bindings with a different policy are updated through the API if its host is known; otherwise sync fails once done unless --force is given").Bool(),
+		Force:               syncCom.Flag("force", "Apply the input even if it was dumped from a different foundation or its checksum does not match, and succeed even if some existing bindings' policies could not be updated").Bool(),
+	}
+
+	exportScriptCom := app.Command("export-script", "Write a bash script of CF CLI commands that does what sync would do")
+	cmdIndex["export-script"] = &exportScriptCmd{
+		InputFile:           exportScriptCom.Flag("input-file", "The file to read the converted data from").Short('f').Required().File(),
+		InputFormat:         exportScriptCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		Force:               exportScriptCom.Flag("force", "Write the script even if the input checksum does not match").Bool(),
+		ServiceName:         exportScriptCom.Flag("service", "The name of the OCF autoscaler service offering").Default(defaultOCFServiceName).String(),
+		ServicePlan:         exportScriptCom.Flag("service-plan", "The name of the OCF autoscaler service plan to create instances of. Discovered when the script runs if the service has exactly one plan").String(),
+		ServiceInstanceName: exportScriptCom.Flag("service-instance-name", "The name of the service instance to create in each space").Default("autoscaler").String(),
+	}
+
+	exportTerraformCom := app.Command("export-terraform", "Write Terraform HCL for the service instances, bindings, and policies that sync would create")
+	cmdIndex["export-terraform"] = &exportTerraformCmd{
+		InputFile:           exportTerraformCom.Flag("input-file", "The file to read the converted data from").Short('f').Required().File(),
+		InputFormat:         exportTerraformCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		Force:               exportTerraformCom.Flag("force", "Write the HCL even if the input checksum does not match").Bool(),
+		ServiceName:         exportTerraformCom.Flag("service", "The name of the OCF autoscaler service offering").Default(defaultOCFServiceName).String(),
+		ServicePlan:         exportTerraformCom.Flag("service-plan", "The name of the OCF autoscaler service plan to create instances of. Discovered through --cf-host if the service has exactly one plan").String(),
+		ServiceInstanceName: exportTerraformCom.Flag("service-instance-name", "The name of the service instance to create in each space").Default("autoscaler").String(),
+		ClientID:            exportTerraformCom.Flag("client-id", "The client id to auth with when looking up existing resources").String(),
+		ClientSecret:        exportTerraformCom.Flag("client-secret", "The client secret to auth with when looking up existing resources").String(),
+		CFHost:              exportTerraformCom.Flag("cf-host", "The CF API host to look up existing resources on, to write import blocks for them").String(),
+		RemapByName:         exportTerraformCom.Flag("remap-by-name", "Resolve GUIDs by org, space, and app name when looking up existing resources").Bool(),
+	}
+
+	impactCom := app.Command("impact", "Predict which apps OCF will scale as soon as their policy is applied")
+	cmdIndex["impact"] = &impactCmd{
+		InputFile:    impactCom.Flag("input-file", "The file to read the converted data from").Short('f').Required().File(),
+		InputFormat:  impactCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		Force:        impactCom.Flag("force", "Use the input even if its checksum does not match").Bool(),
+		ClientID:     impactCom.Flag("client-id", "The client id to auth with").Required().String(),
+		ClientSecret: impactCom.Flag("client-secret", "The client secret to auth with").Required().String(),
+		CFHost:       impactCom.Flag("cf-host", "The CF API host to read live instance counts from").Required().String(),
+		RemapByName:  impactCom.Flag("remap-by-name", "Resolve GUIDs by org, space, and app name on the CF host").Bool(),
+		At:           impactCom.Flag("at", "The planned cutover time, in RFC 3339 format. Defaults to now").PlaceHolder("TIME").String(),
+		OutputFormat: impactCom.Flag("format", "The format to write the report in (json, ndjson, yaml)").Default(formatJSON).Enum(outputFormats...),
+		All:          impactCom.Flag("all", "Include apps which will not scale in the report").Bool(),
+	}
+
+	compareCom := app.Command("compare-scaling", "Compare PCF scaling history from before cutover with OCF scaling history after it")
+	cmdIndex["compare-scaling"] = &compareScalingCmd{
+		InputFile:    compareCom.Flag("input-file", "The dump file, made with --with-history, to read PCF scaling history from").Short('f').Required().File(),
+		InputFormat:  compareCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		Force:        compareCom.Flag("force", "Use the input even if its checksum does not match").Bool(),
+		ClientID:     compareCom.Flag("client-id", "The client id to auth with").Required().String(),
+		ClientSecret: compareCom.Flag("client-secret", "The client secret to auth with").Required().String(),
+		CFHost:       compareCom.Flag("cf-host", "The CF API host the apps were migrated to").Required().String(),
+		OCFASHost:    compareCom.Flag("ocfas-host", "The OCF Autoscaler API to read scaling history from. Defaults to autoscaler.<system domain>").String(),
+		RemapByName:  compareCom.Flag("remap-by-name", "Resolve GUIDs by org, space, and app name on the CF host").Bool(),
+		Cutover:      compareCom.Flag("cutover", "When the apps were cut over to OCF, in RFC 3339 format").PlaceHolder("TIME").Required().String(),
+		Weeks:        compareCom.Flag("weeks", "How many weeks either side of cutover to compare").Default("1").Int(),
+		Tolerance:    compareCom.Flag("tolerance", "How many more or fewer scaling events an app can have on OCF than on PCF before it is reported as differing").Default("0").Int(),
+		Metrics:      compareCom.Flag("metric", "An OCF metric type to report the mean of over the OCF window. Repeatable").Strings(),
+		OutputFormat: compareCom.Flag("format", "The format to write the report in (json, ndjson, yaml)").Default(formatJSON).Enum(outputFormats...),
+	}
+
+	prunePCFCom := app.Command("prune-pcf", "Delete the rules and scheduled limit changes of the orphaned apps recorded in a dump, and disable them in the PCF autoscaler. Its API cannot delete the apps themselves")
+	cmdIndex["prune-pcf"] = &prunePCFCmd{
+		InputFile:    prunePCFCom.Flag("input-file", "The dump file to read orphaned apps from").Short('f').Required().File(),
+		InputFormat:  prunePCFCom.Flag("input-format", "The format of the input file (auto, json, ndjson, yaml). auto detects by file extension").Default(formatAuto).Enum(inputFormats...),
+		Force:        prunePCFCom.Flag("force", "Prune even if the input checksum does not match or it was dumped from a different foundation").Bool(),
+		ClientID:     prunePCFCom.Flag("client-id", "The client id to auth with").Required().String(),
+		ClientSecret: prunePCFCom.Flag("client-secret", "The client secret to auth with").Required().String(),
+		CFHost:       prunePCFCom.Flag("cf-host", "The CF API host to check that apps are still gone from").Required().String(),
+		PCFASHost:    prunePCFCom.Flag("pcfas-host", "The PCF Autoscaler API to talk to. Defaults to autoscale.<system domain>").String(),
+		DryRun:       prunePCFCom.Flag("dry-run", "Only log what would be pruned").Bool(),
+	}
+
+	migrateCom := app.Command("migrate", "Dump, convert, validate, and sync in one go, saving each step's output")
+	cmdIndex["migrate"] = &migrateCmd{
+		ClientID:            migrateCom.Flag("client-id", "The client id to auth with").Required().String(),
+		ClientSecret:        migrateCom.Flag("client-secret", "The client secret to auth with").Required().String(),
+		CFHost:              migrateCom.Flag("cf-host", "The CF API host to scrape from").Required().String(),
+		PCFASHost:           migrateCom.Flag("pcfas-host", "The PCF Autoscaler API to talk to. Defaults to autoscale.<system domain>").String(),
+		PCFBrokerGUID:       migrateCom.Flag("pcf-broker-guid", "The GUID of the PCF autoscaler service broker. Discovered by --pcf-service if not given").String(),
+		PCFServiceName:      migrateCom.Flag("pcf-service", "The name of the PCF autoscaler service offering, to discover the broker by").Default(defaultPCFServiceName).String(),
+		TargetClientID:      migrateCom.Flag("target-client-id", "The client id to auth to the target CF with. Defaults to --client-id").String(),
+		TargetClientSecret:  migrateCom.Flag("target-client-secret", "The client secret to auth to the target CF with. Defaults to --client-secret").String(),
+		TargetCFHost:        migrateCom.Flag("target-cf-host", "The CF API host to apply the policies to. Defaults to --cf-host").String(),
+		OCFASHost:           migrateCom.Flag("ocfas-host", "The OCF Autoscaler API to talk to. Defaults to autoscaler.<target system domain>; unused with --policy-via-binding").String(),
+		OCFBrokerGUID:       migrateCom.Flag("ocf-broker-guid", "The GUID of the OCF autoscaler service broker. Discovered by --ocf-service if not given").String(),
+		OCFServiceName:      migrateCom.Flag("ocf-service", "The name of the OCF autoscaler service offering, to discover the broker by").Default(defaultOCFServiceName).String(),
+		ServiceInstanceName: migrateCom.Flag("service-instance-name", "The name of the service instance to create in each space").Default("autoscaler").String(),
+		ServicePlan:         migrateCom.Flag("service-plan", "The name of the service plan to create new service instances with. Required if the broker has more than one plan and no --service-plan-map is given").String(),
+		ServicePlanMap:      migrateCom.Flag("service-plan-map", "A JSON or YAML file mapping org names and org/space names or space GUIDs to service plan names, overriding --service-plan").File(),
+		InstanceStrategy:    migrateCom.Flag("instance-strategy", "How to pick the service instance in spaces with several autoscaler instances, or where the name is taken (by-name, bound, unique)").Default(instanceStrategyByName).Enum(instanceStrategies...),
+		Workers:             migrateCom.Flag("workers", "The number of concurrent workers").Default("8").Int(),
+		RemapByName:         migrateCom.Flag("remap-by-name", "Resolve target GUIDs by org, space, and app name on the target foundation").Bool(),
+		PolicyViaBinding:    migrateCom.Flag("policy-via-binding", "Attach policies as service binding parameters instead of through the OCF Autoscaler API. Existing bindings with a different policy are updated through the API if its host is known; otherwise sync fails once done unless --force is given").Bool(),
+		Force:               migrateCom.Flag("force", "Apply the converted data even if it was dumped from a different foundation, and succeed even if some existing bindings' policies could not be updated").Bool(),
+		OutputDir:           migrateCom.Flag("output-dir", "The directory to save the dump, converted file, and summary to").Short('o').Required().String(),
+		InitialCount:        migrateCom.Flag("initial-count", "How to pick the instance count schedules start at (current, midpoint). current uses the app's instance count at dump time, clamped to the schedule's limits").Default(models.InitialCountCurrent).Enum(models.InitialCountStrategies...),
+		Format:              migrateCom.Flag("format", "The format to save the dump and converted file in (json, ndjson, yaml)").Default(formatJSON).Enum(outputFormats...),
+		Yes:                 migrateCom.Flag("yes", "Sync without asking for confirmation after conversion").Short('y').Bool(),
 	}
 
 	app.HelpFlag.Short('h')
 	commandName := kingpin.MustParse(app.Parse(os.Args[1:]))
+	logLevel, err := logger.ParseLevel(*globalLogLevel)
+	if err != nil {
+		bailWith(err.Error())
+	}
+	logger.Setup(os.Stderr, logLevel, logger.Format(*globalLogFormat))
+
 	cmd, found := cmdIndex[commandName]
 	if !found {
 		panic(fmt.Sprintf("Unregistered command %s", commandName))
 	}
 
-	err := cmd.Run()
+	err = cmd.Run()
+	traceErr := closeTracer()
 	if err != nil {
 		bailWith(err.Error())
 	}
+
+	if traceErr != nil {
+		bailWith(traceErr.Error())
+	}
 }
 
 func bailWith(f string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "!! "+f+"\n", args...)
+	logger.Errorf(f, args...)
 	os.Exit(1)
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+type migrateCmd struct {
+	ClientID           *string
+	ClientSecret       *string
+	CFHost             *string
+	PCFASHost          *string
+	PCFBrokerGUID      *string
+	TargetClientID     *string
+	TargetClientSecret *string
+	TargetCFHost       *string
+	OCFASHost          *string
+	OCFBrokerGUID      *string
+	PCFServiceName     *string
+	OCFServiceName     *string
+
+	ServiceInstanceName *string
+	ServicePlan         *string
+	ServicePlanMap      **os.File
+	InstanceStrategy    *string
+	Workers             *int
+	RemapByName         *bool
+	PolicyViaBinding    *bool
+	Force               *bool
+	OutputDir           *string
+	Format              *string
+	InitialCount        *string
+	Yes                 *bool
+}
+
+type migrateSummary struct {
+	OutputDir     string         `json:"output_dir"`
+	DumpFile      string         `json:"dump_file"`
+	ConvertedFile string         `json:"converted_file"`
+	Dump          dumpStats      `json:"dump"`
+	Convert       convertStats   `json:"convert"`
+	InvalidApps   int            `json:"invalid_apps"`
+	Synced        bool           `json:"synced"`
+	Sync          *syncStats     `json:"sync,omitempty"`
+	Header        *models.Header `json:"converted_header,omitempty"`
+}
+
+func (m *migrateCmd) Run() error {
+	//Target credentials default to the source ones for migrations within one foundation
+	if *m.TargetCFHost == "" {
+		m.TargetCFHost = m.CFHost
+	}
+	if *m.TargetClientID == "" {
+		m.TargetClientID = m.ClientID
+	}
+	if *m.TargetClientSecret == "" {
+		m.TargetClientSecret = m.ClientSecret
+	}
+
+	err := os.MkdirAll(*m.OutputDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating output directory: %s", err)
+	}
+
+	summary := migrateSummary{
+		OutputDir:     *m.OutputDir,
+		DumpFile:      filepath.Join(*m.OutputDir, "dump."+*m.Format),
+		ConvertedFile: filepath.Join(*m.OutputDir, "converted."+*m.Format),
+	}
+
+	err = m.dump(&summary)
+	if err != nil {
+		return err
+	}
+
+	err = m.convert(&summary)
+	if err != nil {
+		return err
+	}
+
+	err = m.validate(&summary)
+	if err != nil {
+		return err
+	}
+
+	if !*m.Yes {
+		confirmed, err := m.confirm(&summary)
+		if err != nil {
+			return err
+		}
+
+		if !confirmed {
+			logger.Infof("Stopping before sync. Review `%s' and rerun with --yes, or run sync on it directly", summary.ConvertedFile)
+			return m.writeSummary(&summary)
+		}
+	}
+
+	err = m.sync(&summary)
+	if err != nil {
+		return err
+	}
+
+	return m.writeSummary(&summary)
+}
+
+func (m *migrateCmd) dump(summary *migrateSummary) error {
+	logger.WithFields(logger.Fields{logger.FieldStage: "migrate"}).Infof("Dumping PCF autoscaler data to `%s'", summary.DumpFile)
+	outFile, err := os.Create(summary.DumpFile)
+	if err != nil {
+		return fmt.Errorf("Error creating dump file: %s", err)
+	}
+
+	cmd := &dumpCmd{
+		ClientID:     m.ClientID,
+		ClientSecret: m.ClientSecret,
+		CFHost:       m.CFHost,
+		PCFASHost:    m.PCFASHost,
+		BrokerGUID:   m.PCFBrokerGUID,
+		ServiceName:  m.PCFServiceName,
+		Format:       m.Format,
+		stdoutWriter: stdoutWriter{out: outFile},
+	}
+
+	err = cmd.Run()
+	closeErr := outFile.Close()
+	if err != nil {
+		return fmt.Errorf("Error dumping: %s", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Error closing dump file: %s", closeErr)
+	}
+
+	summary.Dump = cmd.stats
+	return nil
+}
+
+func (m *migrateCmd) convert(summary *migrateSummary) error {
+	logger.WithFields(logger.Fields{logger.FieldStage: "migrate"}).Infof("Converting dump to `%s'", summary.ConvertedFile)
+	inFile, err := os.Open(summary.DumpFile)
+	if err != nil {
+		return fmt.Errorf("Error opening dump file: %s", err)
+	}
+
+	outFile, err := os.Create(summary.ConvertedFile)
+	if err != nil {
+		inFile.Close()
+		return fmt.Errorf("Error creating converted file: %s", err)
+	}
+
+	inputFormat := formatAuto
+	cmd := &convertCmd{
+		InputFile:    &inFile,
+		InputFormat:  &inputFormat,
+		OutputFormat: m.Format,
+		Force:        m.Force,
+		InitialCount: m.InitialCount,
+		stdoutWriter: stdoutWriter{out: outFile},
+	}
+
+	//convertCmd closes its input file
+	err = cmd.Run()
+	closeErr := outFile.Close()
+	if err != nil {
+		return fmt.Errorf("Error converting: %s", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Error closing converted file: %s", closeErr)
+	}
+
+	summary.Convert = cmd.stats
+	return nil
+}
+
+func (m *migrateCmd) validate(summary *migrateSummary) error {
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "validate"})
+	log.Infof("Validating converted policies")
+	inFile, err := os.Open(summary.ConvertedFile)
+	if err != nil {
+		return fmt.Errorf("Error opening converted file: %s", err)
+	}
+	defer inFile.Close()
+
+	header, err := verifyInput(inFile, *m.Format, models.KindConverted, false)
+	if err != nil {
+		return err
+	}
+	summary.Header = header
+
+	err = readConvertedSpaces(inFile, *m.Format, false, func(space models.ConvertedSpace) error {
+		for _, app := range space.Apps {
+			if app.Policy == nil {
+				continue
+			}
+
+			err := app.Policy.Validate()
+			if err != nil {
+				summary.InvalidApps++
+				log.WithFields(logger.Fields{
+					logger.FieldOrgName:   space.OrgName,
+					logger.FieldSpaceName: space.Name,
+					logger.FieldSpaceGUID: space.GUID,
+					logger.FieldAppName:   app.Name,
+					logger.FieldAppGUID:   app.GUID,
+				}).Errorf("Invalid policy: %s", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading converted file: %s", err)
+	}
+
+	if summary.InvalidApps > 0 {
+		m.printSummary(summary)
+		return fmt.Errorf("%d apps have invalid policies; fix the source data or `%s' and run sync on it directly",
+			summary.InvalidApps, summary.ConvertedFile)
+	}
+
+	return nil
+}
+
+func (m *migrateCmd) confirm(summary *migrateSummary) (bool, error) {
+	m.printSummary(summary)
+	fmt.Fprintf(os.Stderr, "Apply %d policies to %d apps on `%s'? [y/N] ",
+		summary.Convert.Policies, summary.Convert.Apps, *m.TargetCFHost)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		//Treat a closed stdin as a no
+		return false, nil
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+func (m *migrateCmd) sync(summary *migrateSummary) error {
+	logger.WithFields(logger.Fields{logger.FieldStage: "migrate"}).Infof("Syncing `%s' to `%s'", summary.ConvertedFile, *m.TargetCFHost)
+	inFile, err := os.Open(summary.ConvertedFile)
+	if err != nil {
+		return fmt.Errorf("Error opening converted file: %s", err)
+	}
+
+	inputFormat := formatAuto
+	cmd := &syncCmd{
+		InputFile:           &inFile,
+		InputFormat:         &inputFormat,
+		ClientID:            m.TargetClientID,
+		ClientSecret:        m.TargetClientSecret,
+		CFHost:              m.TargetCFHost,
+		OCFASHost:           m.OCFASHost,
+		BrokerGUID:          m.OCFBrokerGUID,
+		ServiceName:         m.OCFServiceName,
+		ServiceInstanceName: m.ServiceInstanceName,
+		ServicePlan:         m.ServicePlan,
+		ServicePlanMap:      m.ServicePlanMap,
+		InstanceStrategy:    m.InstanceStrategy,
+		Workers:             m.Workers,
+		RemapByName:         m.RemapByName,
+		PolicyViaBinding:    m.PolicyViaBinding,
+		Force:               m.Force,
+		skipSummary:         true,
+	}
+
+	//syncCmd closes its input file
+	err = cmd.Run()
+	if err != nil {
+		//Sync fails after finishing if some policies weren't applied, and the
+		// stats say how many
+		if cmd.stats.PoliciesNotApplied > 0 {
+			summary.Sync = &cmd.stats
+			m.printSummary(summary)
+		}
+
+		return fmt.Errorf("Error syncing: %s", err)
+	}
+
+	summary.Synced = true
+	summary.Sync = &cmd.stats
+	return nil
+}
+
+func (m *migrateCmd) printSummary(summary *migrateSummary) {
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "summary"})
+	log.Infof("Dumped %d apps in %d spaces to `%s'", summary.Dump.Apps, summary.Dump.Spaces, summary.DumpFile)
+	if summary.Dump.Orphans > 0 {
+		log.Infof("Recorded %d orphaned autoscaler apps unknown to CF; see prune-pcf", summary.Dump.Orphans)
+	}
+	log.Infof("Converted %d apps in %d spaces to `%s'; %d have policies",
+		summary.Convert.Apps, summary.Convert.Spaces, summary.ConvertedFile, summary.Convert.Policies)
+	log.Infof("%d apps have invalid policies", summary.InvalidApps)
+	if summary.Sync != nil {
+		summary.Sync.print(log)
+	}
+}
+
+func (m *migrateCmd) writeSummary(summary *migrateSummary) error {
+	if summary.Synced {
+		m.printSummary(summary)
+	}
+
+	path := filepath.Join(*m.OutputDir, "summary.json")
+	outFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating summary file: %s", err)
+	}
+	defer outFile.Close()
+
+	enc := json.NewEncoder(outFile)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(summary)
+	if err != nil {
+		return fmt.Errorf("Error writing summary file: %s", err)
+	}
+
+	logger.Infof("Wrote summary to `%s'", path)
+	return nil
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
+)
+
+//SchemaVersion is bumped whenever the structure of dump or converted files
+// changes in a way older versions of this tool would misread.
+const SchemaVersion = 1
+
+const (
+	KindDump      = "dump"
+	KindConverted = "converted"
+)
+
+//CFHost and BrokerGUID always refer to the foundation the data was originally
+// dumped from, even in converted files.
+type Header struct {
+	SchemaVersion int       `json:"schema_version"`
+	Kind          string    `json:"kind"`
+	ToolVersion   string    `json:"as2as_version"`
+	CFHost        string    `json:"cf_host"`
+	BrokerGUID    string    `json:"broker_guid"`
+	CreatedAt     time.Time `json:"created_at"`
+	//Set in dumps with scaling history, which covers events from then on
+	HistorySince *time.Time `json:"history_since,omitempty"`
+	//Only set in JSON documents. NDJSON streams carry the checksum in the
+	// trailer, because it isn't known until all spaces have been written.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+type Trailer struct {
+	Checksum string `json:"checksum"`
+	Count    int    `json:"count"`
+}
+
+//NDJSONEnvelope is the shape of the first and last lines of an NDJSON stream.
+// Every other line is a space.
+type NDJSONEnvelope struct {
+	Header  *Header  `json:"header,omitempty"`
+	Trailer *Trailer `json:"trailer,omitempty"`
+}
+
+//Checksummer computes the content checksum of a file from its spaces, in
+// the order they appear in the file.
+type Checksummer struct {
+	hash  hash.Hash
+	count int
+}
+
+func NewChecksummer() *Checksummer {
+	return &Checksummer{hash: sha256.New()}
+}
+
+func (c *Checksummer) Add(space interface{}) error {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(space)
+	if err != nil {
+		return err
+	}
+
+	c.hash.Write(buf.Bytes())
+	c.count++
+	return nil
+}
+
+func (c *Checksummer) Count() int {
+	return c.count
+}
+
+func (c *Checksummer) Sum() string {
+	return "sha256:" + hex.EncodeToString(c.hash.Sum(nil))
+}
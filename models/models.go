@@ -12,20 +12,89 @@ import (
 )
 
 type Dump struct {
+	Header *Header `json:"header,omitempty"`
 	Spaces []Space `json:"spaces"`
 }
 
+func (d *Dump) Checksum() (string, error) {
+	sum := NewChecksummer()
+	for i := range d.Spaces {
+		err := sum.Add(&d.Spaces[i])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return sum.Sum(), nil
+}
+
+//Sort puts the dump in a canonical order so that dumps of the same data are
+// byte-identical.
+func (d *Dump) Sort() {
+	for i := range d.Spaces {
+		d.Spaces[i].Sort()
+	}
+
+	sort.SliceStable(d.Spaces, func(i, j int) bool { return d.Spaces[i].GUID < d.Spaces[j].GUID })
+}
+
 type Space struct {
-	GUID string `json:"guid"`
-	Apps []App  `json:"apps,omitempty"`
+	GUID    string `json:"guid"`
+	Name    string `json:"name,omitempty"`
+	OrgName string `json:"org_name,omitempty"`
+	Apps    []App  `json:"apps,omitempty"`
+	//Apps the PCF autoscaler has registered in this space which CF no longer
+	// knows about, with their last known config. They are not converted
+	Orphans []App `json:"orphans,omitempty"`
+}
+
+func (s *Space) Sort() {
+	for i := range s.Apps {
+		s.Apps[i].Sort()
+	}
+
+	for i := range s.Orphans {
+		s.Orphans[i].Sort()
+	}
+
+	sort.SliceStable(s.Apps, func(i, j int) bool { return s.Apps[i].GUID < s.Apps[j].GUID })
+	sort.SliceStable(s.Orphans, func(i, j int) bool { return s.Orphans[i].GUID < s.Orphans[j].GUID })
 }
 
 type App struct {
 	GUID                  string                `json:"guid"`
+	Name                  string                `json:"name,omitempty"`
 	Enabled               bool                  `json:"enabled"`
 	InstanceLimits        InstanceLimits        `json:"instance_limits"`
 	Rules                 []Rule                `json:"rules,omitempty"`
 	ScheduledLimitChanges ScheduledLimitChanges `json:"scheduled_limit_changes,omitempty"`
+	//The number of instances CF had for the app when it was dumped. Nil in
+	// dumps from older versions
+	CurrentInstances *int64 `json:"current_instances,omitempty"`
+	//Only dumped with --with-history
+	ScalingHistory []ScalingEvent `json:"scaling_history,omitempty"`
+}
+
+//ScalingEvent is a change in an app's instance count made by the PCF
+// autoscaler.
+type ScalingEvent struct {
+	Timestamp    time.Time `json:"timestamp"`
+	OldInstances int64     `json:"old_instances"`
+	NewInstances int64     `json:"new_instances"`
+	//The type of the rule which triggered the change, or its GUID if the rule
+	// no longer exists. Empty for changes not made by a rule
+	Trigger string `json:"trigger,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (a *App) Sort() {
+	sort.SliceStable(a.Rules, func(i, j int) bool { return a.Rules[i].lessThan(a.Rules[j]) })
+	sort.SliceStable(a.ScheduledLimitChanges, func(i, j int) bool {
+		return a.ScheduledLimitChanges[i].lessThan(a.ScheduledLimitChanges[j])
+	})
+	sort.SliceStable(a.ScalingHistory, func(i, j int) bool {
+		return a.ScalingHistory[i].Timestamp.Before(a.ScalingHistory[j].Timestamp)
+	})
 }
 
 type InstanceLimits struct {
@@ -33,6 +102,22 @@ type InstanceLimits struct {
 	Max int64 `json:"max"`
 }
 
+func (l InstanceLimits) initialCount(current *int64) int64 {
+	if current == nil {
+		return (l.Min + l.Max) / 2
+	}
+
+	if *current < l.Min {
+		return l.Min
+	}
+
+	if *current > l.Max {
+		return l.Max
+	}
+
+	return *current
+}
+
 type Rule struct {
 	ComparisonMetric string  `json:"comparison_metric,omitempty"`
 	Metric           string  `json:"metric,omitempty"`
@@ -43,6 +128,29 @@ type Rule struct {
 	ThresholdMax     float64 `json:"threshold_max"`
 }
 
+func (r Rule) lessThan(r2 Rule) bool {
+	if r.RuleType != r2.RuleType {
+		return r.RuleType < r2.RuleType
+	}
+	if r.RuleSubType != r2.RuleSubType {
+		return r.RuleSubType < r2.RuleSubType
+	}
+	if r.Metric != r2.Metric {
+		return r.Metric < r2.Metric
+	}
+	if r.QueueName != r2.QueueName {
+		return r.QueueName < r2.QueueName
+	}
+	if r.ComparisonMetric != r2.ComparisonMetric {
+		return r.ComparisonMetric < r2.ComparisonMetric
+	}
+	if r.ThresholdMin != r2.ThresholdMin {
+		return r.ThresholdMin < r2.ThresholdMin
+	}
+
+	return r.ThresholdMax < r2.ThresholdMax
+}
+
 const (
 	RuleTypeCPUUtil        = "cpu"
 	RuleTypeMemoryUtil     = "memory"
@@ -58,6 +166,23 @@ type ScheduledLimitChange struct {
 	Recurrence     Recurrence     `json:"recurrence"`
 }
 
+func (s ScheduledLimitChange) lessThan(s2 ScheduledLimitChange) bool {
+	if s.StartTime != s2.StartTime {
+		return s.StartTime.LessThan(s2.StartTime)
+	}
+	if s.Recurrence != s2.Recurrence {
+		return s.Recurrence < s2.Recurrence
+	}
+	if s.InstanceLimits.Min != s2.InstanceLimits.Min {
+		return s.InstanceLimits.Min < s2.InstanceLimits.Min
+	}
+	if s.InstanceLimits.Max != s2.InstanceLimits.Max {
+		return s.InstanceLimits.Max < s2.InstanceLimits.Max
+	}
+
+	return !s.Enabled && s2.Enabled
+}
+
 type ScheduledLimitChanges []ScheduledLimitChange
 
 type TimeOfDay struct {
@@ -148,8 +273,51 @@ func ConstructApp(
 	return ret, nil
 }
 
-//Returns nil if App is not enabled
-func (a App) ToOCFPolicy() (*ocfas.Policy, error) {
+//ConstructScalingHistory names the rule which triggered each event by its
+// type, looked up in rules.
+func ConstructScalingHistory(events []pcfas.Event, rules []pcfas.Rule) ([]ScalingEvent, error) {
+	ruleTypes := map[string]string{}
+	for _, rule := range rules {
+		ruleTypes[rule.GUID] = rule.RuleType
+	}
+
+	ret := []ScalingEvent{}
+	for _, event := range events {
+		timestamp, err := time.Parse(time.RFC3339, event.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		trigger := event.RuleGUID
+		if ruleType, found := ruleTypes[event.RuleGUID]; found {
+			trigger = ruleType
+		}
+
+		ret = append(ret, ScalingEvent{
+			Timestamp:    timestamp.UTC(),
+			OldInstances: event.PreviousInstances,
+			NewInstances: event.NewInstances,
+			Trigger:      trigger,
+			Reason:       event.Reason,
+		})
+	}
+
+	return ret, nil
+}
+
+const (
+	//Start schedules at the app's current instance count, clamped to the
+	// schedule's limits. Falls back to the midpoint if the count is unknown
+	InitialCountCurrent = "current"
+	//Start schedules halfway between their min and max
+	InitialCountMidpoint = "midpoint"
+)
+
+var InitialCountStrategies = []string{InitialCountCurrent, InitialCountMidpoint}
+
+//Returns nil if App is not enabled. initialCount is one of the InitialCount
+// strategies.
+func (a App) ToOCFPolicy(initialCount string) (*ocfas.Policy, error) {
 	if !a.Enabled {
 		return nil, nil
 	}
@@ -176,7 +344,11 @@ func (a App) ToOCFPolicy() (*ocfas.Policy, error) {
 		}
 		ret.ScalingRules = append(ret.ScalingRules, rules...)
 	}
-	recurringScheds := a.ScheduledLimitChanges.ToOCFRecurringSchedules()
+	var current *int64
+	if initialCount == InitialCountCurrent {
+		current = a.CurrentInstances
+	}
+	recurringScheds := a.ScheduledLimitChanges.ToOCFRecurringSchedules(current)
 	if len(recurringScheds) > 0 {
 		ret.Schedules = &ocfas.Schedules{
 			Timezone:          "Etc/UTC",
@@ -236,8 +408,9 @@ func (r *Rule) ToOCFScalingRules() ([]ocfas.ScalingRule, error) {
 	}, nil
 }
 
-//Returns nil if Schedule not enabled
-func (s ScheduledLimitChanges) ToOCFRecurringSchedules() []ocfas.RecurringSchedule {
+//Returns nil if Schedule not enabled. Schedules start at current clamped to
+// their limits, or at their midpoint if current is nil.
+func (s ScheduledLimitChanges) ToOCFRecurringSchedules(current *int64) []ocfas.RecurringSchedule {
 	splitScheds := daySchedules{}
 	for _, sched := range s {
 		if !sched.Enabled {
@@ -251,8 +424,24 @@ func (s ScheduledLimitChanges) ToOCFRecurringSchedules() []ocfas.RecurringSchedu
 		return nil
 	}
 
+	//Two starting points at the same time on the same day would make a
+	// window which ends before it starts. The one with the larger limits
+	// sorts last, and wins
+	splitScheds.Sort()
+	deduped := daySchedules{}
+	for i := range splitScheds {
+		next := i + 1
+		if next < len(splitScheds) && splitScheds[next].Weekday == splitScheds[i].Weekday &&
+			splitScheds[next].StartTime == splitScheds[i].StartTime {
+			continue
+		}
+
+		deduped = append(deduped, splitScheds[i])
+	}
+	splitScheds = deduped
+
 	if len(splitScheds) == 1 {
-		initial := (splitScheds[0].InstanceLimits.Min + splitScheds[0].InstanceLimits.Max) / 2
+		initial := splitScheds[0].InstanceLimits.initialCount(current)
 		return []ocfas.RecurringSchedule{
 			{
 				StartTime:               TimeOfDay{0, 0}.String(),
@@ -267,9 +456,49 @@ func (s ScheduledLimitChanges) ToOCFRecurringSchedules() []ocfas.RecurringSchedu
 
 	//This turns the starting point based schedules of PCF to the OCF representations of the periods of
 	// time between the starting points.
-	verboseRet := splitScheds.ToOCF()
+	verboseRet := splitScheds.ToOCF(current)
+
+	return condenseOCFRecurringSchedules(dropZeroLengthPeriods(verboseRet))
+}
+
+//OCF requires a recurring schedule's end time to be after its start time, so
+// it cannot hold the one minute windows left by PCF starting points a minute
+// apart. Such a minute is given to the window which follows it on the same
+// day, or dropped if there is none. Each period must be for a single day.
+func dropZeroLengthPeriods(periods []ocfas.RecurringSchedule) []ocfas.RecurringSchedule {
+	periods = append([]ocfas.RecurringSchedule{}, periods...)
+	for i := range periods {
+		if periods[i].StartTime != periods[i].EndTime {
+			continue
+		}
+
+		for j := range periods {
+			if periods[j].DaysOfWeek[0] == periods[i].DaysOfWeek[0] &&
+				periods[j].StartTime == nextMinute(periods[i].EndTime) {
+				periods[j].StartTime = periods[i].StartTime
+				break
+			}
+		}
+	}
+
+	ret := make([]ocfas.RecurringSchedule, 0, len(periods))
+	for _, period := range periods {
+		if period.StartTime != period.EndTime {
+			ret = append(ret, period)
+		}
+	}
+
+	return ret
+}
+
+//Returns the empty string for 23:59, which has no next minute on the same day
+func nextMinute(hhmm string) string {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil || hhmm == "23:59" {
+		return ""
+	}
 
-	return condenseOCFRecurringSchedules(verboseRet)
+	return t.Add(time.Minute).Format("15:04")
 }
 
 //Monday is 1, Tuesday is 2....
@@ -287,99 +516,66 @@ type daySchedules []daySchedule
 
 //First thing on Sunday to last thing on Saturday
 func (d daySchedules) Sort() {
-	sort.Slice(d, func(i, j int) bool {
+	sort.SliceStable(d, func(i, j int) bool {
 		if d[i].Weekday != d[j].Weekday {
 			return d[i].Weekday < d[j].Weekday
 		}
 
-		return d[i].StartTime.LessThan(d[j].StartTime)
+		if d[i].StartTime != d[j].StartTime {
+			return d[i].StartTime.LessThan(d[j].StartTime)
+		}
+
+		if d[i].InstanceLimits.Min != d[j].InstanceLimits.Min {
+			return d[i].InstanceLimits.Min < d[j].InstanceLimits.Min
+		}
+
+		return d[i].InstanceLimits.Max < d[j].InstanceLimits.Max
 	})
 }
 
-func (d daySchedules) ToOCF() []ocfas.RecurringSchedule {
+//Each starting point's limits last until the next starting point in the week,
+// wrapping around from the last to the first. OCF schedules cannot cross
+// midnight, so a window is split into one period per day it touches. Starting
+// points must not share a day and time.
+func (d daySchedules) ToOCF(current *int64) []ocfas.RecurringSchedule {
 	d.Sort()
 
-	periods := make([]ocfas.RecurringSchedule, 0, len(d)-1)
-	var toAppend *ocfas.RecurringSchedule
-
+	periods := make([]ocfas.RecurringSchedule, 0, len(d))
 	for idx, sched := range d {
-		if toAppend != nil {
-			split := false
-			for i := d[idx-1].Weekday + 1; i < sched.Weekday; i++ {
-				//Fill in days which did not have schedule starting points
-				periods = append(periods, ocfas.RecurringSchedule{
-					StartTime:               TimeOfDay{0, 0}.String(),
-					EndTime:                 TimeOfDay{23, 59}.String(),
-					DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(i)},
-					InstanceMinCount:        toAppend.InstanceMinCount,
-					InstanceMaxCount:        toAppend.InstanceMaxCount,
-					InitialMinInstanceCount: toAppend.InitialMinInstanceCount,
-				})
-				split = true
-			}
-
-			endTime := sched.StartTime.SubOneMinute()
-
-			if split || endTime.LessThan(d[idx-1].StartTime) {
-				//Need to split into two rules if would cross day boundary
-				toAppend.EndTime = TimeOfDay{23, 59}.String()
-				periods = append(periods, *toAppend)
-
-				toAppend = &ocfas.RecurringSchedule{
-					StartTime:               TimeOfDay{0, 0}.String(),
-					DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(sched.Weekday)},
-					InstanceMinCount:        toAppend.InstanceMinCount,
-					InstanceMaxCount:        toAppend.InstanceMaxCount,
-					InitialMinInstanceCount: toAppend.InitialMinInstanceCount,
-				}
+		next := d[(idx+1)%len(d)]
+		initial := sched.InstanceLimits.initialCount(current)
+		period := func(day time.Weekday, start, end TimeOfDay) ocfas.RecurringSchedule {
+			return ocfas.RecurringSchedule{
+				StartTime:               start.String(),
+				EndTime:                 end.String(),
+				DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(day)},
+				InstanceMinCount:        sched.InstanceLimits.Min,
+				InstanceMaxCount:        sched.InstanceLimits.Max,
+				InitialMinInstanceCount: &initial,
 			}
-
-			toAppend.EndTime = endTime.String()
-			periods = append(periods, *toAppend)
 		}
 
-		initial := (sched.InstanceLimits.Min + sched.InstanceLimits.Max) / 2
-		toAppend = &ocfas.RecurringSchedule{
-			StartTime:               sched.StartTime.String(),
-			DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(sched.Weekday)},
-			InstanceMinCount:        sched.InstanceLimits.Min,
-			InstanceMaxCount:        sched.InstanceLimits.Max,
-			InitialMinInstanceCount: &initial,
+		day, start := sched.Weekday, sched.StartTime
+		//The next starting point is later the same day, unless it is this one
+		// a week on
+		if len(d) > 1 && next.Weekday == day && sched.StartTime.LessThan(next.StartTime) {
+			periods = append(periods, period(day, start, next.StartTime.SubOneMinute()))
+			continue
 		}
-	}
-
-	split := false
-	for i := d[len(d)-1].Weekday + 1; i != d[0].Weekday; i = (i + 1) % (time.Saturday + 1) {
-		periods = append(periods, ocfas.RecurringSchedule{
-			StartTime:               TimeOfDay{0, 0}.String(),
-			EndTime:                 TimeOfDay{23, 59}.String(),
-			DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(i)},
-			InstanceMinCount:        toAppend.InstanceMinCount,
-			InstanceMaxCount:        toAppend.InstanceMaxCount,
-			InitialMinInstanceCount: toAppend.InitialMinInstanceCount,
-		})
-
-		split = true
-	}
 
-	endTime := d[0].StartTime.SubOneMinute()
-
-	if split || endTime.LessThan(d[len(d)-1].StartTime) {
-		//Need to split into two rules if would cross day boundary
-		toAppend.EndTime = TimeOfDay{23, 59}.String()
-		periods = append(periods, *toAppend)
+		for {
+			periods = append(periods, period(day, start, TimeOfDay{23, 59}))
+			day, start = (day+1)%(time.Saturday+1), TimeOfDay{0, 0}
+			if day == next.Weekday {
+				break
+			}
+		}
 
-		toAppend = &ocfas.RecurringSchedule{
-			StartTime:               TimeOfDay{0, 0}.String(),
-			DaysOfWeek:              ocfas.DaysOfWeek{weekdayToOCF(d[0].Weekday)},
-			InstanceMinCount:        toAppend.InstanceMinCount,
-			InstanceMaxCount:        toAppend.InstanceMaxCount,
-			InitialMinInstanceCount: toAppend.InitialMinInstanceCount,
+		if next.StartTime != (TimeOfDay{0, 0}) {
+			periods = append(periods, period(day, start, next.StartTime.SubOneMinute()))
 		}
 	}
 
-	toAppend.EndTime = endTime.String()
-	periods = append(periods, *toAppend)
 	return periods
 }
 
@@ -414,6 +610,8 @@ func condenseOCFRecurringSchedules(in []ocfas.RecurringSchedule) []ocfas.Recurri
 	inClone := make([]ocfas.RecurringSchedule, len(in))
 	for i := range in {
 		inClone[i] = in[i]
+		//Days get appended to and sorted below, which must not touch the input
+		inClone[i].DaysOfWeek = append(ocfas.DaysOfWeek{}, in[i].DaysOfWeek...)
 	}
 
 	for i := 0; i < len(inClone); i++ {
@@ -427,8 +625,8 @@ func condenseOCFRecurringSchedules(in []ocfas.RecurringSchedule) []ocfas.Recurri
 
 				toAppend.DaysOfWeek = append(toAppend.DaysOfWeek, inClone[j].DaysOfWeek...)
 
-				inClone[j], inClone[len(inClone)-1] = inClone[len(inClone)-1], inClone[j]
-				inClone = inClone[:len(inClone)-1]
+				//Remove while keeping order, so that output order only depends on input order
+				inClone = append(inClone[:j], inClone[j+1:]...)
 				j--
 			}
 		}
@@ -437,19 +635,72 @@ func condenseOCFRecurringSchedules(in []ocfas.RecurringSchedule) []ocfas.Recurri
 		ret = append(ret, toAppend)
 	}
 
+	//First day of week, then time of day
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].DaysOfWeek[0] != ret[j].DaysOfWeek[0] {
+			return ret[i].DaysOfWeek[0] < ret[j].DaysOfWeek[0]
+		}
+
+		return ret[i].StartTime < ret[j].StartTime
+	})
+
 	return ret
 }
 
 type Converted struct {
+	Header *Header          `json:"header,omitempty"`
 	Spaces []ConvertedSpace `json:"spaces"`
 }
 
+func (c *Converted) Checksum() (string, error) {
+	sum := NewChecksummer()
+	for i := range c.Spaces {
+		err := sum.Add(&c.Spaces[i])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return sum.Sum(), nil
+}
+
+//Sort puts the converted output in a canonical order so that conversions of
+// the same data are byte-identical.
+func (c *Converted) Sort() {
+	for i := range c.Spaces {
+		c.Spaces[i].Sort()
+	}
+
+	sort.SliceStable(c.Spaces, func(i, j int) bool { return c.Spaces[i].GUID < c.Spaces[j].GUID })
+}
+
 type ConvertedSpace struct {
-	GUID string                 `json:"guid"`
-	Apps []ConvertedPolicyToApp `json:"apps,omitempty"`
+	GUID    string                 `json:"guid"`
+	Name    string                 `json:"name,omitempty"`
+	OrgName string                 `json:"org_name,omitempty"`
+	Apps    []ConvertedPolicyToApp `json:"apps,omitempty"`
 }
 
 type ConvertedPolicyToApp struct {
-	GUID   string        `json:"guid"`
-	Policy *ocfas.Policy `json:"policy,omitempty"`
+	GUID     string           `json:"guid"`
+	Name     string           `json:"name,omitempty"`
+	Policy   *ocfas.Policy    `json:"policy,omitempty"`
+	Override *AppliedOverride `json:"override,omitempty"`
+}
+
+const (
+	OverrideModeMergePatch = "merge_patch"
+	OverrideModeReplace    = "replace"
+)
+
+//AppliedOverride records that the policy was changed by an entry in an
+// overrides file after it was generated.
+type AppliedOverride struct {
+	//The key the entry was found under in the overrides file
+	Key  string `json:"key"`
+	Mode string `json:"mode"`
+}
+
+func (c *ConvertedSpace) Sort() {
+	sort.SliceStable(c.Apps, func(i, j int) bool { return c.Apps[i].GUID < c.Apps[j].GUID })
 }
@@ -0,0 +1,440 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+func testDump(order []int) Dump {
+	spaces := []Space{
+		{
+			GUID: "space-b",
+			Apps: []App{
+				{
+					GUID: "app-2",
+					Rules: []Rule{
+						{RuleType: RuleTypeMemoryUtil, ThresholdMin: 10, ThresholdMax: 90},
+						{RuleType: RuleTypeCPUUtil, ThresholdMin: 20, ThresholdMax: 80},
+						{RuleType: RuleTypeCPUUtil, ThresholdMin: 10, ThresholdMax: 80},
+					},
+					ScheduledLimitChanges: ScheduledLimitChanges{
+						{StartTime: TimeOfDay{9, 0}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{2, 4}},
+						{StartTime: TimeOfDay{8, 30}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{1, 4}},
+						{StartTime: TimeOfDay{8, 30}, Recurrence: 0x01, InstanceLimits: InstanceLimits{1, 4}},
+					},
+				},
+				{GUID: "app-1"},
+			},
+			Orphans: []App{{GUID: "orphan-2"}, {GUID: "orphan-1"}},
+		},
+		{GUID: "space-a", Apps: []App{{GUID: "app-4"}, {GUID: "app-3"}}},
+		{GUID: "space-c"},
+	}
+
+	ret := Dump{}
+	for _, i := range order {
+		ret.Spaces = append(ret.Spaces, spaces[i])
+	}
+
+	return ret
+}
+
+func reverseSlices(d *Dump) {
+	for i := range d.Spaces {
+		space := &d.Spaces[i]
+		for l, r := 0, len(space.Apps)-1; l < r; l, r = l+1, r-1 {
+			space.Apps[l], space.Apps[r] = space.Apps[r], space.Apps[l]
+		}
+		for j := range space.Apps {
+			app := &space.Apps[j]
+			for l, r := 0, len(app.Rules)-1; l < r; l, r = l+1, r-1 {
+				app.Rules[l], app.Rules[r] = app.Rules[r], app.Rules[l]
+			}
+			for l, r := 0, len(app.ScheduledLimitChanges)-1; l < r; l, r = l+1, r-1 {
+				app.ScheduledLimitChanges[l], app.ScheduledLimitChanges[r] = app.ScheduledLimitChanges[r], app.ScheduledLimitChanges[l]
+			}
+		}
+	}
+}
+
+func TestDumpSortIsCanonical(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []int
+		reverse bool
+	}{
+		{"input order", []int{0, 1, 2}, false},
+		{"spaces reversed", []int{2, 1, 0}, false},
+		{"spaces shuffled", []int{1, 2, 0}, false},
+		{"everything reversed", []int{2, 0, 1}, true},
+	}
+
+	reference := testDump([]int{0, 1, 2})
+	reference.Sort()
+	want, err := json.Marshal(&reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSum, err := reference.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dump := testDump(test.order)
+			if test.reverse {
+				reverseSlices(&dump)
+			}
+			dump.Sort()
+
+			got, err := json.Marshal(&dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+
+			gotSum, err := dump.Checksum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotSum != wantSum {
+				t.Errorf("got checksum %s, want %s", gotSum, wantSum)
+			}
+		})
+	}
+
+	spaceGUIDs := []string{}
+	for _, space := range reference.Spaces {
+		spaceGUIDs = append(spaceGUIDs, space.GUID)
+	}
+	if !reflect.DeepEqual(spaceGUIDs, []string{"space-a", "space-b", "space-c"}) {
+		t.Errorf("spaces sorted as %v", spaceGUIDs)
+	}
+
+	app := reference.Spaces[1].Apps[1]
+	if app.GUID != "app-2" || app.Rules[0].RuleType != RuleTypeCPUUtil || app.Rules[0].ThresholdMin != 10 {
+		t.Errorf("rules sorted as %+v", app.Rules)
+	}
+	if app.ScheduledLimitChanges[0].Recurrence != 0x01 || app.ScheduledLimitChanges[2].StartTime != (TimeOfDay{9, 0}) {
+		t.Errorf("scheduled limit changes sorted as %+v", app.ScheduledLimitChanges)
+	}
+}
+
+func TestCondenseOCFRecurringSchedules(t *testing.T) {
+	sched := func(start, end string, min, max int64, days ...int8) ocfas.RecurringSchedule {
+		return ocfas.RecurringSchedule{
+			StartTime:        start,
+			EndTime:          end,
+			DaysOfWeek:       ocfas.DaysOfWeek(days),
+			InstanceMinCount: min,
+			InstanceMaxCount: max,
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   []ocfas.RecurringSchedule
+		want []ocfas.RecurringSchedule
+	}{
+		{
+			name: "same window on different days merges",
+			in: []ocfas.RecurringSchedule{
+				sched("09:00", "17:00", 2, 4, 3),
+				sched("09:00", "17:00", 2, 4, 1),
+				sched("09:00", "17:00", 2, 4, 2),
+			},
+			want: []ocfas.RecurringSchedule{
+				sched("09:00", "17:00", 2, 4, 1, 2, 3),
+			},
+		},
+		{
+			name: "different limits do not merge",
+			in: []ocfas.RecurringSchedule{
+				sched("09:00", "17:00", 2, 4, 1),
+				sched("09:00", "17:00", 1, 4, 2),
+			},
+			want: []ocfas.RecurringSchedule{
+				sched("09:00", "17:00", 2, 4, 1),
+				sched("09:00", "17:00", 1, 4, 2),
+			},
+		},
+		{
+			name: "ordered by first day then start time",
+			in: []ocfas.RecurringSchedule{
+				sched("17:01", "23:59", 1, 2, 2),
+				sched("09:00", "17:00", 2, 4, 2),
+				sched("00:00", "08:59", 1, 2, 3, 1),
+			},
+			want: []ocfas.RecurringSchedule{
+				sched("00:00", "08:59", 1, 2, 1, 3),
+				sched("09:00", "17:00", 2, 4, 2),
+				sched("17:01", "23:59", 1, 2, 2),
+			},
+		},
+		{
+			name: "empty",
+			in:   []ocfas.RecurringSchedule{},
+			want: []ocfas.RecurringSchedule{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inCopy, _ := json.Marshal(test.in)
+
+			got := condenseOCFRecurringSchedules(test.in)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+
+			inAfter, _ := json.Marshal(test.in)
+			if string(inCopy) != string(inAfter) {
+				t.Errorf("input was modified")
+			}
+		})
+	}
+}
+
+func TestToOCFRecurringSchedulesIsDeterministic(t *testing.T) {
+	changes := ScheduledLimitChanges{
+		{Enabled: true, StartTime: TimeOfDay{8, 0}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{2, 6}},
+		{Enabled: true, StartTime: TimeOfDay{18, 0}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{1, 2}},
+		{Enabled: true, StartTime: TimeOfDay{10, 0}, Recurrence: 0x41, InstanceLimits: InstanceLimits{1, 3}},
+	}
+	reversed := ScheduledLimitChanges{changes[2], changes[1], changes[0]}
+
+	want, _ := json.Marshal(changes.ToOCFRecurringSchedules(nil))
+	got, _ := json.Marshal(reversed.ToOCFRecurringSchedules(nil))
+	if string(got) != string(want) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+//Returns the limits PCF would have in effect at each minute of the week, where
+// minute 0 is the start of Sunday.
+func pcfLimitsByMinute(changes ScheduledLimitChanges) []InstanceLimits {
+	const minutesPerWeek = 7 * 24 * 60
+	ret := make([]InstanceLimits, minutesPerWeek)
+	var current InstanceLimits
+	//Go round twice, so that the last starting point wraps around to the start
+	for m := 0; m < 2*minutesPerWeek; m++ {
+		day := time.Weekday(m % minutesPerWeek / (24 * 60))
+		now := TimeOfDay{uint8(m % (24 * 60) / 60), uint8(m % 60)}
+		found := false
+		for _, change := range changes {
+			if !change.Enabled || !change.Recurrence.ActiveOn(day) || change.StartTime != now {
+				continue
+			}
+
+			//Same starting point: larger limits win
+			if !found || change.InstanceLimits.Min > current.Min ||
+				(change.InstanceLimits.Min == current.Min && change.InstanceLimits.Max > current.Max) {
+				current = change.InstanceLimits
+			}
+			found = true
+		}
+
+		ret[m%minutesPerWeek] = current
+	}
+
+	return ret
+}
+
+func TestConvertedSchedulesValidate(t *testing.T) {
+	weekdays := Recurrence(0x3e)
+	everyDay := Recurrence(0x7f)
+	monday := Recurrence(0x20)
+	tuesday := Recurrence(0x10)
+
+	tests := []struct {
+		name    string
+		changes ScheduledLimitChanges
+		//Minutes which may be covered by a neighbouring window's limits, or not at all
+		maxMismatched int
+	}{
+		{
+			name: "business hours",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{8, 0}, Recurrence: weekdays, InstanceLimits: InstanceLimits{4, 8}},
+				{Enabled: true, StartTime: TimeOfDay{18, 0}, Recurrence: weekdays, InstanceLimits: InstanceLimits{1, 2}},
+			},
+		},
+		{
+			name: "starting points a minute apart",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{9, 0}, Recurrence: everyDay, InstanceLimits: InstanceLimits{2, 4}},
+				{Enabled: true, StartTime: TimeOfDay{9, 1}, Recurrence: everyDay, InstanceLimits: InstanceLimits{3, 6}},
+				{Enabled: true, StartTime: TimeOfDay{17, 0}, Recurrence: everyDay, InstanceLimits: InstanceLimits{1, 2}},
+			},
+			maxMismatched: 7,
+		},
+		{
+			name: "same starting point twice",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{9, 0}, Recurrence: weekdays, InstanceLimits: InstanceLimits{2, 4}},
+				{Enabled: true, StartTime: TimeOfDay{9, 0}, Recurrence: monday, InstanceLimits: InstanceLimits{3, 6}},
+				{Enabled: true, StartTime: TimeOfDay{17, 0}, Recurrence: weekdays, InstanceLimits: InstanceLimits{1, 2}},
+			},
+		},
+		{
+			name: "one minute after midnight following a day split",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{9, 0}, Recurrence: monday, InstanceLimits: InstanceLimits{2, 4}},
+				{Enabled: true, StartTime: TimeOfDay{0, 1}, Recurrence: tuesday, InstanceLimits: InstanceLimits{3, 6}},
+			},
+			maxMismatched: 1,
+		},
+		{
+			name: "last minute of the day",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{23, 59}, Recurrence: monday, InstanceLimits: InstanceLimits{2, 4}},
+				{Enabled: true, StartTime: TimeOfDay{0, 0}, Recurrence: tuesday, InstanceLimits: InstanceLimits{3, 6}},
+			},
+			maxMismatched: 1,
+		},
+		{
+			name: "midnight starting points",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{0, 0}, Recurrence: monday, InstanceLimits: InstanceLimits{2, 4}},
+				{Enabled: true, StartTime: TimeOfDay{0, 0}, Recurrence: tuesday, InstanceLimits: InstanceLimits{3, 6}},
+			},
+		},
+		{
+			name: "single starting point",
+			changes: ScheduledLimitChanges{
+				{Enabled: true, StartTime: TimeOfDay{12, 0}, Recurrence: monday, InstanceLimits: InstanceLimits{2, 4}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := App{
+				Enabled:               true,
+				InstanceLimits:        InstanceLimits{1, 10},
+				ScheduledLimitChanges: test.changes,
+			}
+
+			policy, err := app.ToOCFPolicy(InitialCountMidpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = policy.Validate()
+			if err != nil {
+				t.Fatalf("converted policy does not validate: %s\n%+v", err, policy.Schedules.RecurringSchedule)
+			}
+
+			pcfLimits := pcfLimitsByMinute(test.changes)
+			mismatched := 0
+			for m := 0; m < 7*24*60; m++ {
+				day := weekdayToOCF(time.Weekday(m / (24 * 60)))
+				hhmm := fmt.Sprintf("%02d:%02d", m%(24*60)/60, m%60)
+
+				var covering []ocfas.RecurringSchedule
+				for _, sched := range policy.Schedules.RecurringSchedule {
+					for _, d := range sched.DaysOfWeek {
+						if d == day && sched.StartTime <= hhmm && hhmm <= sched.EndTime {
+							covering = append(covering, sched)
+						}
+					}
+				}
+
+				if len(covering) > 1 {
+					t.Fatalf("day %d %s is covered by %d schedules: %+v", day, hhmm, len(covering), covering)
+				}
+
+				want := pcfLimits[m]
+				if len(covering) == 0 || covering[0].InstanceMinCount != want.Min || covering[0].InstanceMaxCount != want.Max {
+					mismatched++
+				}
+			}
+
+			if mismatched > test.maxMismatched {
+				t.Errorf("%d minutes of the week have the wrong limits, want at most %d\n%+v",
+					mismatched, test.maxMismatched, policy.Schedules.RecurringSchedule)
+			}
+		})
+	}
+}
+
+func TestInitialCount(t *testing.T) {
+	count := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name    string
+		limits  InstanceLimits
+		current *int64
+		want    int64
+	}{
+		{name: "no current count uses the midpoint", limits: InstanceLimits{2, 7}, want: 4},
+		{name: "midpoint of equal limits", limits: InstanceLimits{3, 3}, want: 3},
+		{name: "current within limits", limits: InstanceLimits{2, 7}, current: count(5), want: 5},
+		{name: "current at min", limits: InstanceLimits{2, 7}, current: count(2), want: 2},
+		{name: "current at max", limits: InstanceLimits{2, 7}, current: count(7), want: 7},
+		{name: "current below min", limits: InstanceLimits{2, 7}, current: count(1), want: 2},
+		{name: "current of zero", limits: InstanceLimits{1, 7}, current: count(0), want: 1},
+		{name: "current above max", limits: InstanceLimits{2, 7}, current: count(12), want: 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.limits.initialCount(test.current)
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestToOCFPolicyInitialCount(t *testing.T) {
+	count := func(n int64) *int64 { return &n }
+	app := App{
+		Enabled:        true,
+		InstanceLimits: InstanceLimits{1, 10},
+		ScheduledLimitChanges: ScheduledLimitChanges{
+			{Enabled: true, StartTime: TimeOfDay{8, 0}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{4, 8}},
+			{Enabled: true, StartTime: TimeOfDay{18, 0}, Recurrence: 0x3e, InstanceLimits: InstanceLimits{1, 2}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		current  *int64
+		//Initial counts of the 08:00 and 18:00 schedules
+		wantDay, wantEvening int64
+	}{
+		{name: "midpoint", strategy: InitialCountMidpoint, current: count(6), wantDay: 6, wantEvening: 1},
+		{name: "current clamped to each schedule", strategy: InitialCountCurrent, current: count(3), wantDay: 4, wantEvening: 2},
+		{name: "current unknown", strategy: InitialCountCurrent, wantDay: 6, wantEvening: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app.CurrentInstances = test.current
+			policy, err := app.ToOCFPolicy(test.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, sched := range policy.Schedules.RecurringSchedule {
+				want := test.wantEvening
+				if sched.InstanceMinCount == 4 {
+					want = test.wantDay
+				}
+
+				if sched.InitialMinInstanceCount == nil || *sched.InitialMinInstanceCount != want {
+					t.Errorf("schedule %+v has initial count %v, want %d", sched, sched.InitialMinInstanceCount, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package ocfas
+
+import (
+	"strconv"
+	"time"
+)
+
+//Values of ScalingHistory.ScalingType
+const (
+	ScalingTypeDynamic  = 0
+	ScalingTypeSchedule = 1
+)
+
+//Values of ScalingHistory.Status
+const (
+	ScalingStatusSucceeded = 0
+	ScalingStatusFailed    = 1
+	ScalingStatusIgnored   = 2
+)
+
+type ScalingHistory struct {
+	AppGUID string `json:"app_id"`
+	//Nanoseconds since the epoch
+	Timestamp    int64  `json:"timestamp"`
+	ScalingType  int    `json:"scaling_type"`
+	Status       int    `json:"status"`
+	OldInstances int64  `json:"old_instances"`
+	NewInstances int64  `json:"new_instances"`
+	Reason       string `json:"reason"`
+	Message      string `json:"message"`
+	Error        string `json:"error"`
+}
+
+func (h ScalingHistory) Time() time.Time {
+	return time.Unix(0, h.Timestamp).UTC()
+}
+
+type MetricHistory struct {
+	AppGUID string `json:"app_id"`
+	//Nanoseconds since the epoch
+	Timestamp int64  `json:"timestamp"`
+	Name      string `json:"name"`
+	Unit      string `json:"unit"`
+	Value     string `json:"value"`
+}
+
+func (h MetricHistory) Time() time.Time {
+	return time.Unix(0, h.Timestamp).UTC()
+}
+
+//ScalingHistoryForAppWithGUID returns the app's scaling events between start
+// and end, oldest first.
+func (c *Client) ScalingHistoryForAppWithGUID(guid string, start, end time.Time) ([]ScalingHistory, error) {
+	ret := []ScalingHistory{}
+	err := c.listPaged("/v1/apps/"+guid+"/scaling_histories", timeRangeQuery(start, end), func() interface{} {
+		return &[]ScalingHistory{}
+	}, func(page interface{}) {
+		ret = append(ret, *(page.(*[]ScalingHistory))...)
+	})
+
+	return ret, err
+}
+
+//AggregatedMetricHistoryForAppWithGUID returns the app's metric of the given
+// type averaged across its instances, between start and end, oldest first.
+func (c *Client) AggregatedMetricHistoryForAppWithGUID(guid, metricType string, start, end time.Time) ([]MetricHistory, error) {
+	ret := []MetricHistory{}
+	err := c.listPaged("/v1/apps/"+guid+"/aggregated_metric_histories/"+metricType, timeRangeQuery(start, end), func() interface{} {
+		return &[]MetricHistory{}
+	}, func(page interface{}) {
+		ret = append(ret, *(page.(*[]MetricHistory))...)
+	})
+
+	return ret, err
+}
+
+func timeRangeQuery(start, end time.Time) map[string]string {
+	return map[string]string{
+		"start-time":      strconv.FormatInt(start.UnixNano(), 10),
+		"end-time":        strconv.FormatInt(end.UnixNano(), 10),
+		"order-direction": "asc",
+	}
+}
+
+const historyPageSize = 100
+
+//Reads every page of a history list. newPage returns a pointer to a slice to
+// decode each page's resources into, which is then passed to add.
+func (c *Client) listPaged(path string, query map[string]string, newPage func() interface{}, add func(interface{})) error {
+	for page := 1; ; page++ {
+		pageQuery := map[string]string{
+			"page":             strconv.Itoa(page),
+			"results-per-page": strconv.Itoa(historyPageSize),
+		}
+		for k, v := range query {
+			pageQuery[k] = v
+		}
+
+		req, err := c.newRequest("GET", path, pageQuery, nil)
+		if err != nil {
+			return err
+		}
+
+		resources := newPage()
+		resp := struct {
+			TotalPages int         `json:"total_pages"`
+			Resources  interface{} `json:"resources"`
+		}{Resources: resources}
+		err = c.doRequest(req, &resp)
+		if err != nil {
+			return err
+		}
+
+		add(resources)
+		if page >= resp.TotalPages {
+			return nil
+		}
+	}
+}
@@ -7,8 +7,12 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/trace"
 )
 
 type Policy struct {
@@ -82,7 +86,6 @@ type Client struct {
 	client *http.Client
 	host   string
 	token  string
-	trace  io.Writer
 }
 
 func NewClient(host, token string) *Client {
@@ -93,8 +96,8 @@ func NewClient(host, token string) *Client {
 	}
 }
 
-func (c *Client) TraceTo(writer io.Writer) {
-	c.trace = writer
+func (c *Client) TraceTo(tracer *trace.Tracer) {
+	c.client.Transport = tracer.Wrap(c.client.Transport)
 }
 
 func (c *Client) newRequest(method, path string, query map[string]string, body interface{}) (*http.Request, error) {
@@ -133,40 +136,24 @@ func (c *Client) newRequest(method, path string, query map[string]string, body i
 }
 
 func (c *Client) doRequest(request *http.Request, out interface{}) error {
-	if c.trace != nil {
-		reqDump, err := httputil.DumpRequestOut(request, true)
-		if err != nil {
-			return fmt.Errorf("Error dumping request: %s", err)
-		}
-
-		_, err = c.trace.Write(append(reqDump, []byte("\n  ***\n\n")...))
-		if err != nil {
-			return fmt.Errorf("Error writing request dump: %s", err)
-		}
-	}
-
+	start := time.Now()
 	resp, err := c.client.Do(request)
 	if err != nil {
 		return err
 	}
 
+	logger.WithFields(logger.Fields{
+		logger.FieldHTTPMethod: request.Method,
+		logger.FieldHTTPURL:    request.URL.String(),
+		logger.FieldHTTPStatus: resp.StatusCode,
+		logger.FieldDuration:   time.Since(start),
+	}).Debugf("HTTP request complete")
+
 	defer func() {
 		_, _ = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 	}()
 
-	if c.trace != nil {
-		respDump, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			return fmt.Errorf("Error dumping response: %s", err)
-		}
-
-		_, err = c.trace.Write(append(respDump, []byte("\n--------------------\n\n")...))
-		if err != nil {
-			return fmt.Errorf("Error writing response dump: %s", err)
-		}
-	}
-
 	if resp.StatusCode/100 != 2 {
 		return fmt.Errorf("Non-2xx response code: %s", resp.Status)
 	}
@@ -200,3 +187,126 @@ func (c *Client) CreatePolicyForAppWithGUID(guid string, policy *Policy) error {
 
 	return c.doRequest(req, nil)
 }
+
+var timeOfDayRegex = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+var adjustmentRegex = regexp.MustCompile(`^[-+][1-9][0-9]*%?$`)
+
+//Validate checks the policy against the constraints the OCF autoscaler API
+// enforces, so that problems are found before anything is applied.
+func (p *Policy) Validate() error {
+	if p.InstanceMinCount < 1 {
+		return fmt.Errorf("instance_min_count must be at least 1, got %d", p.InstanceMinCount)
+	}
+
+	if p.InstanceMaxCount < p.InstanceMinCount {
+		return fmt.Errorf("instance_max_count (%d) must not be less than instance_min_count (%d)", p.InstanceMaxCount, p.InstanceMinCount)
+	}
+
+	for i, rule := range p.ScalingRules {
+		err := rule.validate()
+		if err != nil {
+			return fmt.Errorf("scaling_rules[%d]: %s", i, err)
+		}
+	}
+
+	if p.Schedules == nil {
+		return nil
+	}
+
+	if p.Schedules.Timezone == "" {
+		return fmt.Errorf("schedules must have a timezone")
+	}
+
+	for i, sched := range p.Schedules.RecurringSchedule {
+		err := sched.validate()
+		if err != nil {
+			return fmt.Errorf("recurring_schedule[%d]: %s", i, err)
+		}
+	}
+
+	for i, sched := range p.Schedules.SpecificDate {
+		err := validateInstanceCounts(sched.InstanceMinCount, sched.InstanceMaxCount, sched.InitialMinInstanceCount)
+		if err != nil {
+			return fmt.Errorf("specific_date[%d]: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (s ScalingRule) validate() error {
+	if s.MetricType == "" {
+		return fmt.Errorf("metric_type must be set")
+	}
+
+	switch s.Operator {
+	case OperatorLessThan, OperatorLessThanOrEqualTo, OperatorGreaterThan, OperatorGreaterThanOrEqualTo:
+	default:
+		return fmt.Errorf("unknown operator `%s'", s.Operator)
+	}
+
+	if !adjustmentRegex.MatchString(s.Adjustment) {
+		return fmt.Errorf("adjustment `%s' is not of the form +N, -N, +N%%, or -N%%", s.Adjustment)
+	}
+
+	if s.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative, got %d", s.Threshold)
+	}
+
+	if (s.MetricType == MetricTypeCPUUtil || s.MetricType == MetricTypeMemoryUtil) && s.Threshold > 100 {
+		return fmt.Errorf("threshold for %s is a percentage and must not exceed 100, got %d", s.MetricType, s.Threshold)
+	}
+
+	if s.CooldownSecs != 0 && (s.CooldownSecs < 60 || s.CooldownSecs > 3600) {
+		return fmt.Errorf("cool_down_secs must be between 60 and 3600, got %d", s.CooldownSecs)
+	}
+
+	if s.BreachDurationSecs != 0 && (s.BreachDurationSecs < 60 || s.BreachDurationSecs > 3600) {
+		return fmt.Errorf("breach_duration_secs must be between 60 and 3600, got %d", s.BreachDurationSecs)
+	}
+
+	return nil
+}
+
+func (r RecurringSchedule) validate() error {
+	if !timeOfDayRegex.MatchString(r.StartTime) {
+		return fmt.Errorf("start_time `%s' is not of the form HH:MM", r.StartTime)
+	}
+
+	if !timeOfDayRegex.MatchString(r.EndTime) {
+		return fmt.Errorf("end_time `%s' is not of the form HH:MM", r.EndTime)
+	}
+
+	if r.EndTime <= r.StartTime {
+		return fmt.Errorf("end_time (%s) must be after start_time (%s)", r.EndTime, r.StartTime)
+	}
+
+	if len(r.DaysOfWeek) == 0 {
+		return fmt.Errorf("days_of_week must not be empty")
+	}
+
+	for _, day := range r.DaysOfWeek {
+		if day < 1 || day > 7 {
+			return fmt.Errorf("days_of_week must be between 1 and 7, got %d", day)
+		}
+	}
+
+	return validateInstanceCounts(r.InstanceMinCount, r.InstanceMaxCount, r.InitialMinInstanceCount)
+}
+
+func validateInstanceCounts(min, max int64, initial *int64) error {
+	if min < 1 {
+		return fmt.Errorf("instance_min_count must be at least 1, got %d", min)
+	}
+
+	if max < min {
+		return fmt.Errorf("instance_max_count (%d) must not be less than instance_min_count (%d)", max, min)
+	}
+
+	if initial != nil && (*initial < min || *initial > max) {
+		return fmt.Errorf("initial_min_instance_count (%d) must be between instance_min_count (%d) and instance_max_count (%d)",
+			*initial, min, max)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+//overridesFile is keyed by app GUID, `org/space/app' name path, or bare app
+// name, in that order of precedence. A bare app name applies to every app with
+// that name.
+type overridesFile struct {
+	Apps map[string]policyOverride `json:"apps"`
+}
+
+//Exactly one of MergePatch and Policy must be set. MergePatch is an RFC 7386
+// JSON merge patch applied to the generated policy. Policy replaces the
+// generated policy outright; a null policy disables autoscaling for the app.
+type policyOverride struct {
+	MergePatch json.RawMessage `json:"merge_patch,omitempty"`
+	Policy     json.RawMessage `json:"policy,omitempty"`
+}
+
+type overrides struct {
+	entries map[string]policyOverride
+	used    map[string]bool
+}
+
+func loadOverrides(f *os.File) (*overrides, error) {
+	defer f.Close()
+
+	format := detectInputFormat(formatAuto, f.Name())
+	if format == formatNDJSON {
+		return nil, fmt.Errorf("Overrides file must be JSON or YAML")
+	}
+
+	doc := overridesFile{}
+	err := decodeDocument(f, format, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading overrides file: %s", err)
+	}
+
+	for key, override := range doc.Apps {
+		if (override.MergePatch == nil) == (override.Policy == nil) {
+			return nil, fmt.Errorf("Override for `%s' must have exactly one of merge_patch or policy", key)
+		}
+	}
+
+	return &overrides{entries: doc.Apps, used: map[string]bool{}}, nil
+}
+
+//Apply returns the app with its override applied, if it has one. The
+// resulting policy is validated, since an override can produce anything.
+func (o *overrides) Apply(space models.ConvertedSpace, app models.ConvertedPolicyToApp) (models.ConvertedPolicyToApp, error) {
+	key, override, found := o.lookup(space, app)
+	if !found {
+		return app, nil
+	}
+
+	o.used[key] = true
+	mode := models.OverrideModeReplace
+	patched := override.Policy
+	if override.MergePatch != nil {
+		mode = models.OverrideModeMergePatch
+		original, err := json.Marshal(app.Policy)
+		if err != nil {
+			return app, err
+		}
+
+		patched, err = applyMergePatch(original, override.MergePatch)
+		if err != nil {
+			return app, fmt.Errorf("Error applying merge patch `%s' to app with GUID `%s': %s", key, app.GUID, err)
+		}
+	}
+
+	var policy *ocfas.Policy
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&policy)
+	if err != nil {
+		return app, fmt.Errorf("Override `%s' for app with GUID `%s' does not produce a valid policy: %s", key, app.GUID, err)
+	}
+
+	if policy != nil {
+		err = policy.Validate()
+		if err != nil {
+			return app, fmt.Errorf("Override `%s' for app with GUID `%s' does not produce a valid policy: %s", key, app.GUID, err)
+		}
+	}
+
+	app.Policy = policy
+	app.Override = &models.AppliedOverride{Key: key, Mode: mode}
+	logger.WithFields(logger.Fields{
+		logger.FieldStage:     "overrides",
+		logger.FieldOrgName:   space.OrgName,
+		logger.FieldSpaceName: space.Name,
+		logger.FieldAppName:   app.Name,
+		logger.FieldAppGUID:   app.GUID,
+		"override":            key,
+		"mode":                mode,
+	}).Infof("Applied policy override")
+
+	return app, nil
+}
+
+func (o *overrides) lookup(space models.ConvertedSpace, app models.ConvertedPolicyToApp) (string, policyOverride, bool) {
+	keys := []string{app.GUID}
+	if app.Name != "" {
+		if space.OrgName != "" && space.Name != "" {
+			keys = append(keys, space.OrgName+"/"+space.Name+"/"+app.Name)
+		}
+		keys = append(keys, app.Name)
+	}
+
+	for _, key := range keys {
+		if override, found := o.entries[key]; found {
+			return key, override, true
+		}
+	}
+
+	return "", policyOverride{}, false
+}
+
+//Unused returns the keys which did not match any app, which usually means a
+// typo or an app which has since been deleted.
+func (o *overrides) Unused() []string {
+	ret := []string{}
+	for key := range o.entries {
+		if !o.used[key] {
+			ret = append(ret, key)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+func applyMergePatch(target, patch []byte) ([]byte, error) {
+	var targetDoc, patchDoc interface{}
+	err := json.Unmarshal(target, &targetDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(patch, &patchDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(targetDoc, patchDoc))
+}
+
+//As described in RFC 7386
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, isObj := patch.(map[string]interface{})
+	if !isObj {
+		return patch
+	}
+
+	targetObj, isObj := target.(map[string]interface{})
+	if !isObj {
+		targetObj = map[string]interface{}{}
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+
+	return targetObj
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+func normalizeJSON(t *testing.T, doc string) string {
+	var v interface{}
+	err := json.Unmarshal([]byte(doc), &v)
+	if err != nil {
+		t.Fatalf("invalid JSON `%s': %s", doc, err)
+	}
+
+	ret, _ := json.Marshal(v)
+	return string(ret)
+}
+
+//The cases are the examples from RFC 7386 Appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target+" "+test.patch, func(t *testing.T) {
+			got, err := applyMergePatch([]byte(test.target), []byte(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != normalizeJSON(t, test.want) {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOverridesApply(t *testing.T) {
+	space := models.ConvertedSpace{GUID: "space-1", OrgName: "org", Name: "space"}
+	app := models.ConvertedPolicyToApp{
+		GUID: "app-1",
+		Name: "web",
+		Policy: &ocfas.Policy{
+			InstanceMinCount: 1,
+			InstanceMaxCount: 4,
+			ScalingRules: []ocfas.ScalingRule{
+				{MetricType: ocfas.MetricTypeCPUUtil, Operator: ">=", Threshold: 80, Adjustment: "+1"},
+			},
+			Schedules: &ocfas.Schedules{Timezone: ocfas.TimezoneUTC},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		//Checks the policy after the override, which is nil if it disables
+		// autoscaling
+		check    func(*ocfas.Policy) bool
+		wantMode string
+	}{
+		{
+			name: "merge patch removes schedules",
+			file: `{"apps": {"web": {"merge_patch": {"instance_max_count": 8, "schedules": null}}}}`,
+			check: func(p *ocfas.Policy) bool {
+				return p.InstanceMaxCount == 8 && p.Schedules == nil && len(p.ScalingRules) == 1
+			},
+			wantMode: models.OverrideModeMergePatch,
+		},
+		{
+			name:     "null policy disables autoscaling",
+			file:     `{"apps": {"org/space/web": {"policy": null}}}`,
+			check:    func(p *ocfas.Policy) bool { return p == nil },
+			wantMode: models.OverrideModeReplace,
+		},
+		{
+			name:     "GUID takes precedence over name",
+			file:     `{"apps": {"web": {"policy": null}, "app-1": {"merge_patch": {"instance_min_count": 2}}}}`,
+			check:    func(p *ocfas.Policy) bool { return p != nil && p.InstanceMinCount == 2 },
+			wantMode: models.OverrideModeMergePatch,
+		},
+		{
+			name:    "merge patch producing an invalid policy",
+			file:    `{"apps": {"web": {"merge_patch": {"instance_min_count": 10}}}}`,
+			wantErr: "does not produce a valid policy",
+		},
+		{
+			name:    "merge patch adding an unknown field",
+			file:    `{"apps": {"web": {"merge_patch": {"max": 10}}}}`,
+			wantErr: "unknown field",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "as2as-*.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+
+			_, err = f.WriteString(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Seek(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o, err := loadOverrides(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := o.Apply(space, app)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !test.check(got.Policy) {
+				policy, _ := json.Marshal(got.Policy)
+				t.Errorf("unexpected policy %s", policy)
+			}
+			if got.Override == nil || got.Override.Mode != test.wantMode {
+				t.Errorf("got override %+v, want mode %s", got.Override, test.wantMode)
+			}
+			if app.Policy.Schedules == nil || app.Policy.InstanceMaxCount != 4 {
+				t.Errorf("the input app was modified")
+			}
+		})
+	}
+}
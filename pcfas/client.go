@@ -7,32 +7,60 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"strconv"
+	"time"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/trace"
 )
 
 type Client struct {
 	client *http.Client
 	host   string
 	token  string
-	trace  io.Writer
+
+	pageSize      int
+	parallelPages int
 }
 
+//Defaults for SetPageSize and SetParallelPages
+const (
+	DefaultPageSize      = 100
+	DefaultParallelPages = 1
+)
+
 func NewClient(host, token string) *Client {
 	return &Client{
-		host:   host,
-		token:  token,
-		client: &http.Client{},
+		host:          host,
+		token:         token,
+		client:        &http.Client{},
+		pageSize:      DefaultPageSize,
+		parallelPages: DefaultParallelPages,
 	}
 }
 
-func (p *Client) TraceTo(writer io.Writer) {
-	p.trace = writer
+//SetPageSize sets how many resources to ask for per page of a list.
+func (p *Client) SetPageSize(size int) {
+	if size > 0 {
+		p.pageSize = size
+	}
+}
+
+//SetParallelPages sets how many pages of a list to fetch at once after the
+// first.
+func (p *Client) SetParallelPages(n int) {
+	if n > 0 {
+		p.parallelPages = n
+	}
+}
+
+func (p *Client) TraceTo(tracer *trace.Tracer) {
+	p.client.Transport = tracer.Wrap(p.client.Transport)
 }
 
 type Pagination struct {
-	TotalPages int `json:"total_pages"`
+	TotalPages   int `json:"total_pages"`
+	TotalResults int `json:"total_results"`
 }
 
 func (p *Client) newRequest(method, path string, query map[string]string, body interface{}) (*http.Request, error) {
@@ -41,14 +69,16 @@ func (p *Client) newRequest(method, path string, query map[string]string, body i
 		values.Set(k, v)
 	}
 
-	var bodyReader io.ReadWriter
+	var bodyReader io.Reader
 	if body != nil {
-		body = bytes.Buffer{}
-		jEncoder := json.NewEncoder(bodyReader)
+		buf := &bytes.Buffer{}
+		jEncoder := json.NewEncoder(buf)
 		err := jEncoder.Encode(body)
 		if err != nil {
 			return nil, err
 		}
+
+		bodyReader = buf
 	}
 
 	u := url.URL{
@@ -64,45 +94,32 @@ func (p *Client) newRequest(method, path string, query map[string]string, body i
 	}
 	req.Header.Set("Authorization", "Bearer "+p.token)
 	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	return req, nil
 }
 
 func (p *Client) doRequest(request *http.Request, out interface{}) error {
-	if p.trace != nil {
-		reqDump, err := httputil.DumpRequestOut(request, true)
-		if err != nil {
-			return fmt.Errorf("Error dumping request: %s", err)
-		}
-
-		_, err = p.trace.Write(append(reqDump, []byte("\n  ***\n\n")...))
-		if err != nil {
-			return fmt.Errorf("Error writing request dump: %s", err)
-		}
-	}
-
+	start := time.Now()
 	resp, err := p.client.Do(request)
 	if err != nil {
 		return err
 	}
 
+	logger.WithFields(logger.Fields{
+		logger.FieldHTTPMethod: request.Method,
+		logger.FieldHTTPURL:    request.URL.String(),
+		logger.FieldHTTPStatus: resp.StatusCode,
+		logger.FieldDuration:   time.Since(start),
+	}).Debugf("HTTP request complete")
+
 	defer func() {
 		_, _ = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 	}()
 
-	if p.trace != nil {
-		respDump, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			return fmt.Errorf("Error dumping response: %s", err)
-		}
-
-		_, err = p.trace.Write(append(respDump, []byte("\n--------------------\n\n")...))
-		if err != nil {
-			return fmt.Errorf("Error writing response dump: %s", err)
-		}
-	}
-
 	if resp.StatusCode/100 != 2 {
 		return fmt.Errorf("Non-2xx response code: %s", resp.Status)
 	}
@@ -132,44 +149,19 @@ type InstanceLimits struct {
 }
 
 func (p *Client) AppsForSpaceWithGUID(guid string) ([]App, error) {
-	type AppsResponse struct {
-		Pagination Pagination `json:"pagination"`
-		Resources  []App      `json:"resources"`
-	}
-
-	currentPage := 1
 	resources := []App{}
-	for {
-		responseBodyObj := AppsResponse{}
-		req, err := p.newRequest(
-			"GET",
-			"/api/v2/apps",
-			map[string]string{
-				"space_guid": guid,
-				"page":       strconv.Itoa(currentPage),
-			},
-			nil,
-		)
+	err := p.Paginate("/api/v2/apps", map[string]string{"space_guid": guid}, func(raw json.RawMessage) error {
+		app := App{}
+		err := json.Unmarshal(raw, &app)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		err = p.doRequest(req, &responseBodyObj)
-		if err != nil {
-			return nil, err
-		}
-
-		resources = append(resources, responseBodyObj.Resources...)
-
-		totalPages := responseBodyObj.Pagination.TotalPages
-		if totalPages >= currentPage {
-			break
-		}
-
-		currentPage++
-	}
+		resources = append(resources, app)
+		return nil
+	})
 
-	return resources, nil
+	return resources, err
 }
 
 type Rule struct {
@@ -188,43 +180,19 @@ type RuleThreshold struct {
 }
 
 func (p *Client) RulesForAppWithGUID(guid string) ([]Rule, error) {
-	type RulesResponse struct {
-		Pagination Pagination `json:"pagination"`
-		Resources  []Rule     `json:"resources"`
-	}
-
-	currentPage := 1
 	resources := []Rule{}
-	for {
-		responseBodyObj := RulesResponse{}
-		req, err := p.newRequest(
-			"GET",
-			"/api/v2/apps/"+guid+"/rules",
-			map[string]string{
-				"page": strconv.Itoa(currentPage),
-			},
-			nil,
-		)
+	err := p.Paginate("/api/v2/apps/"+guid+"/rules", nil, func(raw json.RawMessage) error {
+		rule := Rule{}
+		err := json.Unmarshal(raw, &rule)
 		if err != nil {
-			return nil, err
-		}
-
-		err = p.doRequest(req, &responseBodyObj)
-		if err != nil {
-			return nil, err
+			return err
 		}
 
-		resources = append(resources, responseBodyObj.Resources...)
-
-		totalPages := responseBodyObj.Pagination.TotalPages
-		if totalPages >= currentPage {
-			break
-		}
-
-		currentPage++
-	}
+		resources = append(resources, rule)
+		return nil
+	})
 
-	return resources, nil
+	return resources, err
 }
 
 type ScheduledLimitChange struct {
@@ -236,41 +204,94 @@ type ScheduledLimitChange struct {
 }
 
 func (p *Client) ScheduledLimitChangesForAppWithGUID(guid string) ([]ScheduledLimitChange, error) {
-	type ScheduledLimitChangeResponse struct {
-		Pagination Pagination             `json:"pagination"`
-		Resources  []ScheduledLimitChange `json:"resources"`
-	}
-
-	currentPage := 1
 	resources := []ScheduledLimitChange{}
-	for {
-		responseBodyObj := ScheduledLimitChangeResponse{}
-		req, err := p.newRequest(
-			"GET",
-			"/api/v2/apps/"+guid+"/scheduled_limit_changes",
-			map[string]string{
-				"page": strconv.Itoa(currentPage),
-			},
-			nil,
-		)
+	err := p.Paginate("/api/v2/apps/"+guid+"/scheduled_limit_changes", nil, func(raw json.RawMessage) error {
+		change := ScheduledLimitChange{}
+		err := json.Unmarshal(raw, &change)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		err = p.doRequest(req, &responseBodyObj)
+		resources = append(resources, change)
+		return nil
+	})
+
+	return resources, err
+}
+
+//Event is a change in an app's instance count made by the PCF autoscaler.
+type Event struct {
+	GUID              string `json:"guid"`
+	Timestamp         string `json:"timestamp"`
+	PreviousInstances int64  `json:"previous_instance_count"`
+	NewInstances      int64  `json:"new_instance_count"`
+	RuleGUID          string `json:"rule_guid"`
+	Reason            string `json:"reason"`
+}
+
+//EventsForAppWithGUID returns the app's scaling events at or after since.
+// The App Autoscaler API lists an app's events at GET /api/v2/apps/:guid/events
+// with only the page and per_page parameters, so they can't be filtered by
+// time on the server, and the order they come back in isn't part of the
+// contract. The order is worked out from the timestamps instead: once events
+// are known to come newest first, paging stops at the first one before since.
+func (p *Client) EventsForAppWithGUID(guid string, since time.Time) ([]Event, error) {
+	resources := []Event{}
+	var previous time.Time
+	newestFirst, oldestFirst := false, false
+	err := p.Paginate("/api/v2/apps/"+guid+"/events", nil, func(raw json.RawMessage) error {
+		event := Event{}
+		err := json.Unmarshal(raw, &event)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		resources = append(resources, responseBodyObj.Resources...)
+		timestamp, err := time.Parse(time.RFC3339, event.Timestamp)
+		if err != nil {
+			return fmt.Errorf("Error parsing timestamp of event `%s': %s", event.GUID, err)
+		}
+
+		if !previous.IsZero() {
+			newestFirst = newestFirst || timestamp.Before(previous)
+			oldestFirst = oldestFirst || timestamp.After(previous)
+		}
+		previous = timestamp
 
-		totalPages := responseBodyObj.Pagination.TotalPages
-		if totalPages >= currentPage {
-			break
+		if !timestamp.Before(since) {
+			resources = append(resources, event)
+		} else if newestFirst && !oldestFirst {
+			return errStopPaging
 		}
+		return nil
+	})
+
+	return resources, err
+}
+
+//UpdateApp replaces the app's enabled flag and instance limits.
+func (p *Client) UpdateApp(app App) error {
+	req, err := p.newRequest("PUT", "/api/v2/apps/"+app.GUID, nil, app)
+	if err != nil {
+		return err
+	}
 
-		currentPage++
+	return p.doRequest(req, nil)
+}
+
+func (p *Client) DeleteRuleForAppWithGUID(appGUID, ruleGUID string) error {
+	req, err := p.newRequest("DELETE", "/api/v2/apps/"+appGUID+"/rules/"+ruleGUID, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return p.doRequest(req, nil)
+}
+
+func (p *Client) DeleteScheduledLimitChangeForAppWithGUID(appGUID, changeGUID string) error {
+	req, err := p.newRequest("DELETE", "/api/v2/apps/"+appGUID+"/scheduled_limit_changes/"+changeGUID, nil, nil)
+	if err != nil {
+		return err
 	}
 
-	return resources, nil
+	return p.doRequest(req, nil)
 }
@@ -0,0 +1,123 @@
+package pcfas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//eventsServer serves events with the given timestamps, in the given order,
+// and records which pages were requested.
+type eventsServer struct {
+	timestamps []string
+	requested  []int
+}
+
+func (s *eventsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	s.requested = append(s.requested, number)
+
+	ret := page{}
+	ret.Pagination.TotalResults = len(s.timestamps)
+	ret.Pagination.TotalPages = (len(s.timestamps) + perPage - 1) / perPage
+	for i := (number - 1) * perPage; i < number*perPage && i < len(s.timestamps); i++ {
+		raw, _ := json.Marshal(Event{GUID: "event-" + strconv.Itoa(i), Timestamp: s.timestamps[i]})
+		ret.Resources = append(ret.Resources, raw)
+	}
+
+	json.NewEncoder(w).Encode(ret)
+}
+
+func TestEventsForAppWithGUID(t *testing.T) {
+	since := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		timestamps []string
+		want       []string
+		wantPages  []int
+		wantErr    string
+	}{
+		{
+			name: "newest first stops at the first older event",
+			timestamps: []string{
+				"2021-06-03T00:00:00Z", "2021-06-02T00:00:00Z", "2021-06-01T00:00:00Z",
+				"2021-05-31T00:00:00Z", "2021-05-30T00:00:00Z", "2021-05-29T00:00:00Z",
+				"2021-05-28T00:00:00Z", "2021-05-27T00:00:00Z",
+			},
+			want:      []string{"event-0", "event-1", "event-2"},
+			wantPages: []int{1, 2},
+		},
+		{
+			name: "oldest first reads every page",
+			timestamps: []string{
+				"2021-05-27T00:00:00Z", "2021-05-28T00:00:00Z", "2021-05-29T00:00:00Z",
+				"2021-05-30T00:00:00Z", "2021-05-31T00:00:00Z", "2021-06-01T00:00:00Z",
+				"2021-06-02T00:00:00Z", "2021-06-03T00:00:00Z",
+			},
+			want:      []string{"event-5", "event-6", "event-7"},
+			wantPages: []int{1, 2, 3},
+		},
+		{
+			name:       "a single old event can't show the order",
+			timestamps: []string{"2021-05-31T00:00:00Z", "2021-06-02T00:00:00Z"},
+			want:       []string{"event-1"},
+			wantPages:  []int{1},
+		},
+		{
+			name: "all events before since",
+			timestamps: []string{
+				"2021-05-31T00:00:00Z", "2021-05-30T00:00:00Z", "2021-05-29T00:00:00Z",
+				"2021-05-28T00:00:00Z",
+			},
+			want:      []string{},
+			wantPages: []int{1},
+		},
+		{
+			name:       "no events",
+			timestamps: []string{},
+			want:       []string{},
+			wantPages:  []int{1},
+		},
+		{
+			name:       "malformed timestamp",
+			timestamps: []string{"2021-06-02 00:00"},
+			wantErr:    "Error parsing timestamp of event `event-0'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &eventsServer{timestamps: test.timestamps}
+			client := NewClient("pcfas.example.com", "token")
+			client.client.Transport = handlerTransport{server}
+			client.SetPageSize(3)
+
+			events, err := client.EventsForAppWithGUID("app-1", since)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, event := range events {
+				got = append(got, event.GUID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got events %v, want %v", got, test.want)
+			}
+			if fmt.Sprint(server.requested) != fmt.Sprint(test.wantPages) {
+				t.Errorf("got pages %v, want %v", server.requested, test.wantPages)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package pcfas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+//errStopPaging can be returned by a Paginate callback to stop reading
+// without an error, such as once the rest of an ordered list isn't wanted.
+var errStopPaging = errors.New("stop paging")
+
+type page struct {
+	Pagination Pagination        `json:"pagination"`
+	Resources  []json.RawMessage `json:"resources"`
+}
+
+//Paginate calls fn with each resource of the list at path, in order. The
+// first page says how many more there are, and those are fetched up to
+// parallelPages at a time. Fails if the number of resources doesn't match
+// the total the API reported, so that a list is never silently cut short.
+func (p *Client) Paginate(path string, query map[string]string, fn func(json.RawMessage) error) error {
+	err := p.paginate(path, query, fn)
+	if err == errStopPaging {
+		return nil
+	}
+
+	return err
+}
+
+func (p *Client) paginate(path string, query map[string]string, fn func(json.RawMessage) error) error {
+	first, err := p.getPage(path, query, 1)
+	if err != nil {
+		return err
+	}
+
+	seen := 0
+	for _, resource := range first.Resources {
+		seen++
+		err = fn(resource)
+		if err != nil {
+			return err
+		}
+	}
+
+	for start := 2; start <= first.Pagination.TotalPages; start += p.parallelPages {
+		end := start + p.parallelPages - 1
+		if end > first.Pagination.TotalPages {
+			end = first.Pagination.TotalPages
+		}
+
+		pages, err := p.getPages(path, query, start, end)
+		if err != nil {
+			return err
+		}
+
+		for _, pg := range pages {
+			for _, resource := range pg.Resources {
+				seen++
+				err = fn(resource)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if first.Pagination.TotalResults != 0 && seen != first.Pagination.TotalResults {
+		return fmt.Errorf("Got %d resources from `%s' but the API reported %d", seen, path, first.Pagination.TotalResults)
+	}
+
+	return nil
+}
+
+//Fetches pages start through end at once, returned in order.
+func (p *Client) getPages(path string, query map[string]string, start, end int) ([]page, error) {
+	pages := make([]page, end-start+1)
+	errs := make([]error, len(pages))
+	wait := sync.WaitGroup{}
+	wait.Add(len(pages))
+	for i := range pages {
+		go func(i int) {
+			defer wait.Done()
+			pages[i], errs[i] = p.getPage(path, query, start+i)
+		}(i)
+	}
+	wait.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pages, nil
+}
+
+func (p *Client) getPage(path string, query map[string]string, number int) (page, error) {
+	pageQuery := map[string]string{}
+	for k, v := range query {
+		pageQuery[k] = v
+	}
+	pageQuery["page"] = strconv.Itoa(number)
+	pageQuery["per_page"] = strconv.Itoa(p.pageSize)
+
+	ret := page{}
+	req, err := p.newRequest("GET", path, pageQuery, nil)
+	if err != nil {
+		return ret, err
+	}
+
+	err = p.doRequest(req, &ret)
+	return ret, err
+}
@@ -0,0 +1,169 @@
+package pcfas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (h handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+//pagedServer serves resources 1 through len(resources) in pages, reporting
+// totalResults as the total. It records the most pages in flight at once.
+type pagedServer struct {
+	resources    []int
+	totalResults int
+	//Pages which fail
+	failPages map[int]bool
+
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+	requested   []int
+}
+
+func (s *pagedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+
+	s.lock.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.requested = append(s.requested, number)
+	s.lock.Unlock()
+
+	//Give the other pages of a batch time to be requested
+	time.Sleep(10 * time.Millisecond)
+
+	s.lock.Lock()
+	s.inFlight--
+	s.lock.Unlock()
+
+	if s.failPages[number] {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	ret := page{}
+	ret.Pagination.TotalResults = s.totalResults
+	ret.Pagination.TotalPages = (len(s.resources) + perPage - 1) / perPage
+	for i := (number - 1) * perPage; i < number*perPage && i < len(s.resources); i++ {
+		ret.Resources = append(ret.Resources, json.RawMessage(strconv.Itoa(s.resources[i])))
+	}
+
+	json.NewEncoder(w).Encode(ret)
+}
+
+func TestPaginate(t *testing.T) {
+	seven := []int{1, 2, 3, 4, 5, 6, 7}
+	tests := []struct {
+		name          string
+		resources     []int
+		totalResults  int
+		parallelPages int
+		failPages     map[int]bool
+		wantErr       string
+		//Zero to skip the check
+		wantMaxInFlight int
+	}{
+		{name: "sequential", resources: seven, totalResults: 7, parallelPages: 1, wantMaxInFlight: 1},
+		{name: "two pages at a time", resources: seven, totalResults: 7, parallelPages: 2, wantMaxInFlight: 2},
+		{name: "more parallel pages than pages", resources: seven, totalResults: 7, parallelPages: 10, wantMaxInFlight: 2},
+		{name: "one page", resources: []int{1}, totalResults: 1, parallelPages: 3, wantMaxInFlight: 1},
+		{name: "empty", resources: []int{}, totalResults: 0, parallelPages: 3},
+		{
+			name:          "fewer resources than reported",
+			resources:     seven,
+			totalResults:  8,
+			parallelPages: 2,
+			wantErr:       "Got 7 resources from `/api/v2/things' but the API reported 8",
+		},
+		{
+			name:          "more resources than reported",
+			resources:     seven,
+			totalResults:  6,
+			parallelPages: 1,
+			wantErr:       "Got 7 resources from `/api/v2/things' but the API reported 6",
+		},
+		{
+			name:          "failed page in a parallel batch",
+			resources:     seven,
+			totalResults:  7,
+			parallelPages: 2,
+			failPages:     map[int]bool{3: true},
+			wantErr:       "502",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &pagedServer{resources: test.resources, totalResults: test.totalResults, failPages: test.failPages}
+			client := NewClient("pcfas.example.com", "token")
+			client.client.Transport = handlerTransport{server}
+			client.SetPageSize(3)
+			client.SetParallelPages(test.parallelPages)
+
+			got := []string{}
+			err := client.Paginate("/api/v2/things", nil, func(resource json.RawMessage) error {
+				got = append(got, string(resource))
+				return nil
+			})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{}
+			for _, resource := range test.resources {
+				want = append(want, strconv.Itoa(resource))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got resources %v, want %v in order", got, want)
+			}
+
+			if test.wantMaxInFlight != 0 && server.maxInFlight != test.wantMaxInFlight {
+				t.Errorf("got at most %d pages in flight, want %d (requested %v)", server.maxInFlight, test.wantMaxInFlight, server.requested)
+			}
+		})
+	}
+}
+
+func TestPaginateStopsOnCallbackError(t *testing.T) {
+	server := &pagedServer{resources: []int{1, 2, 3, 4, 5, 6, 7}, totalResults: 7}
+	client := NewClient("pcfas.example.com", "token")
+	client.client.Transport = handlerTransport{server}
+	client.SetPageSize(3)
+
+	calls := 0
+	err := client.Paginate("/api/v2/things", nil, func(json.RawMessage) error {
+		calls++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || err.Error() != "stop" {
+		t.Fatalf("got error %v, want the callback's", err)
+	}
+	if calls != 1 || len(server.requested) != 1 {
+		t.Errorf("got %d calls and pages %v after the callback failed, want 1 and [1]", calls, server.requested)
+	}
+}
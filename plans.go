@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+//planMappingFile picks service plans for new service instances by org or
+// space. Space entries win over org entries, which win over --service-plan.
+type planMappingFile struct {
+	//org name -> plan name
+	Orgs map[string]string `json:"orgs"`
+	//`org/space' name path or space GUID -> plan name
+	Spaces map[string]string `json:"spaces"`
+}
+
+//planSelector decides which of the broker's plans a new service instance in
+// a space is created with, and checks that the plan is visible to the org the
+// space is in. It is safe to use from multiple workers.
+type planSelector struct {
+	services    serviceAPI
+	byName      map[string][]cfclient.ServicePlan
+	byGUID      map[string]cfclient.ServicePlan
+	defaultPlan string
+	mapping     planMappingFile
+
+	lock sync.Mutex
+	//space GUID -> plan, for spaces PlanFor has already resolved
+	spacePlans map[string]cfclient.ServicePlan
+	//space GUID -> org GUID
+	spaceOrgs map[string]string
+	//plan GUID + "/" + org GUID -> visible
+	visible map[string]bool
+}
+
+//defaultPlan may be empty if the broker only has one plan, or if a mapping
+// file is given. mappingFile may be nil.
+func newPlanSelector(services serviceAPI, plans []cfclient.ServicePlan, defaultPlan string, mappingFile *os.File) (*planSelector, error) {
+	ret := &planSelector{
+		services:    services,
+		byName:      map[string][]cfclient.ServicePlan{},
+		byGUID:      map[string]cfclient.ServicePlan{},
+		defaultPlan: defaultPlan,
+		spacePlans:  map[string]cfclient.ServicePlan{},
+		spaceOrgs:   map[string]string{},
+		visible:     map[string]bool{},
+	}
+
+	for _, plan := range plans {
+		ret.byName[plan.Name] = append(ret.byName[plan.Name], plan)
+		ret.byGUID[plan.Guid] = plan
+	}
+
+	if mappingFile != nil {
+		defer mappingFile.Close()
+		format := detectInputFormat(formatAuto, mappingFile.Name())
+		if format == formatNDJSON {
+			return nil, fmt.Errorf("Service plan mapping file must be JSON or YAML")
+		}
+
+		err := decodeDocument(mappingFile, format, &ret.mapping)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading service plan mapping file: %s", err)
+		}
+	}
+
+	if ret.defaultPlan == "" && len(plans) == 1 {
+		ret.defaultPlan = plans[0].Name
+	}
+
+	if ret.defaultPlan == "" && mappingFile == nil {
+		return nil, fmt.Errorf("Service broker has %d plans (%s); choose one with --service-plan",
+			len(plans), strings.Join(ret.planNames(), ", "))
+	}
+
+	//Catch typos before anything is created
+	names := []string{}
+	if ret.defaultPlan != "" {
+		names = append(names, ret.defaultPlan)
+	}
+	for _, name := range ret.mapping.Orgs {
+		names = append(names, name)
+	}
+	for _, name := range ret.mapping.Spaces {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		_, err := ret.planNamed(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (p *planSelector) planNames() []string {
+	ret := []string{}
+	for name := range p.byName {
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+func (p *planSelector) planNamed(name string) (cfclient.ServicePlan, error) {
+	plans := p.byName[name]
+	if len(plans) == 0 {
+		return cfclient.ServicePlan{}, fmt.Errorf("Service broker has no plan named `%s' (has %s)",
+			name, strings.Join(p.planNames(), ", "))
+	}
+
+	if len(plans) > 1 {
+		return cfclient.ServicePlan{}, fmt.Errorf("Service broker has %d plans named `%s'", len(plans), name)
+	}
+
+	return plans[0], nil
+}
+
+//PlanNameForGUID returns the GUID itself if the plan isn't one of the
+// broker's.
+func (p *planSelector) PlanNameForGUID(guid string) string {
+	plan, found := p.byGUID[guid]
+	if !found {
+		return guid
+	}
+
+	return plan.Name
+}
+
+//PlanFor returns the plan to create the space's service instance with.
+// Results are cached, so spaces resolved up front cost nothing later.
+func (p *planSelector) PlanFor(space models.ConvertedSpace) (cfclient.ServicePlan, error) {
+	p.lock.Lock()
+	plan, cached := p.spacePlans[space.GUID]
+	p.lock.Unlock()
+	if cached {
+		return plan, nil
+	}
+
+	plan, err := p.planFor(space)
+	if err != nil {
+		return plan, err
+	}
+
+	p.lock.Lock()
+	p.spacePlans[space.GUID] = plan
+	p.lock.Unlock()
+	return plan, nil
+}
+
+func (p *planSelector) planFor(space models.ConvertedSpace) (cfclient.ServicePlan, error) {
+	name := p.defaultPlan
+	if orgPlan, found := p.mapping.Orgs[space.OrgName]; found && space.OrgName != "" {
+		name = orgPlan
+	}
+	if spacePlan, found := p.mapping.Spaces[space.OrgName+"/"+space.Name]; found && space.Name != "" {
+		name = spacePlan
+	}
+	if spacePlan, found := p.mapping.Spaces[space.GUID]; found {
+		name = spacePlan
+	}
+
+	if name == "" {
+		return cfclient.ServicePlan{}, fmt.Errorf("No service plan mapped for space with GUID `%s' and no --service-plan given", space.GUID)
+	}
+
+	plan, err := p.planNamed(name)
+	if err != nil {
+		return plan, err
+	}
+
+	visible, err := p.isVisible(plan, space.GUID)
+	if err != nil {
+		return plan, err
+	}
+
+	if !visible {
+		return plan, fmt.Errorf("Service plan `%s' is not visible to the org of space with GUID `%s' (%s/%s)",
+			plan.Name, space.GUID, space.OrgName, space.Name)
+	}
+
+	return plan, nil
+}
+
+func (p *planSelector) isVisible(plan cfclient.ServicePlan, spaceGUID string) (bool, error) {
+	if plan.Public {
+		return true, nil
+	}
+
+	orgGUID, err := p.orgForSpace(spaceGUID)
+	if err != nil {
+		return false, err
+	}
+
+	key := plan.Guid + "/" + orgGUID
+	p.lock.Lock()
+	visible, cached := p.visible[key]
+	p.lock.Unlock()
+	if cached {
+		return visible, nil
+	}
+
+	visible, err = p.services.PlanVisibleToOrg(plan, orgGUID)
+	if err != nil {
+		return false, fmt.Errorf("Error checking visibility of service plan `%s' to org with GUID `%s': %s", plan.Name, orgGUID, err)
+	}
+
+	p.lock.Lock()
+	p.visible[key] = visible
+	p.lock.Unlock()
+	return visible, nil
+}
+
+func (p *planSelector) orgForSpace(spaceGUID string) (string, error) {
+	p.lock.Lock()
+	orgGUID, cached := p.spaceOrgs[spaceGUID]
+	p.lock.Unlock()
+	if cached {
+		return orgGUID, nil
+	}
+
+	orgGUID, err := p.services.OrgGUIDForSpace(spaceGUID)
+	if err != nil {
+		return "", fmt.Errorf("Error getting space with GUID `%s': %s", spaceGUID, err)
+	}
+
+	p.lock.Lock()
+	p.spaceOrgs[spaceGUID] = orgGUID
+	p.lock.Unlock()
+	return orgGUID, nil
+}
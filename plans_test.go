@@ -0,0 +1,265 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+//Returns an open file with contents, positioned at the start. It is removed
+// when the test ends.
+func tempFile(t *testing.T, pattern, contents string) *os.File {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+
+	_, err = f.WriteString(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func testPlanServices() *fakeServices {
+	return &fakeServices{
+		plans: []cfclient.ServicePlan{
+			{Guid: "plan-free", Name: "free", Public: true},
+			{Guid: "plan-gold", Name: "gold"},
+		},
+		visible: map[string]bool{"plan-gold/org-a": true},
+		spaceOrgs: map[string]string{
+			"space-a1": "org-a",
+			"space-a2": "org-a",
+			"space-b1": "org-b",
+		},
+	}
+}
+
+func TestPlanSelector(t *testing.T) {
+	a1 := models.ConvertedSpace{GUID: "space-a1", OrgName: "a", Name: "one"}
+	a2 := models.ConvertedSpace{GUID: "space-a2", OrgName: "a", Name: "two"}
+	b1 := models.ConvertedSpace{GUID: "space-b1", OrgName: "b", Name: "one"}
+
+	tests := []struct {
+		name        string
+		plans       []cfclient.ServicePlan
+		defaultPlan string
+		mapping     string
+		//Set if newPlanSelector should fail
+		wantNewErr string
+		space      models.ConvertedSpace
+		wantPlan   string
+		wantErr    string
+	}{
+		{
+			name:        "default plan",
+			defaultPlan: "free",
+			space:       b1,
+			wantPlan:    "free",
+		},
+		{
+			name:     "only plan is the default",
+			plans:    []cfclient.ServicePlan{{Guid: "plan-free", Name: "free", Public: true}},
+			space:    b1,
+			wantPlan: "free",
+		},
+		{
+			name:       "several plans and no default",
+			wantNewErr: "choose one with --service-plan",
+		},
+		{
+			name:        "unknown default plan",
+			defaultPlan: "silver",
+			wantNewErr:  "no plan named `silver'",
+		},
+		{
+			name:       "unknown plan in mapping",
+			mapping:    `{"orgs": {"a": "silver"}}`,
+			wantNewErr: "no plan named `silver'",
+		},
+		{
+			name:        "org mapping overrides default",
+			defaultPlan: "free",
+			mapping:     `{"orgs": {"a": "gold"}}`,
+			space:       a1,
+			wantPlan:    "gold",
+		},
+		{
+			name:     "space name overrides org",
+			mapping:  `{"orgs": {"a": "gold"}, "spaces": {"a/two": "free"}}`,
+			space:    a2,
+			wantPlan: "free",
+		},
+		{
+			name:     "space GUID overrides space name",
+			mapping:  `{"spaces": {"a/two": "free", "space-a2": "gold"}}`,
+			space:    a2,
+			wantPlan: "gold",
+		},
+		{
+			name:    "unmapped space",
+			mapping: `{"orgs": {"a": "gold"}}`,
+			space:   b1,
+			wantErr: "No service plan mapped",
+		},
+		{
+			name:    "plan not visible to org",
+			mapping: `{"orgs": {"b": "gold"}}`,
+			space:   b1,
+			wantErr: "is not visible",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services := testPlanServices()
+			if test.plans != nil {
+				services.plans = test.plans
+			}
+
+			var mapping *os.File
+			if test.mapping != "" {
+				mapping = tempFile(t, "as2as-*.json", test.mapping)
+			}
+
+			selector, err := newPlanSelector(services, services.plans, test.defaultPlan, mapping)
+			if test.wantNewErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantNewErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantNewErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := selector.PlanFor(test.space)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plan.Name != test.wantPlan {
+				t.Errorf("got plan %s, want %s", plan.Name, test.wantPlan)
+			}
+		})
+	}
+}
+
+//Sets up a sync of input with the by-name strategy, as Run does
+func testPrepareSpaces(t *testing.T, services *fakeServices, selector *planSelector, input *os.File) (*syncCmd, *instanceResolver) {
+	existing, err := (&syncCmd{}).mapSpaceGUIDsToServiceInstances(services, services.plans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remap, force := false, true
+	s := &syncCmd{InputFile: &input, RemapByName: &remap, Force: &force}
+	return s, newInstanceResolver(services, selector, "autoscaler", instanceStrategyByName, existing)
+}
+
+func TestPrepareSpacesReportsEverySpace(t *testing.T) {
+	services := testPlanServices()
+	services.spaceOrgs["space-c1"] = "org-c"
+	services.spaceOrgs["space-c2"] = "org-c"
+	//Reused, so space-c2 needs no plan
+	services.instances = []cfclient.ServiceInstance{{Guid: "instance-c2", Name: "autoscaler", SpaceGuid: "space-c2", ServicePlanGuid: "plan-free"}}
+	mapping := tempFile(t, "as2as-*.json", `{"orgs": {"a": "gold"}}`)
+	selector, err := newPlanSelector(services, services.plans, "", mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := tempFile(t, "as2as-*.json", `{"spaces": [
+		{"guid": "space-a1", "org_name": "a", "name": "one"},
+		{"guid": "space-b1", "org_name": "b", "name": "one"},
+		{"guid": "space-c1", "org_name": "c", "name": "one"},
+		{"guid": "space-c2", "org_name": "c", "name": "two"}
+	]}`)
+	s, instances := testPrepareSpaces(t, services, selector, input)
+
+	_, err = s.prepareSpaces(services, formatJSON, selector, instances)
+	if err == nil || !strings.Contains(err.Error(), "2 spaces have no usable service plan") {
+		t.Fatalf("got error %v, want both unmapped spaces needing an instance reported", err)
+	}
+
+	if len(services.calls) != 0 {
+		t.Errorf("preparing spaces changed something: %v", services.calls)
+	}
+
+	//The mapped space is cached, so nothing is looked up for it again
+	services.spaceOrgs = nil
+	plan, err := selector.PlanFor(models.ConvertedSpace{GUID: "space-a1", OrgName: "a"})
+	if err != nil || plan.Name != "gold" {
+		t.Errorf("got plan %s and error %v for the mapped space, want gold", plan.Name, err)
+	}
+}
+
+func TestPrepareSpacesSpoolsPipedInput(t *testing.T) {
+	services := testPlanServices()
+	services.instances = []cfclient.ServiceInstance{{Guid: "instance-a2", Name: "autoscaler", SpaceGuid: "space-a2", ServicePlanGuid: "plan-free"}}
+	selector, err := newPlanSelector(services, services.plans, "free", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.WriteString(`{"spaces": [
+			{"guid": "space-b1", "org_name": "b", "name": "one", "apps": [{"guid": "app-1"}]},
+			{"guid": "space-a2", "org_name": "a", "name": "two", "apps": [{"guid": "app-2"}]}
+		]}`)
+		w.Close()
+	}()
+	s, instances := testPrepareSpaces(t, services, selector, r)
+
+	spool, err := s.prepareSpaces(services, formatJSON, selector, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	got := []string{}
+	err = readConvertedSpaces(spool, formatNDJSON, false, func(space models.ConvertedSpace) error {
+		got = append(got, space.GUID+"/"+space.Apps[0].GUID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "space-b1/app-1,space-a2/app-2" {
+		t.Errorf("got spooled spaces %v", got)
+	}
+
+	//Sync reuses the decisions rather than making them again, so a name taken
+	// since then isn't seen
+	services.otherInstances = map[string][]string{"space-b1": {"autoscaler"}}
+	decision, err := instances.Resolve(models.ConvertedSpace{GUID: "space-b1"})
+	if err != nil || decision.CreateName != "autoscaler" {
+		t.Errorf("got decision %+v and error %v for space-b1, want the cached one to create `autoscaler'", decision, err)
+	}
+}
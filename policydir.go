@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/thomasmitchell/as2as/models"
+)
+
+const policyDirIndexFile = "index.json"
+
+//policyDirWriter writes each app's policy to its own file, laid out as
+// org/space/app.json, so that it can be attached with
+// `cf attach-autoscaling-policy`. An index mapping the paths back to GUIDs is
+// written when it is closed.
+type policyDirWriter struct {
+	dir   string
+	index policyDirIndex
+	used  map[string]bool
+}
+
+type policyDirIndex struct {
+	Header *models.Header        `json:"header,omitempty"`
+	Apps   []policyDirIndexEntry `json:"apps"`
+}
+
+type policyDirIndexEntry struct {
+	//Relative to the index file
+	Path      string `json:"path"`
+	OrgName   string `json:"org_name,omitempty"`
+	SpaceName string `json:"space_name,omitempty"`
+	SpaceGUID string `json:"space_guid"`
+	AppName   string `json:"app_name,omitempty"`
+	AppGUID   string `json:"app_guid"`
+}
+
+func newPolicyDirWriter(dir string, header models.Header) (*policyDirWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating output directory: %s", err)
+	}
+
+	return &policyDirWriter{
+		dir:   dir,
+		index: policyDirIndex{Header: &header, Apps: []policyDirIndexEntry{}},
+		used:  map[string]bool{},
+	}, nil
+}
+
+//Apps without a policy are skipped, as there is nothing to attach.
+func (p *policyDirWriter) Write(space *models.ConvertedSpace) error {
+	orgDir := pathComponent(space.OrgName, "unknown-org")
+	spaceDir := pathComponent(space.Name, space.GUID)
+
+	for _, app := range space.Apps {
+		if app.Policy == nil {
+			continue
+		}
+
+		path := filepath.Join(orgDir, spaceDir, pathComponent(app.Name, app.GUID)+".json")
+		if p.used[path] {
+			//Names are only unique within a space, and sanitizing can collide
+			path = filepath.Join(orgDir, spaceDir, pathComponent(app.Name, app.GUID)+"-"+app.GUID+".json")
+		}
+		p.used[path] = true
+
+		err := p.writePolicy(path, app.Policy)
+		if err != nil {
+			return fmt.Errorf("Error writing policy for app with GUID `%s': %s", app.GUID, err)
+		}
+
+		p.index.Apps = append(p.index.Apps, policyDirIndexEntry{
+			Path:      filepath.ToSlash(path),
+			OrgName:   space.OrgName,
+			SpaceName: space.Name,
+			SpaceGUID: space.GUID,
+			AppName:   app.Name,
+			AppGUID:   app.GUID,
+		})
+	}
+
+	return nil
+}
+
+func (p *policyDirWriter) writePolicy(path string, policy interface{}) error {
+	fullPath := filepath.Join(p.dir, path)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return writeDocumentFile(fullPath, policy)
+}
+
+func (p *policyDirWriter) Close() error {
+	sort.Slice(p.index.Apps, func(i, j int) bool {
+		return p.index.Apps[i].Path < p.index.Apps[j].Path
+	})
+
+	err := writeDocumentFile(filepath.Join(p.dir, policyDirIndexFile), &p.index)
+	if err != nil {
+		return fmt.Errorf("Error writing index file: %s", err)
+	}
+
+	return nil
+}
+
+func writeDocumentFile(path string, v interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = encodeDocument(f, formatJSON, v)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+//Makes name safe to use as a single path component, falling back to fallback
+// if name is empty.
+func pathComponent(name, fallback string) string {
+	if name == "" {
+		name = fallback
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', 0:
+			return '_'
+		}
+		return r
+	}, name)
+
+	if name == "." || name == ".." {
+		name = strings.Repeat("_", len(name))
+	}
+
+	return name
+}
@@ -0,0 +1,254 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thomasmitchell/as2as/logger"
+)
+
+const (
+	barWidth       = 30
+	redrawInterval = 200 * time.Millisecond
+)
+
+type Tracker struct {
+	name    string
+	done    int64
+	total   int64
+	started time.Time
+}
+
+func (t *Tracker) Increment() {
+	atomic.AddInt64(&t.done, 1)
+}
+
+func (t *Tracker) AddTotal(n int) {
+	atomic.AddInt64(&t.total, int64(n))
+}
+
+func (t *Tracker) SetTotal(n int) {
+	atomic.StoreInt64(&t.total, int64(n))
+}
+
+type snapshot struct {
+	name  string
+	done  int64
+	total int64
+	rate  float64
+	eta   time.Duration
+}
+
+func (t *Tracker) snapshot(now time.Time) snapshot {
+	ret := snapshot{
+		name:  t.name,
+		done:  atomic.LoadInt64(&t.done),
+		total: atomic.LoadInt64(&t.total),
+		eta:   -1,
+	}
+
+	elapsed := now.Sub(t.started).Seconds()
+	if elapsed > 0 {
+		ret.rate = float64(ret.done) / elapsed
+	}
+
+	if ret.rate > 0 && ret.total >= ret.done {
+		ret.eta = time.Duration(float64(ret.total-ret.done) / ret.rate * float64(time.Second))
+	}
+
+	return ret
+}
+
+//Reporter draws progress bars for its trackers when writing to a terminal,
+// and otherwise logs a summary line for each tracker every interval.
+type Reporter struct {
+	out      *os.File
+	tty      bool
+	enabled  bool
+	interval time.Duration
+
+	lock      sync.Mutex
+	trackers  []*Tracker
+	drawn     int
+	stop      chan bool
+	stopped   chan bool
+	oldLogOut io.Writer
+}
+
+//If enabled is false, trackers still count but nothing is ever displayed.
+func NewReporter(out *os.File, enabled bool, interval time.Duration) *Reporter {
+	return &Reporter{
+		out:      out,
+		tty:      isTerminal(out),
+		enabled:  enabled,
+		interval: interval,
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *Reporter) Track(name string, total int) *Tracker {
+	t := &Tracker{
+		name:    name,
+		total:   int64(total),
+		started: time.Now(),
+	}
+
+	r.lock.Lock()
+	r.trackers = append(r.trackers, t)
+	r.lock.Unlock()
+	return t
+}
+
+func (r *Reporter) Start() {
+	if !r.enabled || r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan bool)
+	r.stopped = make(chan bool)
+
+	interval := r.interval
+	if r.tty {
+		interval = redrawInterval
+		r.oldLogOut = logger.SetOutput(r)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.report()
+			case <-r.stop:
+				r.report()
+				close(r.stopped)
+				return
+			}
+		}
+	}()
+}
+
+func (r *Reporter) Stop() {
+	if r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.stopped
+	r.stop = nil
+
+	if r.oldLogOut != nil {
+		logger.SetOutput(r.oldLogOut)
+		r.oldLogOut = nil
+	}
+}
+
+//Write lets log lines be printed above the progress bars without the bars
+// being drawn over.
+func (r *Reporter) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.clear()
+	n, err := r.out.Write(p)
+	r.draw()
+	return n, err
+}
+
+func (r *Reporter) report() {
+	if r.tty {
+		r.lock.Lock()
+		r.clear()
+		r.draw()
+		r.lock.Unlock()
+		return
+	}
+
+	r.lock.Lock()
+	trackers := make([]*Tracker, len(r.trackers))
+	copy(trackers, r.trackers)
+	r.lock.Unlock()
+
+	now := time.Now()
+	for _, t := range trackers {
+		s := t.snapshot(now)
+		fields := logger.Fields{
+			logger.FieldStage: s.name,
+			"done":            s.done,
+			"total":           s.total,
+			"rate":            fmt.Sprintf("%.1f/s", s.rate),
+		}
+		if s.eta >= 0 {
+			fields["eta"] = s.eta.Round(time.Second).String()
+		}
+
+		logger.WithFields(fields).Infof("Progress: %s %d/%d", s.name, s.done, s.total)
+	}
+}
+
+//Must be called with the lock held
+func (r *Reporter) clear() {
+	if r.drawn == 0 {
+		return
+	}
+
+	fmt.Fprintf(r.out, "\033[%dA", r.drawn)
+	for i := 0; i < r.drawn; i++ {
+		fmt.Fprintf(r.out, "\033[2K\n")
+	}
+	fmt.Fprintf(r.out, "\033[%dA", r.drawn)
+	r.drawn = 0
+}
+
+//Must be called with the lock held
+func (r *Reporter) draw() {
+	now := time.Now()
+
+	nameWidth := 0
+	for _, t := range r.trackers {
+		if len(t.name) > nameWidth {
+			nameWidth = len(t.name)
+		}
+	}
+
+	for _, t := range r.trackers {
+		fmt.Fprintf(r.out, "%s\n", t.snapshot(now).bar(nameWidth))
+	}
+
+	r.drawn = len(r.trackers)
+}
+
+func (s snapshot) bar(nameWidth int) string {
+	filled := 0
+	if s.total > 0 {
+		filled = int(float64(barWidth) * float64(s.done) / float64(s.total))
+	}
+	if filled > barWidth {
+		filled = barWidth
+	}
+
+	eta := "--"
+	if s.eta >= 0 {
+		eta = s.eta.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%-*s [%s%s] %d/%d  %.1f/s  ETA %s",
+		nameWidth, s.name,
+		strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+		s.done, s.total, s.rate, eta,
+	)
+}
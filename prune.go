@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/pcfas"
+)
+
+//prunePCFCmd cleans the orphans recorded in a dump out of the PCF autoscaler.
+// The PCF autoscaler API has no way to delete an app outright, so each
+// orphan's rules and scheduled limit changes are deleted and the app is
+// disabled. The registration itself stays until the autoscaler service
+// instance is deleted, but dump no longer records it as an orphan.
+type prunePCFCmd struct {
+	InputFile    **os.File
+	InputFormat  *string
+	Force        *bool
+	ClientID     *string
+	ClientSecret *string
+	CFHost       *string
+	PCFASHost    *string
+	DryRun       *bool
+}
+
+type pruneStats struct {
+	Pruned int
+	//Apps which CF knows about again since the dump
+	Skipped int
+}
+
+func (p *prunePCFCmd) Run() error {
+	inputFormat := detectInputFormat(*p.InputFormat, (*p.InputFile).Name())
+	header, err := verifyInput(*p.InputFile, inputFormat, models.KindDump, *p.Force)
+	if err != nil {
+		return err
+	}
+
+	if header != nil && header.CFHost != "" && header.CFHost != *p.CFHost && !*p.Force {
+		return fmt.Errorf("Input was dumped from `%s', not `%s'. Use --force to prune anyway", header.CFHost, *p.CFHost)
+	}
+
+	cf, err := buildCFClient(*p.CFHost, *p.ClientID, *p.ClientSecret)
+	if err != nil {
+		return err
+	}
+
+	services, err := newServiceAPI(cf)
+	if err != nil {
+		return err
+	}
+
+	token, err := cf.GetToken()
+	if err != nil {
+		return fmt.Errorf("Error retrieving auth token: %s", err)
+	}
+
+	err = discoverASHost(cf, p.PCFASHost, pcfASHostPrefix)
+	if err != nil {
+		return err
+	}
+
+	pcfasClient := pcfas.NewClient(*p.PCFASHost, strings.TrimPrefix(token, "bearer "))
+	tracer, err := getTracer()
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		pcfasClient.TraceTo(tracer)
+	}
+
+	stats := pruneStats{}
+	err = readDumpSpaces(*p.InputFile, inputFormat, *p.Force, func(space models.Space) error {
+		for _, orphan := range space.Orphans {
+			pruned, err := p.pruneApp(services, pcfasClient, space, orphan)
+			if err != nil {
+				return err
+			}
+
+			if pruned {
+				stats.Pruned++
+			} else {
+				stats.Skipped++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*p.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	verb := "Pruned"
+	if *p.DryRun {
+		verb = "Would prune"
+	}
+	logger.Infof("%s %d orphaned apps; skipped %d which CF knows about again", verb, stats.Pruned, stats.Skipped)
+	return nil
+}
+
+//alreadyPruned is true of an app left the way pruneApp leaves it.
+func alreadyPruned(app models.App) bool {
+	return !app.Enabled && len(app.Rules) == 0 && len(app.ScheduledLimitChanges) == 0
+}
+
+//Returns false if the app turned out not to be orphaned.
+func (p *prunePCFCmd) pruneApp(services serviceAPI, pcfasClient *pcfas.Client, space models.Space, orphan models.App) (bool, error) {
+	log := logger.WithFields(logger.Fields{
+		logger.FieldStage:     "prune",
+		logger.FieldOrgName:   space.OrgName,
+		logger.FieldSpaceName: space.Name,
+		logger.FieldSpaceGUID: space.GUID,
+		logger.FieldAppGUID:   orphan.GUID,
+	})
+
+	//The dump may be old, so make sure before deleting anything
+	cfApp, err := services.GetApp(orphan.GUID)
+	if err != nil {
+		return false, fmt.Errorf("Error querying CF for existence of app with GUID `%s': %s", orphan.GUID, err)
+	}
+	if cfApp != nil {
+		log.Warnf("Skipping app which CF knows about again")
+		return false, nil
+	}
+
+	rules, err := pcfasClient.RulesForAppWithGUID(orphan.GUID)
+	if err != nil {
+		return false, fmt.Errorf("Error getting rules for app with GUID `%s': %s", orphan.GUID, err)
+	}
+
+	changes, err := pcfasClient.ScheduledLimitChangesForAppWithGUID(orphan.GUID)
+	if err != nil {
+		return false, fmt.Errorf("Error getting scheduled limit changes for app with GUID `%s': %s", orphan.GUID, err)
+	}
+
+	log = log.WithFields(logger.Fields{"rules": len(rules), "scheduled_limit_changes": len(changes)})
+	if *p.DryRun {
+		log.Infof("Would delete rules and scheduled limit changes and disable orphaned app")
+		return true, nil
+	}
+
+	for _, rule := range rules {
+		err = pcfasClient.DeleteRuleForAppWithGUID(orphan.GUID, rule.GUID)
+		if err != nil {
+			return false, fmt.Errorf("Error deleting rule `%s' of app with GUID `%s': %s", rule.GUID, orphan.GUID, err)
+		}
+	}
+
+	for _, change := range changes {
+		err = pcfasClient.DeleteScheduledLimitChangeForAppWithGUID(orphan.GUID, change.GUID)
+		if err != nil {
+			return false, fmt.Errorf("Error deleting scheduled limit change `%s' of app with GUID `%s': %s", change.GUID, orphan.GUID, err)
+		}
+	}
+
+	err = pcfasClient.UpdateApp(pcfas.App{
+		GUID:    orphan.GUID,
+		Enabled: false,
+		InstanceLimits: pcfas.InstanceLimits{
+			Min: orphan.InstanceLimits.Min,
+			Max: orphan.InstanceLimits.Max,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error disabling app with GUID `%s': %s", orphan.GUID, err)
+	}
+
+	log.Infof("Deleted rules and scheduled limit changes and disabled orphaned app")
+	return true, nil
+}
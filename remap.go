@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+type remapEntry struct {
+	OrgName   string
+	SpaceName string
+	AppName   string
+	GUID      string
+	Reason    string
+}
+
+func (r remapEntry) log(log logger.Entry) logger.Entry {
+	return log.WithFields(logger.Fields{
+		logger.FieldOrgName:   r.OrgName,
+		logger.FieldSpaceName: r.SpaceName,
+		logger.FieldAppName:   r.AppName,
+		logger.FieldAppGUID:   r.GUID,
+	})
+}
+
+type remapReport struct {
+	Matched   int
+	Unmatched []remapEntry
+	Ambiguous []remapEntry
+	//Spaces with no app matched on the target, which are skipped entirely
+	UnmatchedSpaces int
+}
+
+func (r *remapReport) unmatched(space models.ConvertedSpace, app models.ConvertedPolicyToApp, reason string) {
+	r.Unmatched = append(r.Unmatched, remapEntry{
+		OrgName:   space.OrgName,
+		SpaceName: space.Name,
+		AppName:   app.Name,
+		GUID:      app.GUID,
+		Reason:    reason,
+	})
+}
+
+func (r *remapReport) ambiguous(space models.ConvertedSpace, app models.ConvertedPolicyToApp, reason string) {
+	r.Ambiguous = append(r.Ambiguous, remapEntry{
+		OrgName:   space.OrgName,
+		SpaceName: space.Name,
+		AppName:   app.Name,
+		GUID:      app.GUID,
+		Reason:    reason,
+	})
+}
+
+func (r *remapReport) Print() {
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "remap"})
+	log.Infof("Remapped %d apps by name, %d unmatched, %d ambiguous; %d spaces had no app to remap",
+		r.Matched, len(r.Unmatched), len(r.Ambiguous), r.UnmatchedSpaces)
+	for _, entry := range r.Unmatched {
+		entry.log(log).Warnf("App could not be matched on the target foundation: %s", entry.Reason)
+	}
+
+	for _, entry := range r.Ambiguous {
+		entry.log(log).Warnf("App matched ambiguously on the target foundation: %s", entry.Reason)
+	}
+}
+
+type nameRemapper struct {
+	services serviceAPI
+	Report   *remapReport
+	//org name -> org GUID, or empty string if no single org has that name
+	orgGUIDs map[string]string
+}
+
+func newNameRemapper(services serviceAPI) *nameRemapper {
+	return &nameRemapper{
+		services: services,
+		Report:   &remapReport{},
+		orgGUIDs: map[string]string{},
+	}
+}
+
+//Remap resolves the org, space, and app names recorded for a space against
+// the target foundation. found is false if the space itself could not be
+// resolved or none of its apps could. Apps which do not resolve to exactly one
+// app on the target are left out of the returned space and listed in the
+// report instead.
+func (n *nameRemapper) Remap(space models.ConvertedSpace) (ret models.ConvertedSpace, found bool, err error) {
+	report := n.Report
+	failSpace := func(reason string, isAmbiguous bool) {
+		report.UnmatchedSpaces++
+		for _, app := range space.Apps {
+			if isAmbiguous {
+				report.ambiguous(space, app, reason)
+			} else {
+				report.unmatched(space, app, reason)
+			}
+		}
+	}
+
+	if space.OrgName == "" || space.Name == "" {
+		failSpace("no org or space name recorded in input", false)
+		return ret, false, nil
+	}
+
+	orgGUID, cached := n.orgGUIDs[space.OrgName]
+	if !cached {
+		orgs, err := n.services.FindOrgGUIDsByName(space.OrgName)
+		if err != nil {
+			return ret, false, fmt.Errorf("Error looking up org with name `%s': %s", space.OrgName, err)
+		}
+
+		if len(orgs) == 1 {
+			orgGUID = orgs[0]
+		}
+
+		n.orgGUIDs[space.OrgName] = orgGUID
+	}
+
+	if orgGUID == "" {
+		failSpace(fmt.Sprintf("no single org named `%s' on target", space.OrgName), false)
+		return ret, false, nil
+	}
+
+	targetSpaces, err := n.services.FindSpaceGUIDsByName(orgGUID, space.Name)
+	if err != nil {
+		return ret, false, fmt.Errorf("Error looking up space with name `%s' in org `%s': %s", space.Name, space.OrgName, err)
+	}
+
+	if len(targetSpaces) == 0 {
+		failSpace(fmt.Sprintf("no space named `%s' in org `%s' on target", space.Name, space.OrgName), false)
+		return ret, false, nil
+	}
+
+	if len(targetSpaces) > 1 {
+		failSpace(fmt.Sprintf("%d spaces named `%s' in org `%s' on target", len(targetSpaces), space.Name, space.OrgName), true)
+		return ret, false, nil
+	}
+
+	targetApps, err := n.services.ListAppsInSpace(targetSpaces[0])
+	if err != nil {
+		return ret, false, fmt.Errorf("Error listing apps in space `%s' in org `%s': %s", space.Name, space.OrgName, err)
+	}
+
+	//app name -> target app GUIDs
+	targetAppGUIDs := map[string][]string{}
+	for _, targetApp := range targetApps {
+		targetAppGUIDs[targetApp.Name] = append(targetAppGUIDs[targetApp.Name], targetApp.Guid)
+	}
+
+	sourceNameCounts := map[string]int{}
+	for _, app := range space.Apps {
+		sourceNameCounts[app.Name]++
+	}
+
+	ret = space
+	ret.GUID = targetSpaces[0]
+	ret.Apps = nil
+
+	for _, app := range space.Apps {
+		if app.Name == "" {
+			report.unmatched(space, app, "no app name recorded in input")
+			continue
+		}
+
+		if sourceNameCounts[app.Name] > 1 {
+			report.ambiguous(space, app, fmt.Sprintf("%d apps in input share this name", sourceNameCounts[app.Name]))
+			continue
+		}
+
+		guids := targetAppGUIDs[app.Name]
+		if len(guids) == 0 {
+			report.unmatched(space, app, "no app with this name on target")
+			continue
+		}
+
+		if len(guids) > 1 {
+			report.ambiguous(space, app, fmt.Sprintf("%d apps with this name on target", len(guids)))
+			continue
+		}
+
+		app.GUID = guids[0]
+		ret.Apps = append(ret.Apps, app)
+		report.Matched++
+	}
+
+	if len(ret.Apps) == 0 {
+		report.UnmatchedSpaces++
+		return ret, false, nil
+	}
+
+	return ret, true, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thomasmitchell/as2as/models"
+)
+
+type exportScriptCmd struct {
+	InputFile           **os.File
+	InputFormat         *string
+	Force               *bool
+	ServiceName         *string
+	ServicePlan         *string
+	ServiceInstanceName *string
+
+	stdoutWriter
+}
+
+//The guards make every step safe to rerun if the script fails partway
+// through. The v3 API calls need cf CLI v7 or later, and jq.
+const scriptPreamble = `
+set -euo pipefail
+
+POLICY_DIR="$(mktemp -d)"
+trap 'rm -rf "$POLICY_DIR"' EXIT
+
+urlencode() {
+  jq -rn --arg v "$1" '$v|@uri'
+}
+
+discover_plan() {
+  local service="$1" plans
+  plans="$(cf curl "/v3/service_plans?service_offering_names=$(urlencode "$service")" | jq -r '.resources[].name')"
+  if [ -z "$plans" ] || [ "$(wc -l <<<"$plans")" -ne 1 ]; then
+    echo "Service '$service' must have exactly one plan to discover it; set SERVICE_PLAN. Plans found: ${plans:-none}" >&2
+    exit 1
+  fi
+  echo "$plans"
+}
+
+ensure_service_instance() {
+  local service="$1" plan="$2" instance="$3"
+  if cf service "$instance" >/dev/null 2>&1; then
+    echo "Service instance '$instance' already exists"
+    return
+  fi
+  cf create-service "$service" "$plan" "$instance" --wait
+}
+
+ensure_binding() {
+  local app="$1" instance="$2" app_guid total
+  app_guid="$(cf app "$app" --guid)"
+  total="$(cf curl "/v3/service_credential_bindings?type=app&app_guids=${app_guid}&service_instance_names=$(urlencode "$instance")" |
+    jq -r '.pagination.total_results')"
+  if ! [[ "$total" =~ ^[0-9]+$ ]]; then
+    echo "Could not check whether app '$app' is bound to '$instance'" >&2
+    exit 1
+  fi
+  if [ "$total" -gt 0 ]; then
+    echo "App '$app' is already bound to '$instance'"
+    return
+  fi
+  cf bind-service "$app" "$instance"
+}
+`
+
+func (e *exportScriptCmd) Run() error {
+	inputFormat := detectInputFormat(*e.InputFormat, (*e.InputFile).Name())
+	header, err := verifyInput(*e.InputFile, inputFormat, models.KindConverted, *e.Force)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(e.output())
+	fmt.Fprintf(out, "#!/usr/bin/env bash\n")
+	fmt.Fprintf(out, "# Generated by as2as %s from `%s'\n", version, (*e.InputFile).Name())
+	if header != nil {
+		if header.CFHost != "" {
+			fmt.Fprintf(out, "# Source foundation: %s (broker %s)\n", header.CFHost, header.BrokerGUID)
+		}
+		fmt.Fprintf(out, "# Converted at: %s\n", header.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, "%s", scriptPreamble)
+	fmt.Fprintf(out, "\nSERVICE=%s\n", shellQuote(*e.ServiceName))
+	if *e.ServicePlan != "" {
+		fmt.Fprintf(out, "SERVICE_PLAN=%s\n", shellQuote(*e.ServicePlan))
+	} else {
+		//The plan can still be given through the environment when running the script
+		fmt.Fprintf(out, "if [ -z \"${SERVICE_PLAN:-}\" ]; then\n  SERVICE_PLAN=\"$(discover_plan \"$SERVICE\")\"\nfi\n")
+	}
+
+	err = readConvertedSpaces(*e.InputFile, inputFormat, *e.Force, func(space models.ConvertedSpace) error {
+		return e.writeSpace(out, space)
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*e.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	fmt.Fprintf(out, "\necho 'Done!'\n")
+	err = out.Flush()
+	if err != nil {
+		return fmt.Errorf("Error writing script: %s", err)
+	}
+
+	return nil
+}
+
+func (e *exportScriptCmd) writeSpace(out io.Writer, space models.ConvertedSpace) error {
+	//The CF CLI only works with names
+	if space.OrgName == "" || space.Name == "" {
+		return fmt.Errorf("Space with GUID `%s' has no org or space name to target with the CF CLI; the input predates names being recorded, so dump and convert it again", space.GUID)
+	}
+
+	instance := shellQuote(*e.ServiceInstanceName)
+	fmt.Fprintf(out, "\n# Space %s (%s)\n", space.GUID, space.OrgName+"/"+space.Name)
+	fmt.Fprintf(out, "cf target -o %s -s %s\n", shellQuote(space.OrgName), shellQuote(space.Name))
+	fmt.Fprintf(out, "ensure_service_instance \"$SERVICE\" \"$SERVICE_PLAN\" %s\n", instance)
+
+	for _, app := range space.Apps {
+		if app.Name == "" {
+			return fmt.Errorf("App with GUID `%s' in space `%s/%s' has no name to bind it by", app.GUID, space.OrgName, space.Name)
+		}
+
+		name := shellQuote(app.Name)
+		fmt.Fprintf(out, "\n# App %s\n", app.GUID)
+		fmt.Fprintf(out, "ensure_binding %s %s\n", name, instance)
+		if app.Policy == nil {
+			fmt.Fprintf(out, "# Autoscaling was disabled for this app; no policy to attach\n")
+			continue
+		}
+
+		policy := bytes.Buffer{}
+		err := encodeDocument(&policy, formatJSON, app.Policy)
+		if err != nil {
+			return fmt.Errorf("Error encoding policy for app with GUID `%s': %s", app.GUID, err)
+		}
+
+		//The delimiter is quoted so that nothing in the policy is expanded
+		policyFile := fmt.Sprintf("\"$POLICY_DIR/%s.json\"", app.GUID)
+		fmt.Fprintf(out, "cat > %s <<'POLICY'\n%sPOLICY\n", policyFile, policy.String())
+		fmt.Fprintf(out, "cf attach-autoscaling-policy %s %s\n", name, policyFile)
+	}
+
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -3,38 +3,92 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
 	"github.com/thomasmitchell/as2as/models"
 	"github.com/thomasmitchell/as2as/ocfas"
+	"github.com/thomasmitchell/as2as/progress"
 )
 
 type syncCmd struct {
 	InputFile           **os.File
+	InputFormat         *string
 	ClientID            *string
 	ClientSecret        *string
 	CFHost              *string
 	OCFASHost           *string
 	BrokerGUID          *string
+	ServiceName         *string
 	ServiceInstanceName *string
+	ServicePlan         *string
+	ServicePlanMap      **os.File
+	InstanceStrategy    *string
 	Workers             *int
+	RemapByName         *bool
+	//Attach policies as binding parameters instead of through the OCF
+	// autoscaler API, so OCFASHost isn't needed unless existing bindings have
+	// a different policy
+	PolicyViaBinding *bool
+	Force            *bool
+
+	//Only set with PolicyViaBinding if the OCF autoscaler API host is known,
+	// to update the policies of existing bindings
+	policyAPI policySetter
+	stats     syncStats
+	statsLock sync.Mutex
+	//Set by migrate, which prints the stats in its own summary
+	skipSummary bool
+}
+
+type policySetter interface {
+	CreatePolicyForAppWithGUID(guid string, policy *ocfas.Policy) error
+}
+
+//Updated concurrently by the sync workers, so only touch with sync/atomic
+type syncStats struct {
+	InstancesCreated  int64 `json:"instances_created"`
+	InstancesExisting int64 `json:"instances_existing"`
+	BindingsCreated   int64 `json:"bindings_created"`
+	BindingsExisting  int64 `json:"bindings_existing"`
+	PoliciesSet       int64 `json:"policies_set"`
+	//Apps with autoscaling disabled, which get no policy
+	PoliciesSkipped int64 `json:"policies_skipped"`
+	//Only with --policy-via-binding: the existing binding already had the policy
+	PoliciesUnchanged int64 `json:"policies_unchanged,omitempty"`
+	//Only with --policy-via-binding: existing bindings which had a different
+	// policy, or parameters which couldn't be read, and no autoscaler API host
+	// to update them through. Sync fails on these unless forced
+	PoliciesNotApplied int64 `json:"policies_not_applied,omitempty"`
+	//plan name -> number of spaces using it. Guarded by statsLock
+	Plans map[string]int64 `json:"plans,omitempty"`
+	//Guarded by statsLock
+	Instances []instanceChoice `json:"instances,omitempty"`
+}
+
+func (s *syncCmd) policyViaBinding() bool {
+	return s.PolicyViaBinding != nil && *s.PolicyViaBinding
 }
 
 func (s *syncCmd) Run() error {
-	jDecoder := json.NewDecoder(*s.InputFile)
-	syncInput := models.Converted{}
-	err := jDecoder.Decode(&syncInput)
+	inputFormat := detectInputFormat(*s.InputFormat, (*s.InputFile).Name())
+	inputHeader, err := verifyInput(*s.InputFile, inputFormat, models.KindConverted, *s.Force)
 	if err != nil {
-		return fmt.Errorf("Error parsing input file JSON: %s", err)
+		return err
 	}
 
-	err = (*s.InputFile).Close()
+	err = s.checkFoundation(inputHeader)
 	if err != nil {
-		return fmt.Errorf("Error closing input file")
+		return err
 	}
 
 	cf, err := buildCFClient(*s.CFHost, *s.ClientID, *s.ClientSecret)
@@ -42,149 +96,435 @@ func (s *syncCmd) Run() error {
 		return err
 	}
 
-	planGUIDs, err := s.getServicePlanGUIDs(cf)
+	services, err := newServiceAPI(cf)
+	if err != nil {
+		return err
+	}
+
+	serviceName := defaultOCFServiceName
+	if s.ServiceName != nil && *s.ServiceName != "" {
+		serviceName = *s.ServiceName
+	}
+	err = discoverBrokerGUID(services, s.BrokerGUID, serviceName)
 	if err != nil {
 		return err
 	}
 
-	if len(planGUIDs) == 0 {
+	//Binding parameters can't be changed, so the API is still used for
+	// existing bindings with a different policy if its host can be found
+	err = discoverASHost(cf, s.OCFASHost, ocfASHostPrefix)
+	if err != nil && !s.policyViaBinding() {
+		return err
+	}
+	if err != nil {
+		logger.Warnf("Existing bindings with a different policy will be left alone: %s", err)
+	} else if s.policyViaBinding() {
+		s.policyAPI, err = s.newPolicyAPI(cf)
+		if err != nil {
+			return err
+		}
+	}
+
+	plans, err := s.getServicePlans(services)
+	if err != nil {
+		return err
+	}
+
+	if len(plans) == 0 {
 		return fmt.Errorf("No service plans exist for service broker with GUID `%s'", *s.BrokerGUID)
 	}
 
-	spacesToInstances, err := s.mapSpaceGUIDsToServiceInstances(cf, planGUIDs)
+	var planMapFile *os.File
+	if s.ServicePlanMap != nil {
+		planMapFile = *s.ServicePlanMap
+	}
+	defaultPlan := ""
+	if s.ServicePlan != nil {
+		defaultPlan = *s.ServicePlan
+	}
+	planSelector, err := newPlanSelector(services, plans, defaultPlan, planMapFile)
+	if err != nil {
+		return err
+	}
+
+	spacesToInstances, err := s.mapSpaceGUIDsToServiceInstances(services, plans)
 	if err != nil {
 		return err
 	}
 
-	spacesToCreateInstances := make(chan models.ConvertedSpace, len(syncInput.Spaces))
+	instanceStrategy := instanceStrategyByName
+	if s.InstanceStrategy != nil {
+		instanceStrategy = *s.InstanceStrategy
+	}
+	instances := newInstanceResolver(services, planSelector, *s.ServiceInstanceName, instanceStrategy, spacesToInstances)
+
+	spool, err := s.prepareSpaces(services, inputFormat, planSelector, instances)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+
+	numWorkers := *(s.Workers)
+
+	reporter := newProgressReporter()
+	defer reporter.Stop()
+	instancesTracker := reporter.Track("instances created", 0)
+	bindingsTracker := reporter.Track("bindings made", 0)
+	policiesTracker := reporter.Track("policies set", 0)
+	reporter.Start()
+
+	errChan := make(chan error)
+
+	//Spaces are streamed from the spool file so that NDJSON input never needs to be held in
+	// memory all at once. They were already remapped
+	spacesToCreateInstances := make(chan models.ConvertedSpace, numWorkers)
 	go func() {
-		for i := range syncInput.Spaces {
-			spacesToCreateInstances <- syncInput.Spaces[i]
+		err := readConvertedSpaces(spool, formatNDJSON, *s.Force, func(space models.ConvertedSpace) error {
+			instancesTracker.AddTotal(1)
+			bindingsTracker.AddTotal(len(space.Apps))
+			//Apps with autoscaling disabled get no policy, so they aren't counted
+			for _, app := range space.Apps {
+				if app.Policy != nil {
+					policiesTracker.AddTotal(1)
+				}
+			}
+			spacesToCreateInstances <- space
+			return nil
+		})
+		if err != nil {
+			errChan <- fmt.Errorf("Error reading spool file: %s", err)
+			return
+		}
+
+		err = spool.Close()
+		if err != nil {
+			errChan <- fmt.Errorf("Error closing spool file: %s", err)
+			return
 		}
 
 		close(spacesToCreateInstances)
 	}()
 
-	numWorkers := *(s.Workers)
-
 	instancesWaitGroup := sync.WaitGroup{}
 	instancesWaitGroup.Add(numWorkers)
-	readySpacesChan := make(chan SyncServiceInstanceSpacePair, len(syncInput.Spaces))
-	errChan := make(chan error)
-	fmt.Fprintf(os.Stderr, "Creating service instances\n")
+	readySpacesChan := make(chan SyncServiceInstanceSpacePair, numWorkers)
+	instancesLog := logger.WithFields(logger.Fields{logger.FieldStage: "instances"})
+	instancesLog.Infof("Creating service instances")
+	instancesStart := time.Now()
 	for i := 0; i < numWorkers; i++ {
 		go s.createServiceInstancesForSpaces(
-			cf,
+			services,
 			spacesToCreateInstances,
 			readySpacesChan,
 			&instancesWaitGroup,
 			errChan,
-			*s.ServiceInstanceName,
-			planGUIDs[0],
-			spacesToInstances,
+			instances,
+			planSelector,
+			instancesTracker,
 		)
 	}
 	go func() {
 		instancesWaitGroup.Wait()
-		fmt.Fprintf(os.Stderr, "Done creating service instances\n")
+		instancesLog.WithFields(logger.Fields{
+			logger.FieldDuration: time.Since(instancesStart),
+		}).Infof("Done creating service instances")
 		close(readySpacesChan)
 	}()
 
 	bindAppsWaitGroup := sync.WaitGroup{}
 	bindAppsWaitGroup.Add(numWorkers)
 
-	fmt.Fprintf(os.Stderr, "Binding services to apps\n")
-	appChan := make(chan models.ConvertedPolicyToApp, 1000)
+	bindingsLog := logger.WithFields(logger.Fields{logger.FieldStage: "bindings"})
+	bindingsLog.Infof("Binding services to apps")
+	bindingsStart := time.Now()
+	doneChan := make(chan bool)
+	//Policies are attached while binding in that mode, so nothing is left for
+	// the policy workers
+	var appChan chan models.ConvertedPolicyToApp
+	if !s.policyViaBinding() {
+		appChan = make(chan models.ConvertedPolicyToApp, 1000)
+	}
 	for i := 0; i < numWorkers; i++ {
 		go s.bindServiceToApps(
-			cf,
+			services,
 			readySpacesChan,
 			appChan,
 			&bindAppsWaitGroup,
 			errChan,
+			bindingsTracker,
+			policiesTracker,
 		)
 	}
 	go func() {
 		bindAppsWaitGroup.Wait()
-		fmt.Fprintf(os.Stderr, "Done binding services to apps\n")
+		bindingsLog.WithFields(logger.Fields{
+			logger.FieldDuration: time.Since(bindingsStart),
+		}).Infof("Done binding services to apps")
+		if appChan == nil {
+			doneChan <- true
+			return
+		}
+
 		close(appChan)
 	}()
 
-	setPoliciesWaitGroup := sync.WaitGroup{}
-	setPoliciesWaitGroup.Add(numWorkers)
-	doneChan := make(chan bool)
+	if appChan != nil {
+		err = s.startPolicyWorkers(cf, appChan, doneChan, errChan, policiesTracker)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-doneChan:
+		reporter.Stop()
+		return s.finish()
+	}
+}
+
+//finish reports what was done, and fails if any policies couldn't be applied
+// so that they aren't missed in the output
+func (s *syncCmd) finish() error {
+	s.printInstances()
+	if !s.skipSummary {
+		s.stats.print(logger.WithFields(logger.Fields{logger.FieldStage: "summary"}))
+	}
+
+	if s.stats.PoliciesNotApplied > 0 {
+		if !*s.Force {
+			return fmt.Errorf("%d policies were not applied to existing bindings; see the warnings above, or use --force to ignore them",
+				s.stats.PoliciesNotApplied)
+		}
+
+		logger.Warnf("%d policies were not applied to existing bindings; continuing because of --force", s.stats.PoliciesNotApplied)
+	}
+
+	logger.Infof("Done!")
+	return nil
+}
+
+func (s *syncStats) print(log logger.Entry) {
+	log.Infof("Service instances: %d created, %d already existed", s.InstancesCreated, s.InstancesExisting)
+	log.Infof("Bindings: %d created, %d already existed", s.BindingsCreated, s.BindingsExisting)
+	log.Infof("Policies: %d set, %d skipped because autoscaling was disabled", s.PoliciesSet, s.PoliciesSkipped)
+	if s.PoliciesUnchanged > 0 {
+		log.Infof("Policies: %d already attached to their binding", s.PoliciesUnchanged)
+	}
+	if s.PoliciesNotApplied > 0 {
+		log.Warnf("Policies: %d not applied to existing bindings; see the warnings above", s.PoliciesNotApplied)
+	}
+}
+
+func (s *syncCmd) newPolicyAPI(cf *cfclient.Client) (*ocfas.Client, error) {
 	token, err := cf.GetToken()
 	if err != nil {
-		return fmt.Errorf("Error retrieving auth token: %s", err)
+		return nil, fmt.Errorf("Error retrieving auth token: %s", err)
 	}
+
 	as := ocfas.NewClient(*s.OCFASHost, strings.TrimPrefix(token, "bearer "))
-	if globalTrace != nil && *globalTrace {
-		as.TraceTo(os.Stderr)
+	tracer, err := getTracer()
+	if err != nil {
+		return nil, err
+	}
+	if tracer != nil {
+		as.TraceTo(tracer)
+	}
+
+	return as, nil
+}
+
+func (s *syncCmd) startPolicyWorkers(
+	cf *cfclient.Client,
+	appChan <-chan models.ConvertedPolicyToApp,
+	doneChan chan<- bool,
+	errChan chan<- error,
+	policiesTracker *progress.Tracker,
+) error {
+	numWorkers := *(s.Workers)
+	setPoliciesWaitGroup := sync.WaitGroup{}
+	setPoliciesWaitGroup.Add(numWorkers)
+	as, err := s.newPolicyAPI(cf)
+	if err != nil {
+		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Setting policies on apps\n")
+	policiesLog := logger.WithFields(logger.Fields{logger.FieldStage: "policies"})
+	policiesLog.Infof("Setting policies on apps")
+	policiesStart := time.Now()
 	for i := 0; i < numWorkers; i++ {
 		go s.setAppPolicies(
 			as,
 			appChan,
 			&setPoliciesWaitGroup,
 			errChan,
+			policiesTracker,
 		)
 	}
 	go func() {
 		setPoliciesWaitGroup.Wait()
-		fmt.Fprintf(os.Stderr, "Done setting policies on apps\n")
+		policiesLog.WithFields(logger.Fields{
+			logger.FieldDuration: time.Since(policiesStart),
+		}).Infof("Done setting policies on apps")
 		doneChan <- true
 	}()
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-doneChan:
-		fmt.Fprintf(os.Stderr, "Done!\n")
+	return nil
+}
+
+func (s *syncCmd) checkFoundation(header *models.Header) error {
+	if header == nil || header.CFHost == "" || header.CFHost == *s.CFHost {
+		return nil
+	}
+
+	log := logger.WithFields(logger.Fields{"source_cf_host": header.CFHost, "cf_host": *s.CFHost})
+	if *s.RemapByName {
+		log.Infof("Input was dumped from a different foundation; GUIDs will be remapped by name")
+		return nil
+	}
+
+	if *s.Force {
+		log.Warnf("Input was dumped from a different foundation; continuing because of --force")
 		return nil
 	}
+
+	return fmt.Errorf("Input was dumped from `%s', not `%s'. Use --remap-by-name to migrate across foundations, or --force to apply it anyway",
+		header.CFHost, *s.CFHost)
 }
 
-func (s *syncCmd) getServicePlanGUIDs(cf *cfclient.Client) ([]string, error) {
-	fmt.Fprintf(os.Stderr, "Checking if service broker with GUID `%s' exists\n", *s.BrokerGUID)
-	_, err := cf.GetServiceBrokerByGuid(*s.BrokerGUID)
+func (s *syncCmd) getServicePlans(services serviceAPI) ([]cfclient.ServicePlan, error) {
+	logger.Infof("Checking if service broker with GUID `%s' exists", *s.BrokerGUID)
+	err := services.CheckServiceBroker(*s.BrokerGUID)
 	if err != nil {
 		return nil, fmt.Errorf("Error discovering service broker `%s'", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Looking up service plans for service broker with GUID `%s'\n", *s.BrokerGUID)
+	logger.Infof("Looking up service plans for service broker with GUID `%s'", *s.BrokerGUID)
 	//Discover which spaces have service instances of the proper type bound
-	servicePlansQuery := url.Values{}
-	servicePlansQuery.Add("q", "service_broker_guid:"+*s.BrokerGUID)
-	plans, err := cf.ListServicePlansByQuery(servicePlansQuery)
+	plans, err := services.ListServicePlans(*s.BrokerGUID)
 	if err != nil {
 		return nil, fmt.Errorf("Error listing service plans for broker with GUID `%s': %s", *s.BrokerGUID, err)
 	}
 
-	ret := []string{}
-	for _, plan := range plans {
-		ret = append(ret, plan.Guid)
+	return plans, nil
+}
+
+//prepareSpaces reads the input before anything is created, so that every
+// space sync can't handle is reported together instead of sync stopping at the
+// first one partway through. Each space is remapped once, and a plan is only
+// chosen for spaces which need a new service instance. Decisions and plans are
+// cached for the sync itself. The spaces to sync are spooled to a temporary
+// NDJSON file to be read from there, since the input may be a pipe which
+// can't be read twice.
+func (s *syncCmd) prepareSpaces(services serviceAPI, inputFormat string, plans *planSelector, instances *instanceResolver) (*os.File, error) {
+	log := logger.WithFields(logger.Fields{logger.FieldStage: "plans"})
+	log.Infof("Choosing service instances and plans for spaces")
+
+	spool, err := ioutil.TempFile("", "as2as-sync-*.ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating spool file: %s", err)
+	}
+	removeSpool := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	var remapper *nameRemapper
+	if *s.RemapByName {
+		logger.WithFields(logger.Fields{logger.FieldStage: "remap"}).Infof("Remapping GUIDs by org, space, and app name")
+		remapper = newNameRemapper(services)
+	}
+
+	enc := newJSONEncoder(spool, formatNDJSON)
+	noInstance, noPlan := 0, 0
+	err = readConvertedSpaces(*s.InputFile, inputFormat, *s.Force, func(space models.ConvertedSpace) error {
+		if remapper != nil {
+			var found bool
+			var err error
+			space, found, err = remapper.Remap(space)
+			if err != nil {
+				return err
+			}
+
+			if !found {
+				return nil
+			}
+		}
+
+		spaceLog := log.WithFields(logger.Fields{
+			logger.FieldOrgName:   space.OrgName,
+			logger.FieldSpaceName: space.Name,
+			logger.FieldSpaceGUID: space.GUID,
+		})
+		decision, err := instances.Resolve(space)
+		if err != nil {
+			noInstance++
+			spaceLog.Errorf("No usable service instance: %s", err)
+			return nil
+		}
+
+		if decision.Existing == nil {
+			_, err = plans.PlanFor(space)
+			if err != nil {
+				noPlan++
+				spaceLog.Errorf("No usable service plan: %s", err)
+				return nil
+			}
+		}
+
+		return enc.Encode(&space)
+	})
+	if err != nil {
+		removeSpool()
+		return nil, fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*s.InputFile).Close()
+	if err != nil {
+		removeSpool()
+		return nil, fmt.Errorf("Error closing input file")
+	}
+
+	if remapper != nil {
+		remapper.Report.Print()
 	}
 
-	return ret, nil
+	switch {
+	case noInstance > 0 && noPlan > 0:
+		removeSpool()
+		return nil, fmt.Errorf("%d spaces have no usable service instance and %d have no usable service plan; see the errors above. Nothing was created",
+			noInstance, noPlan)
+	case noInstance > 0:
+		removeSpool()
+		return nil, fmt.Errorf("%d spaces have no usable service instance; see the errors above. Nothing was created", noInstance)
+	case noPlan > 0:
+		removeSpool()
+		return nil, fmt.Errorf("%d spaces have no usable service plan; map them in --service-plan-map or set --service-plan. Nothing was created", noPlan)
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		removeSpool()
+		return nil, fmt.Errorf("Error rewinding spool file: %s", err)
+	}
+
+	return spool, nil
 }
 
-func (s *syncCmd) mapSpaceGUIDsToServiceInstances(cf *cfclient.Client, planGUIDs []string) (map[string]string, error) {
-	//space_guid -> service_instance_guid
-	spaceInstanceLookup := map[string]string{}
+func (s *syncCmd) mapSpaceGUIDsToServiceInstances(services serviceAPI, plans []cfclient.ServicePlan) (map[string][]cfclient.ServiceInstance, error) {
+	//space_guid -> service_instances
+	spaceInstanceLookup := map[string][]cfclient.ServiceInstance{}
 
-	for _, planGUID := range planGUIDs {
-		fmt.Fprintf(os.Stderr, "Looking up service instances for service plan with GUID `%s'\n", planGUID)
-		serviceInstancesQuery := url.Values{}
-		serviceInstancesQuery.Add("q", "service_plan_guid:"+planGUID)
-		serviceInstances, err := cf.ListServiceInstancesByQuery(serviceInstancesQuery)
+	for _, plan := range plans {
+		logger.Infof("Looking up service instances for service plan `%s' with GUID `%s'", plan.Name, plan.Guid)
+		serviceInstances, err := services.ListServiceInstancesForPlan(plan.Guid)
 		if err != nil {
-			return nil, fmt.Errorf("Error listing service instances for plan `%s': %s", planGUID, err)
+			return nil, fmt.Errorf("Error listing service instances for plan `%s': %s", plan.Guid, err)
 		}
 
 		for _, serviceInstance := range serviceInstances {
-			spaceInstanceLookup[serviceInstance.SpaceGuid] = serviceInstance.Guid
+			spaceInstanceLookup[serviceInstance.SpaceGuid] = append(spaceInstanceLookup[serviceInstance.SpaceGuid], serviceInstance)
 		}
 	}
 
@@ -192,34 +532,94 @@ func (s *syncCmd) mapSpaceGUIDsToServiceInstances(cf *cfclient.Client, planGUIDs
 }
 
 func (s *syncCmd) createServiceInstancesForSpaces(
-	cf *cfclient.Client,
+	services serviceAPI,
 	spaces <-chan models.ConvertedSpace,
 	output chan<- SyncServiceInstanceSpacePair,
 	done *sync.WaitGroup,
 	errChan chan<- error,
-	instanceName string,
-	servicePlanGUID string,
-	spacesToInstances map[string]string,
+	instances *instanceResolver,
+	plans *planSelector,
+	tracker *progress.Tracker,
 ) {
 	for space := range spaces {
-		serviceInstanceGUID, hasInstance := spacesToInstances[space.GUID]
+		log := logger.WithFields(logger.Fields{
+			logger.FieldStage:     "instances",
+			logger.FieldOrgName:   space.OrgName,
+			logger.FieldSpaceName: space.Name,
+			logger.FieldSpaceGUID: space.GUID,
+		})
+
+		decision, err := instances.Resolve(space)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		choice := instanceChoice{
+			OrgName:   space.OrgName,
+			SpaceName: space.Name,
+			SpaceGUID: space.GUID,
+			Strategy:  instances.strategy,
+			Conflict:  decision.Conflict,
+		}
+
+		if decision.Existing == nil {
+			plan, err := plans.PlanFor(space)
+			if err != nil {
+				errChan <- err
+				return
+			}
 
-		if !hasInstance {
 			//create the service instance
-			serviceInstance, err := cf.CreateServiceInstance(cfclient.ServiceInstanceRequest{
-				Name:            instanceName,
-				SpaceGuid:       space.GUID,
-				ServicePlanGuid: servicePlanGUID,
-			})
+			start := time.Now()
+			serviceInstance, err := services.CreateServiceInstance(decision.CreateName, space.GUID, plan.Guid)
+			if err != nil {
+				errChan <- fmt.Errorf("Error when creating service instance of plan `%s' in space with GUID `%s': %s",
+					plan.Name, space.GUID, err)
+				return
+			}
+
+			choice.ServiceInstanceGUID = serviceInstance.Guid
+			choice.ServiceInstanceName = decision.CreateName
+			choice.ServicePlan = plan.Name
+			choice.Action = instanceActionCreated
+			atomic.AddInt64(&s.stats.InstancesCreated, 1)
+			log = log.WithFields(logger.Fields{logger.FieldDuration: time.Since(start)})
+		} else {
+			//A previous run may have left the instance still provisioning
+			if decision.Existing.LastOperation.State == lastOperationInProgress {
+				log.WithFields(logger.Fields{logger.FieldServiceInstanceGUID: decision.Existing.Guid}).Infof("Waiting for service instance operation to finish")
+			}
+			err = services.WaitForServiceInstance(*decision.Existing)
 			if err != nil {
-				errChan <- fmt.Errorf("Error when creating service instance of plan with GUID `%s' in space with GUID `%s': %s",
-					servicePlanGUID, space.GUID, err)
+				errChan <- fmt.Errorf("Error waiting for service instance with GUID `%s' in space with GUID `%s': %s",
+					decision.Existing.Guid, space.GUID, err)
 				return
 			}
 
-			serviceInstanceGUID = serviceInstance.Guid
+			choice.ServiceInstanceGUID = decision.Existing.Guid
+			choice.ServiceInstanceName = decision.Existing.Name
+			choice.ServicePlan = plans.PlanNameForGUID(decision.Existing.ServicePlanGuid)
+			choice.Action = instanceActionExisting
+			atomic.AddInt64(&s.stats.InstancesExisting, 1)
+		}
+
+		s.recordInstance(choice)
+		log = log.WithFields(logger.Fields{
+			logger.FieldServiceInstanceGUID: choice.ServiceInstanceGUID,
+			"service_instance_name":         choice.ServiceInstanceName,
+			"service_plan":                  choice.ServicePlan,
+		})
+		if choice.Conflict != "" {
+			log.WithFields(logger.Fields{"conflict": choice.Conflict}).Warnf("Chose %s service instance by strategy `%s'", choice.Action, choice.Strategy)
+		} else if choice.Action == instanceActionCreated {
+			log.Infof("Created service instance")
+		} else {
+			log.Infof("Using existing service instance")
 		}
 
+		serviceInstanceGUID := choice.ServiceInstanceGUID
+		tracker.Increment()
 		output <- SyncServiceInstanceSpacePair{
 			Space:               space,
 			ServiceInstanceGUID: serviceInstanceGUID,
@@ -229,37 +629,107 @@ func (s *syncCmd) createServiceInstancesForSpaces(
 	done.Done()
 }
 
+func (s *syncCmd) recordInstance(choice instanceChoice) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	if s.stats.Plans == nil {
+		s.stats.Plans = map[string]int64{}
+	}
+
+	s.stats.Plans[choice.ServicePlan]++
+	s.stats.Instances = append(s.stats.Instances, choice)
+}
+
+func (s *syncCmd) printInstances() {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	//Workers finish in any order
+	sort.Slice(s.stats.Instances, func(i, j int) bool {
+		return s.stats.Instances[i].SpaceGUID < s.stats.Instances[j].SpaceGUID
+	})
+
+	conflicts := 0
+	for _, choice := range s.stats.Instances {
+		if choice.Conflict != "" {
+			conflicts++
+		}
+	}
+	if conflicts > 0 {
+		logger.Warnf("%d spaces had conflicting service instances; see the warnings above", conflicts)
+	}
+
+	names := []string{}
+	for name := range s.stats.Plans {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		logger.WithFields(logger.Fields{"service_plan": name}).Infof("%d spaces use this service plan", s.stats.Plans[name])
+	}
+}
+
 type SyncServiceInstanceSpacePair struct {
 	Space               models.ConvertedSpace
 	ServiceInstanceGUID string
 }
 
 func (s *syncCmd) bindServiceToApps(
-	cf *cfclient.Client,
+	services serviceAPI,
 	spaces <-chan SyncServiceInstanceSpacePair,
 	output chan models.ConvertedPolicyToApp,
 	done *sync.WaitGroup,
 	errChan chan<- error,
+	tracker *progress.Tracker,
+	policiesTracker *progress.Tracker,
 ) {
 	for spacePair := range spaces {
 		for _, app := range spacePair.Space.Apps {
+			if output == nil {
+				err := s.bindWithPolicy(services, spacePair, app)
+				if err != nil {
+					errChan <- err
+					return
+				}
+
+				tracker.Increment()
+				if app.Policy != nil {
+					policiesTracker.Increment()
+				}
+				continue
+			}
+
 			//check if binding exists
-			bindingsQuery := url.Values{}
-			bindingsQuery.Add("q", "app_guid:"+app.GUID)
-			bindingsQuery.Add("q", "service_instance_guid:"+spacePair.ServiceInstanceGUID)
-			bindings, err := cf.ListServiceBindingsByQuery(bindingsQuery)
+			bindings, err := services.ListBindings(spacePair.ServiceInstanceGUID, app.GUID)
 			if err != nil {
 				errChan <- fmt.Errorf("Error checking service bindings for app with GUID `%s': %s", app.GUID, err)
 				return
 			}
 
+			log := logger.WithFields(logger.Fields{
+				logger.FieldStage:               "bindings",
+				logger.FieldSpaceGUID:           spacePair.Space.GUID,
+				logger.FieldAppName:             app.Name,
+				logger.FieldAppGUID:             app.GUID,
+				logger.FieldServiceInstanceGUID: spacePair.ServiceInstanceGUID,
+			})
+
 			if len(bindings) == 0 {
-				_, err = cf.CreateServiceBinding(app.GUID, spacePair.ServiceInstanceGUID)
+				start := time.Now()
+				err = services.CreateBinding(app.GUID, spacePair.ServiceInstanceGUID, nil)
 				if err != nil {
 					errChan <- fmt.Errorf("Error binding service instance with GUID `%s' to app with GUID `%s': %s",
 						spacePair.ServiceInstanceGUID, app.GUID, err)
+					return
 				}
+
+				atomic.AddInt64(&s.stats.BindingsCreated, 1)
+				log.WithFields(logger.Fields{logger.FieldDuration: time.Since(start)}).Debugf("Bound service instance to app")
+			} else {
+				atomic.AddInt64(&s.stats.BindingsExisting, 1)
+				log.Debugf("App already bound to service instance")
 			}
+			tracker.Increment()
 
 			output <- app
 		}
@@ -268,17 +738,170 @@ func (s *syncCmd) bindServiceToApps(
 	done.Done()
 }
 
+//bindWithPolicy binds the app with its policy as the binding parameters.
+// Parameters can't be changed on an existing binding, and unbinding to rebind
+// would leave the app without a policy in between, or unbound if binding
+// fails. So an existing binding with a different policy keeps its binding and
+// gets the policy through the autoscaler API, if its host is known.
+func (s *syncCmd) bindWithPolicy(services serviceAPI, spacePair SyncServiceInstanceSpacePair, app models.ConvertedPolicyToApp) error {
+	log := logger.WithFields(logger.Fields{
+		logger.FieldStage:               "bindings",
+		logger.FieldSpaceGUID:           spacePair.Space.GUID,
+		logger.FieldAppName:             app.Name,
+		logger.FieldAppGUID:             app.GUID,
+		logger.FieldServiceInstanceGUID: spacePair.ServiceInstanceGUID,
+	})
+
+	bindings, err := services.ListBindings(spacePair.ServiceInstanceGUID, app.GUID)
+	if err != nil {
+		return fmt.Errorf("Error checking service bindings for app with GUID `%s': %s", app.GUID, err)
+	}
+
+	if len(bindings) > 0 {
+		return s.checkBindingPolicy(services, bindings[0].Guid, app, log)
+	}
+
+	//Bind without parameters rather than passing a JSON null
+	var parameters interface{}
+	if app.Policy != nil {
+		parameters = app.Policy
+	}
+
+	start := time.Now()
+	err = services.CreateBinding(app.GUID, spacePair.ServiceInstanceGUID, parameters)
+	if err != nil {
+		return fmt.Errorf("Error binding service instance with GUID `%s' to app with GUID `%s': %s",
+			spacePair.ServiceInstanceGUID, app.GUID, err)
+	}
+
+	atomic.AddInt64(&s.stats.BindingsCreated, 1)
+	if app.Policy != nil {
+		atomic.AddInt64(&s.stats.PoliciesSet, 1)
+	} else {
+		atomic.AddInt64(&s.stats.PoliciesSkipped, 1)
+	}
+
+	log.WithFields(logger.Fields{logger.FieldDuration: time.Since(start)}).Debugf("Bound service instance to app with its policy")
+	return nil
+}
+
+func (s *syncCmd) checkBindingPolicy(services serviceAPI, bindingGUID string, app models.ConvertedPolicyToApp, log logger.Entry) error {
+	atomic.AddInt64(&s.stats.BindingsExisting, 1)
+	log = log.WithFields(logger.Fields{"binding_guid": bindingGUID})
+	if app.Policy == nil {
+		atomic.AddInt64(&s.stats.PoliciesSkipped, 1)
+		log.Debugf("App already bound to service instance")
+		return nil
+	}
+
+	//Setting the policy through the API is safe to repeat, so a binding whose
+	// parameters can't be read is updated as if its policy differed
+	same, err := bindingHasPolicy(services, bindingGUID, app)
+	if err != nil {
+		log.Warnf("Could not read the parameters of the existing binding: %s", err)
+	}
+
+	if same {
+		atomic.AddInt64(&s.stats.PoliciesUnchanged, 1)
+		log.Debugf("App already bound to service instance with its policy")
+		return nil
+	}
+
+	if s.policyAPI == nil {
+		atomic.AddInt64(&s.stats.PoliciesNotApplied, 1)
+		log.Warnf("Existing binding may not have the app's policy; give --ocfas-host to update it")
+		return nil
+	}
+
+	start := time.Now()
+	err = s.policyAPI.CreatePolicyForAppWithGUID(app.GUID, app.Policy)
+	if err != nil {
+		return fmt.Errorf("Error when updating policy for app with GUID `%s': %s", app.GUID, err)
+	}
+
+	atomic.AddInt64(&s.stats.PoliciesSet, 1)
+	log.WithFields(logger.Fields{logger.FieldDuration: time.Since(start)}).Infof("Updated the policy of the existing binding through the autoscaler API")
+	return nil
+}
+
+//Compares after decoding both into a Policy, since the broker needn't keep key
+// order, spacing, or fields which are empty
+func bindingHasPolicy(services serviceAPI, bindingGUID string, app models.ConvertedPolicyToApp) (bool, error) {
+	raw, err := services.GetBindingParameters(bindingGUID)
+	if err != nil {
+		return false, err
+	}
+
+	existing, err := normalizePolicy(raw)
+	if err != nil {
+		return false, err
+	}
+
+	encoded, err := json.Marshal(app.Policy)
+	if err != nil {
+		return false, err
+	}
+
+	wanted, err := normalizePolicy(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(existing, wanted), nil
+}
+
+func normalizePolicy(raw json.RawMessage) (interface{}, error) {
+	policy := ocfas.Policy{}
+	err := json.Unmarshal(raw, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	//Missing and empty mean the same to the autoscaler
+	if policy.ScalingRules == nil {
+		policy.ScalingRules = []ocfas.ScalingRule{}
+	}
+	if policy.Schedules != nil && reflect.DeepEqual(*policy.Schedules, ocfas.Schedules{}) {
+		policy.Schedules = nil
+	}
+
+	encoded, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret interface{}
+	err = json.Unmarshal(encoded, &ret)
+	return ret, err
+}
+
 func (s *syncCmd) setAppPolicies(
 	as *ocfas.Client,
 	apps <-chan models.ConvertedPolicyToApp,
 	done *sync.WaitGroup,
 	errChan chan<- error,
+	tracker *progress.Tracker,
 ) {
 	for app := range apps {
+		start := time.Now()
 		err := as.CreatePolicyForAppWithGUID(app.GUID, app.Policy)
 		if err != nil {
 			errChan <- fmt.Errorf("Error when creating policy for app with GUID `%s': %s", app.GUID, err)
 		}
+
+		if app.Policy == nil {
+			atomic.AddInt64(&s.stats.PoliciesSkipped, 1)
+			continue
+		}
+
+		atomic.AddInt64(&s.stats.PoliciesSet, 1)
+		logger.WithFields(logger.Fields{
+			logger.FieldStage:    "policies",
+			logger.FieldAppName:  app.Name,
+			logger.FieldAppGUID:  app.GUID,
+			logger.FieldDuration: time.Since(start),
+		}).Debugf("Set policy on app")
+		tracker.Increment()
 	}
 
 	done.Done()
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/models"
+	"github.com/thomasmitchell/as2as/ocfas"
+)
+
+type fakePolicyAPI struct {
+	//app GUID -> policy
+	set map[string]*ocfas.Policy
+}
+
+func (f *fakePolicyAPI) CreatePolicyForAppWithGUID(guid string, policy *ocfas.Policy) error {
+	f.set[guid] = policy
+	return nil
+}
+
+func TestBindWithPolicy(t *testing.T) {
+	policy := &ocfas.Policy{
+		InstanceMinCount: 1,
+		InstanceMaxCount: 3,
+		ScalingRules: []ocfas.ScalingRule{
+			{MetricType: ocfas.MetricTypeCPUUtil, Operator: ">=", Threshold: 80, Adjustment: "+1"},
+		},
+	}
+	//The same policy as the broker might return it
+	samePolicy := `{"scaling_rules": [{"adjustment": "+1", "threshold": 80, "operator": ">=", "metric_type": "cpu"}],
+		"instance_max_count": 3, "instance_min_count": 1, "schedules": {}}`
+	otherPolicy := `{"instance_min_count": 2, "instance_max_count": 3, "scaling_rules": []}`
+
+	tests := []struct {
+		name   string
+		policy *ocfas.Policy
+		//Parameters of an existing binding, if there is one
+		existing      string
+		unreadable    bool
+		noPolicyAPI   bool
+		createBindErr error
+		wantErr       string
+		wantCalls     []string
+		wantAPIUpdate bool
+		wantStats     syncStats
+		//Checks the new binding's parameters are the policy
+		wantBoundPolicy bool
+	}{
+		{
+			name:            "new binding with policy",
+			policy:          policy,
+			wantCalls:       []string{"bind app-1"},
+			wantStats:       syncStats{BindingsCreated: 1, PoliciesSet: 1},
+			wantBoundPolicy: true,
+		},
+		{
+			name:      "new binding without policy",
+			wantCalls: []string{"bind app-1"},
+			wantStats: syncStats{BindingsCreated: 1, PoliciesSkipped: 1},
+		},
+		{
+			name:          "binding fails",
+			policy:        policy,
+			createBindErr: fmt.Errorf("broker unavailable"),
+			wantErr:       "broker unavailable",
+			wantCalls:     []string{"bind app-1"},
+		},
+		{
+			name:      "existing binding with the same policy",
+			policy:    policy,
+			existing:  samePolicy,
+			wantStats: syncStats{BindingsExisting: 1, PoliciesUnchanged: 1},
+		},
+		{
+			name:      "existing binding and autoscaling disabled",
+			existing:  otherPolicy,
+			wantStats: syncStats{BindingsExisting: 1, PoliciesSkipped: 1},
+		},
+		{
+			name:          "existing binding with another policy",
+			policy:        policy,
+			existing:      otherPolicy,
+			wantAPIUpdate: true,
+			wantStats:     syncStats{BindingsExisting: 1, PoliciesSet: 1},
+		},
+		{
+			name:        "existing binding with another policy and no API host",
+			policy:      policy,
+			existing:    otherPolicy,
+			noPolicyAPI: true,
+			wantStats:   syncStats{BindingsExisting: 1, PoliciesNotApplied: 1},
+		},
+		{
+			name:          "existing binding with unreadable parameters",
+			policy:        policy,
+			existing:      otherPolicy,
+			unreadable:    true,
+			wantAPIUpdate: true,
+			wantStats:     syncStats{BindingsExisting: 1, PoliciesSet: 1},
+		},
+		{
+			name:        "existing binding with unreadable parameters and no API host",
+			policy:      policy,
+			existing:    otherPolicy,
+			unreadable:  true,
+			noPolicyAPI: true,
+			wantStats:   syncStats{BindingsExisting: 1, PoliciesNotApplied: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services := &fakeServices{createBindingErr: test.createBindErr}
+			if test.existing != "" {
+				services.bindings = []fakeBinding{{
+					ServiceBinding: cfclient.ServiceBinding{Guid: "binding-0", AppGuid: "app-1", ServiceInstanceGuid: "instance-1"},
+					parameters:     json.RawMessage(test.existing),
+				}}
+			}
+			if test.unreadable {
+				services.bindingParamsErr = map[string]error{"binding-0": fmt.Errorf("broker does not support fetching bindings")}
+			}
+
+			api := &fakePolicyAPI{set: map[string]*ocfas.Policy{}}
+			s := &syncCmd{}
+			if !test.noPolicyAPI {
+				s.policyAPI = api
+			}
+
+			spacePair := SyncServiceInstanceSpacePair{Space: models.ConvertedSpace{GUID: "space-1"}, ServiceInstanceGUID: "instance-1"}
+			err := s.bindWithPolicy(services, spacePair, models.ConvertedPolicyToApp{GUID: "app-1", Policy: test.policy})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if strings.Join(services.calls, ",") != strings.Join(test.wantCalls, ",") {
+				t.Errorf("got calls %v, want %v", services.calls, test.wantCalls)
+			}
+			if _, updated := api.set["app-1"]; updated != test.wantAPIUpdate {
+				t.Errorf("policy updated through the API: %t, want %t", updated, test.wantAPIUpdate)
+			}
+			if !reflect.DeepEqual(s.stats, test.wantStats) {
+				t.Errorf("got stats %+v, want %+v", s.stats, test.wantStats)
+			}
+
+			if test.existing != "" && len(services.bindings) != 1 {
+				t.Errorf("existing binding was not left in place: %+v", services.bindings)
+			}
+			if test.wantBoundPolicy {
+				same, err := bindingHasPolicy(services, services.bindings[0].Guid, models.ConvertedPolicyToApp{Policy: test.policy})
+				if err != nil || !same {
+					t.Errorf("binding was created with parameters %s", services.bindings[0].parameters)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncFinish(t *testing.T) {
+	tests := []struct {
+		name    string
+		stats   syncStats
+		force   bool
+		wantErr string
+	}{
+		{name: "all applied", stats: syncStats{BindingsCreated: 2, PoliciesSet: 2}},
+		{
+			name:    "policies not applied",
+			stats:   syncStats{BindingsExisting: 2, PoliciesNotApplied: 2},
+			wantErr: "2 policies were not applied",
+		},
+		{
+			name:  "policies not applied with force",
+			stats: syncStats{BindingsExisting: 2, PoliciesNotApplied: 2},
+			force: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			force := test.force
+			s := &syncCmd{Force: &force, stats: test.stats}
+			err := s.finish()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
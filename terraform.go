@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/models"
+)
+
+//exportTerraformCmd writes HCL for the cloudfoundry/cloudfoundry Terraform
+// provider. Orgs, spaces, apps, and the service plan are referenced through
+// data sources by name, so that the same HCL applies to any foundation.
+type exportTerraformCmd struct {
+	InputFile           **os.File
+	InputFormat         *string
+	Force               *bool
+	ServiceName         *string
+	ServicePlan         *string
+	ServiceInstanceName *string
+	//If CFHost is set, CF is checked for service instances and bindings which
+	// already exist so that import blocks can be written for them
+	ClientID     *string
+	ClientSecret *string
+	CFHost       *string
+	RemapByName  *bool
+
+	stdoutWriter
+
+	cf       *cfclient.Client
+	services serviceAPI
+	remapper *nameRemapper
+	names    map[string]bool
+	orgs     map[string]string
+	imports  int
+}
+
+const terraformPlanDataSource = "autoscaler"
+
+func (e *exportTerraformCmd) Run() error {
+	inputFormat := detectInputFormat(*e.InputFormat, (*e.InputFile).Name())
+	header, err := verifyInput(*e.InputFile, inputFormat, models.KindConverted, *e.Force)
+	if err != nil {
+		return err
+	}
+
+	if *e.CFHost != "" {
+		e.cf, err = buildCFClient(*e.CFHost, *e.ClientID, *e.ClientSecret)
+		if err != nil {
+			return err
+		}
+
+		e.services, err = newServiceAPI(e.cf)
+		if err != nil {
+			return err
+		}
+
+		if *e.RemapByName {
+			e.remapper = newNameRemapper(e.services)
+		}
+	}
+
+	err = e.discoverServicePlan()
+	if err != nil {
+		return err
+	}
+
+	e.names = map[string]bool{}
+	e.orgs = map[string]string{}
+
+	out := bufio.NewWriter(e.output())
+	fmt.Fprintf(out, "# Generated by as2as %s from `%s'\n", version, (*e.InputFile).Name())
+	if header != nil {
+		if header.CFHost != "" {
+			fmt.Fprintf(out, "# Source foundation: %s (broker %s)\n", header.CFHost, header.BrokerGUID)
+		}
+		fmt.Fprintf(out, "# Converted at: %s\n", header.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, "# Requires the cloudfoundry/cloudfoundry provider, and Terraform 1.5 or later for import blocks\n")
+
+	fmt.Fprintf(out, "\ndata \"cloudfoundry_service_plan\" %s {\n", hclString(terraformPlanDataSource))
+	fmt.Fprintf(out, "  name                  = %s\n", hclString(*e.ServicePlan))
+	fmt.Fprintf(out, "  service_offering_name = %s\n", hclString(*e.ServiceName))
+	fmt.Fprintf(out, "}\n")
+
+	err = readConvertedSpaces(*e.InputFile, inputFormat, *e.Force, func(space models.ConvertedSpace) error {
+		return e.writeSpace(out, space)
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading input file: %s", err)
+	}
+
+	err = (*e.InputFile).Close()
+	if err != nil {
+		return fmt.Errorf("Error closing input file")
+	}
+
+	err = out.Flush()
+	if err != nil {
+		return fmt.Errorf("Error writing Terraform: %s", err)
+	}
+
+	if e.remapper != nil {
+		e.remapper.Report.Print()
+	}
+
+	if e.cf != nil {
+		logger.Infof("Wrote import blocks for %d existing resources", e.imports)
+	}
+
+	return nil
+}
+
+//The plan goes into a data source, so unlike export-script it has to be
+// known now. It is only discovered when the service has a single plan.
+func (e *exportTerraformCmd) discoverServicePlan() error {
+	if *e.ServicePlan != "" {
+		return nil
+	}
+
+	if e.services == nil {
+		return fmt.Errorf("--service-plan is required unless --cf-host is given to discover it")
+	}
+
+	brokerGUID := ""
+	err := discoverBrokerGUID(e.services, &brokerGUID, *e.ServiceName)
+	if err != nil {
+		return err
+	}
+
+	plans, err := e.services.ListServicePlans(brokerGUID)
+	if err != nil {
+		return fmt.Errorf("Error listing service plans for broker with GUID `%s': %s", brokerGUID, err)
+	}
+
+	if len(plans) != 1 {
+		names := make([]string, 0, len(plans))
+		for _, plan := range plans {
+			names = append(names, plan.Name)
+		}
+		return fmt.Errorf("Service `%s' has %d plans (%s); choose one with --service-plan", *e.ServiceName, len(plans), strings.Join(names, ", "))
+	}
+
+	*e.ServicePlan = plans[0].Name
+	logger.WithFields(logger.Fields{"service": *e.ServiceName, "service_plan": *e.ServicePlan}).Infof("Discovered service plan")
+	return nil
+}
+
+func (e *exportTerraformCmd) writeSpace(out io.Writer, space models.ConvertedSpace) error {
+	//The data sources look everything up by name
+	if space.OrgName == "" || space.Name == "" {
+		return fmt.Errorf("Space with GUID `%s' has no org or space name for the cloudfoundry_space data source to look it up by", space.GUID)
+	}
+
+	existing, err := e.lookupExisting(space)
+	if err != nil {
+		return err
+	}
+
+	org, seen := e.orgs[space.OrgName]
+	if !seen {
+		org = e.uniqueName(space.OrgName)
+		e.orgs[space.OrgName] = org
+		fmt.Fprintf(out, "\ndata \"cloudfoundry_org\" %s {\n", hclString(org))
+		fmt.Fprintf(out, "  name = %s\n", hclString(space.OrgName))
+		fmt.Fprintf(out, "}\n")
+	}
+
+	spaceName := e.uniqueName(space.OrgName + "_" + space.Name)
+	fmt.Fprintf(out, "\n# Space %s\n", space.GUID)
+	fmt.Fprintf(out, "data \"cloudfoundry_space\" %s {\n", hclString(spaceName))
+	fmt.Fprintf(out, "  name = %s\n", hclString(space.Name))
+	fmt.Fprintf(out, "  org  = data.cloudfoundry_org.%s.id\n", org)
+	fmt.Fprintf(out, "}\n")
+
+	fmt.Fprintf(out, "\nresource \"cloudfoundry_service_instance\" %s {\n", hclString(spaceName))
+	fmt.Fprintf(out, "  name         = %s\n", hclString(*e.ServiceInstanceName))
+	fmt.Fprintf(out, "  type         = \"managed\"\n")
+	fmt.Fprintf(out, "  space        = data.cloudfoundry_space.%s.id\n", spaceName)
+	fmt.Fprintf(out, "  service_plan = data.cloudfoundry_service_plan.%s.id\n", terraformPlanDataSource)
+	fmt.Fprintf(out, "}\n")
+	if existing.instanceGUID != "" {
+		e.writeImport(out, "cloudfoundry_service_instance."+spaceName, existing.instanceGUID)
+	}
+
+	for _, app := range space.Apps {
+		if app.Name == "" {
+			return fmt.Errorf("App with GUID `%s' in space `%s/%s' has no name for the cloudfoundry_app data source to look it up by", app.GUID, space.OrgName, space.Name)
+		}
+
+		appName := e.uniqueName(space.OrgName + "_" + space.Name + "_" + app.Name)
+		fmt.Fprintf(out, "\n# App %s\n", app.GUID)
+		fmt.Fprintf(out, "data \"cloudfoundry_app\" %s {\n", hclString(appName))
+		fmt.Fprintf(out, "  name       = %s\n", hclString(app.Name))
+		fmt.Fprintf(out, "  space_name = %s\n", hclString(space.Name))
+		fmt.Fprintf(out, "  org_name   = %s\n", hclString(space.OrgName))
+		fmt.Fprintf(out, "}\n")
+
+		fmt.Fprintf(out, "\nresource \"cloudfoundry_service_credential_binding\" %s {\n", hclString(appName))
+		fmt.Fprintf(out, "  type             = \"app\"\n")
+		fmt.Fprintf(out, "  service_instance = cloudfoundry_service_instance.%s.id\n", spaceName)
+		fmt.Fprintf(out, "  app              = data.cloudfoundry_app.%s.id\n", appName)
+		if app.Policy != nil {
+			policy := bytes.Buffer{}
+			err := encodeDocument(&policy, formatJSON, app.Policy)
+			if err != nil {
+				return fmt.Errorf("Error encoding policy for app with GUID `%s': %s", app.GUID, err)
+			}
+
+			fmt.Fprintf(out, "  parameters       = <<-POLICY\n%sPOLICY\n", hclHeredoc(policy.String(), "    "))
+		} else {
+			fmt.Fprintf(out, "  # Autoscaling was disabled for this app; no policy to attach\n")
+		}
+		fmt.Fprintf(out, "}\n")
+
+		if bindingGUID := existing.bindingGUIDs[app.Name]; bindingGUID != "" {
+			e.writeImport(out, "cloudfoundry_service_credential_binding."+appName, bindingGUID)
+		}
+	}
+
+	return nil
+}
+
+func (e *exportTerraformCmd) writeImport(out io.Writer, to, id string) {
+	e.imports++
+	fmt.Fprintf(out, "\nimport {\n")
+	fmt.Fprintf(out, "  to = %s\n", to)
+	fmt.Fprintf(out, "  id = %s\n", hclString(id))
+	fmt.Fprintf(out, "}\n")
+}
+
+type existingResources struct {
+	instanceGUID string
+	//app name -> binding GUID
+	bindingGUIDs map[string]string
+}
+
+//Finds the service instance with the configured name in the space, and the
+// bindings of it to the space's apps. Nothing is looked up unless a CF host
+// was given.
+func (e *exportTerraformCmd) lookupExisting(space models.ConvertedSpace) (existingResources, error) {
+	ret := existingResources{bindingGUIDs: map[string]string{}}
+	if e.cf == nil {
+		return ret, nil
+	}
+
+	if e.remapper != nil {
+		var found bool
+		var err error
+		space, found, err = e.remapper.Remap(space)
+		if err != nil || !found {
+			return ret, err
+		}
+	}
+
+	log := logger.WithFields(logger.Fields{
+		logger.FieldStage:     "import",
+		logger.FieldOrgName:   space.OrgName,
+		logger.FieldSpaceName: space.Name,
+		logger.FieldSpaceGUID: space.GUID,
+	})
+
+	instance, err := e.services.FindServiceInstanceInSpace(space.GUID, *e.ServiceInstanceName)
+	if err != nil {
+		return ret, fmt.Errorf("Error looking up service instance in space with GUID `%s': %s", space.GUID, err)
+	}
+
+	if instance == nil {
+		log.Debugf("No existing service instance")
+		return ret, nil
+	}
+
+	ret.instanceGUID = instance.Guid
+	log.WithFields(logger.Fields{logger.FieldServiceInstanceGUID: ret.instanceGUID}).Debugf("Found existing service instance")
+
+	for _, app := range space.Apps {
+		bindings, err := e.services.ListBindings(ret.instanceGUID, app.GUID)
+		if err != nil {
+			return ret, fmt.Errorf("Error checking service bindings for app with GUID `%s': %s", app.GUID, err)
+		}
+
+		if len(bindings) > 0 {
+			ret.bindingGUIDs[app.Name] = bindings[0].Guid
+		}
+	}
+
+	return ret, nil
+}
+
+var terraformInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+//Turns name into a valid Terraform identifier which has not been used yet in
+// this file.
+func (e *exportTerraformCmd) uniqueName(name string) string {
+	name = strings.ToLower(terraformInvalidNameChars.ReplaceAllString(name, "_"))
+	if name == "" || !(name[0] == '_' || (name[0] >= 'a' && name[0] <= 'z')) {
+		name = "_" + name
+	}
+
+	ret := name
+	for i := 2; e.names[ret]; i++ {
+		ret = fmt.Sprintf("%s_%d", name, i)
+	}
+
+	e.names[ret] = true
+	return ret
+}
+
+//Escapes template sequences so that s is taken literally by Terraform.
+func hclEscapeTemplate(s string) string {
+	s = strings.Replace(s, "${", "$${", -1)
+	return strings.Replace(s, "%{", "%%{", -1)
+}
+
+func hclString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + hclEscapeTemplate(s) + `"`
+}
+
+func hclHeredoc(s, indent string) string {
+	lines := strings.SplitAfter(hclEscapeTemplate(s), "\n")
+	for i := range lines {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,356 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatHAR  Format = "har"
+)
+
+const redacted = "[REDACTED]"
+
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+var sensitiveKeyFragments = []string{
+	"token",
+	"secret",
+	"password",
+	"credentials",
+	"authorization",
+}
+
+type Tracer struct {
+	out     io.Writer
+	format  Format
+	redact  bool
+	creator string
+	version string
+
+	lock    sync.Mutex
+	entries []harEntry
+}
+
+func New(out io.Writer, format Format, redact bool) *Tracer {
+	return &Tracer{
+		out:     out,
+		format:  format,
+		redact:  redact,
+		creator: "as2as",
+		version: "unknown",
+	}
+}
+
+func (t *Tracer) SetCreator(name, version string) {
+	t.creator = name
+	t.version = version
+}
+
+//Wrap returns a RoundTripper which traces every request made through base.
+// If base is nil, http.DefaultTransport is used.
+func (t *Tracer) Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{base: base, tracer: t}
+}
+
+//Close writes out any buffered trace data. Text traces are written as they
+// happen, so this only has an effect for HAR output.
+func (t *Tracer) Close() error {
+	if t.format != FormatHAR {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entries := t.entries
+	if entries == nil {
+		entries = []harEntry{}
+	}
+
+	doc := harDocument{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: t.creator, Version: t.version},
+			Entries: entries,
+		},
+	}
+
+	enc := json.NewEncoder(t.out)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(&doc)
+	if err != nil {
+		return fmt.Errorf("Error writing HAR trace: %s", err)
+	}
+
+	return nil
+}
+
+type transport struct {
+	base   http.RoundTripper
+	tracer *Tracer
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//RoundTrippers mustn't modify the request they're given, so the body read
+	// for the trace is put back on a copy
+	req = req.Clone(req.Context())
+	reqBody, err := drainBody(&req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading request body for trace: %s", err)
+	}
+
+	if t.tracer.format == FormatText {
+		err = t.tracer.writeTextRequest(req, reqBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	started := time.Now()
+	resp, rtErr := t.base.RoundTrip(req)
+	elapsed := time.Since(started)
+	if rtErr != nil {
+		//Failed round trips are often the ones worth tracing, so record them too
+		if t.tracer.format == FormatHAR {
+			t.tracer.recordHAR(req, reqBody, nil, nil, rtErr, started, elapsed)
+			return nil, rtErr
+		}
+
+		err = t.tracer.writeTextError(rtErr)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, rtErr
+	}
+
+	respBody, err := drainBody(&resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response body for trace: %s", err)
+	}
+
+	if t.tracer.format == FormatHAR {
+		t.tracer.recordHAR(req, reqBody, resp, respBody, nil, started, elapsed)
+		return resp, nil
+	}
+
+	err = t.tracer.writeTextResponse(resp, respBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func drainBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	contents, err := ioutil.ReadAll(*body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = (*body).Close()
+	if err != nil {
+		return nil, err
+	}
+
+	*body = ioutil.NopCloser(bytes.NewReader(contents))
+	return contents, nil
+}
+
+func (t *Tracer) writeTextRequest(req *http.Request, body []byte) error {
+	toDump := req.Clone(req.Context())
+	toDump.URL = t.url(req.URL)
+	toDump.Header = t.headers(req.Header)
+	body = t.body(body, req.Header.Get("Content-Type"))
+	toDump.Body = ioutil.NopCloser(bytes.NewReader(body))
+	toDump.ContentLength = int64(len(body))
+
+	reqDump, err := httputil.DumpRequestOut(toDump, true)
+	if err != nil {
+		return fmt.Errorf("Error dumping request: %s", err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err = t.out.Write(append(reqDump, []byte("\n  ***\n\n")...))
+	if err != nil {
+		return fmt.Errorf("Error writing request dump: %s", err)
+	}
+
+	return nil
+}
+
+func (t *Tracer) writeTextResponse(resp *http.Response, body []byte) error {
+	toDump := *resp
+	toDump.Header = t.headers(resp.Header)
+	body = t.body(body, resp.Header.Get("Content-Type"))
+	toDump.Body = ioutil.NopCloser(bytes.NewReader(body))
+	toDump.ContentLength = int64(len(body))
+	toDump.TransferEncoding = nil
+
+	respDump, err := httputil.DumpResponse(&toDump, true)
+	if err != nil {
+		return fmt.Errorf("Error dumping response: %s", err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err = t.out.Write(append(respDump, []byte("\n--------------------\n\n")...))
+	if err != nil {
+		return fmt.Errorf("Error writing response dump: %s", err)
+	}
+
+	return nil
+}
+
+func (t *Tracer) writeTextError(rtErr error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err := fmt.Fprintf(t.out, "Request failed: %s\n\n--------------------\n\n", rtErr)
+	if err != nil {
+		return fmt.Errorf("Error writing request error: %s", err)
+	}
+
+	return nil
+}
+
+func (t *Tracer) headers(h http.Header) http.Header {
+	ret := h.Clone()
+	if !t.redact {
+		return ret
+	}
+
+	for _, name := range sensitiveHeaders {
+		if ret.Get(name) != "" {
+			ret.Set(name, redacted)
+		}
+	}
+
+	return ret
+}
+
+//Returns a copy of u with the values of sensitive query parameters redacted
+func (t *Tracer) url(u *url.URL) *url.URL {
+	ret := *u
+	if !t.redact || ret.RawQuery == "" {
+		return &ret
+	}
+
+	values, err := url.ParseQuery(ret.RawQuery)
+	if err != nil {
+		ret.RawQuery = redacted
+		return &ret
+	}
+
+	changed := false
+	for k := range values {
+		if isSensitiveKey(k) {
+			values.Set(k, redacted)
+			changed = true
+		}
+	}
+
+	if changed {
+		ret.RawQuery = values.Encode()
+	}
+
+	return &ret
+}
+
+func (t *Tracer) body(body []byte, contentType string) []byte {
+	if !t.redact || len(body) == 0 {
+		return body
+	}
+
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return []byte(redacted)
+		}
+
+		for k := range values {
+			if isSensitiveKey(k) {
+				values.Set(k, redacted)
+			}
+		}
+
+		return []byte(values.Encode())
+	}
+
+	var parsed interface{}
+	err := json.Unmarshal(body, &parsed)
+	if err != nil {
+		//Not JSON, and not a form. We don't know where secrets would be in here,
+		// so pass it through untouched.
+		return body
+	}
+
+	ret, err := json.Marshal(redactJSON(parsed))
+	if err != nil {
+		return []byte(redacted)
+	}
+
+	return ret
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range typed {
+			if isSensitiveKey(k) {
+				typed[k] = redacted
+				continue
+			}
+
+			typed[k] = redactJSON(inner)
+		}
+
+	case []interface{}:
+		for i := range typed {
+			typed[i] = redactJSON(typed[i])
+		}
+	}
+
+	return v
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, fragment := range sensitiveKeyFragments {
+		if strings.Contains(k, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,329 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHeadersRedaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		redact bool
+		header string
+		value  string
+		want   string
+	}{
+		{"authorization", true, "Authorization", "bearer abc", redacted},
+		{"cookie", true, "Cookie", "session=abc", redacted},
+		{"set-cookie", true, "Set-Cookie", "session=abc", redacted},
+		{"proxy authorization", true, "Proxy-Authorization", "Basic abc", redacted},
+		{"harmless header", true, "Content-Type", "application/json", "application/json"},
+		{"unredacted", false, "Authorization", "bearer abc", "bearer abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer := New(&bytes.Buffer{}, FormatText, test.redact)
+			h := http.Header{}
+			h.Set(test.header, test.value)
+
+			got := tracer.headers(h).Get(test.header)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if h.Get(test.header) != test.value {
+				t.Errorf("original header was modified")
+			}
+		})
+	}
+}
+
+func TestBodyRedaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		redact      bool
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "json top level",
+			redact:      true,
+			contentType: "application/json",
+			body:        `{"access_token":"abc","name":"app"}`,
+			want:        `{"access_token":"[REDACTED]","name":"app"}`,
+		},
+		{
+			name:        "json nested in arrays",
+			redact:      true,
+			contentType: "application/json",
+			body:        `{"resources":[{"entity":{"credentials":{"uri":"x"},"name":"svc"}}]}`,
+			want:        `{"resources":[{"entity":{"credentials":"[REDACTED]","name":"svc"}}]}`,
+		},
+		{
+			name:        "json key match is case insensitive",
+			redact:      true,
+			contentType: "application/json",
+			body:        `{"Client_Secret":"abc"}`,
+			want:        `{"Client_Secret":"[REDACTED]"}`,
+		},
+		{
+			name:        "form encoded token request",
+			redact:      true,
+			contentType: "application/x-www-form-urlencoded",
+			body:        "client_id=as2as&client_secret=abc&grant_type=client_credentials",
+			want:        "client_id=as2as&client_secret=%5BREDACTED%5D&grant_type=client_credentials",
+		},
+		{
+			name:        "form content type with charset",
+			redact:      true,
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "password=abc",
+			want:        "password=%5BREDACTED%5D",
+		},
+		{
+			name:        "not json or form",
+			redact:      true,
+			contentType: "text/plain",
+			body:        "hello",
+			want:        "hello",
+		},
+		{
+			name:        "unredacted",
+			redact:      false,
+			contentType: "application/json",
+			body:        `{"access_token":"abc"}`,
+			want:        `{"access_token":"abc"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer := New(&bytes.Buffer{}, FormatText, test.redact)
+			got := string(tracer.body([]byte(test.body), test.contentType))
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestURLRedaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		redact bool
+		url    string
+		want   string
+	}{
+		{
+			name:   "access token",
+			redact: true,
+			url:    "https://uaa.example.com/userinfo?access_token=abc&page=2",
+			want:   "https://uaa.example.com/userinfo?access_token=%5BREDACTED%5D&page=2",
+		},
+		{
+			name:   "key match is case insensitive",
+			redact: true,
+			url:    "https://api.example.com/v3/apps?Client_Secret=abc",
+			want:   "https://api.example.com/v3/apps?Client_Secret=%5BREDACTED%5D",
+		},
+		{
+			name:   "harmless query is left as is",
+			redact: true,
+			url:    "https://api.example.com/v3/apps?names=a,b&page=2",
+			want:   "https://api.example.com/v3/apps?names=a,b&page=2",
+		},
+		{
+			name:   "no query",
+			redact: true,
+			url:    "https://api.example.com/v3/apps",
+			want:   "https://api.example.com/v3/apps",
+		},
+		{
+			name:   "unredacted",
+			redact: false,
+			url:    "https://uaa.example.com/userinfo?access_token=abc",
+			want:   "https://uaa.example.com/userinfo?access_token=abc",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer := New(&bytes.Buffer{}, FormatText, test.redact)
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := tracer.url(u).String()
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			if u.String() != test.url {
+				t.Errorf("original URL was modified to %s", u)
+			}
+		})
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"abc","token_type":"bearer"}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		format  Format
+		base    http.RoundTripper
+		wantErr bool
+		//Substrings the trace must contain
+		want []string
+		//Substrings the trace must not contain
+		notWant []string
+	}{
+		{
+			name:    "text success",
+			format:  FormatText,
+			want:    []string{"POST /oauth/token?login_hint=as2as&token=%5BREDACTED%5D", "client_secret=%5BREDACTED%5D", `"access_token":"[REDACTED]"`, "Authorization: [REDACTED]"},
+			notWant: []string{"hunter2", `"abc"`, "Basic"},
+		},
+		{
+			name:    "har success",
+			format:  FormatHAR,
+			want:    []string{`"status": 200`, "client_secret=%5BREDACTED%5D", `\"access_token\":\"[REDACTED]\"`, "token?login_hint=as2as&token=%5BREDACTED%5D"},
+			notWant: []string{"hunter2", `\"abc\"`, "Basic", "_error"},
+		},
+		{
+			name:    "text error",
+			format:  FormatText,
+			base:    failingTransport{},
+			wantErr: true,
+			want:    []string{"POST /oauth/token", "Request failed: connection refused"},
+			notWant: []string{"hunter2"},
+		},
+		{
+			name:    "har error",
+			format:  FormatHAR,
+			base:    failingTransport{},
+			wantErr: true,
+			want:    []string{`"method": "POST"`, `"_error": "connection refused"`, `"status": 0`},
+			notWant: []string{"hunter2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			tracer := New(out, test.format, true)
+			client := &http.Client{Transport: tracer.Wrap(test.base)}
+
+			req, err := http.NewRequest("POST", srv.URL+"/oauth/token?token=hunter2&login_hint=as2as", strings.NewReader("client_secret=hunter2&grant_type=client_credentials"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Basic aHVudGVyMg==")
+
+			resp, err := client.Do(req)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if resp != nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if !strings.Contains(string(body), `"abc"`) {
+					t.Errorf("caller got redacted response body %s", body)
+				}
+			}
+
+			err = tracer.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.format == FormatHAR {
+				doc := harDocument{}
+				err = json.Unmarshal(out.Bytes(), &doc)
+				if err != nil {
+					t.Fatalf("HAR output is not JSON: %s", err)
+				}
+				if len(doc.Log.Entries) != 1 {
+					t.Fatalf("got %d HAR entries, want 1", len(doc.Log.Entries))
+				}
+				for _, param := range doc.Log.Entries[0].Request.QueryString {
+					if param.Name == "token" && param.Value != redacted {
+						t.Errorf("got query parameter token=%s in HAR", param.Value)
+					}
+				}
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("trace does not contain %s:\n%s", want, out)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(out.String(), notWant) {
+					t.Errorf("trace contains %s:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripLeavesRequestAlone(t *testing.T) {
+	base := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	tracer := New(&bytes.Buffer{}, FormatText, true)
+	transport := tracer.Wrap(handlerTransport{base})
+
+	body := ioutil.NopCloser(strings.NewReader("client_secret=hunter2"))
+	req, err := http.NewRequest("POST", "https://uaa.example.com/oauth/token?token=hunter2", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Basic aHVudGVyMg==")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != "client_secret=hunter2" {
+		t.Errorf("server got body %q", got)
+	}
+	if req.Body != body {
+		t.Errorf("caller's request body was replaced")
+	}
+	if req.URL.RawQuery != "token=hunter2" || req.Header.Get("Authorization") != "Basic aHVudGVyMg==" {
+		t.Errorf("caller's request was modified: %s %v", req.URL, req.Header)
+	}
+}
+
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (h handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
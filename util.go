@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 
 	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/thomasmitchell/as2as/logger"
+	"github.com/thomasmitchell/as2as/progress"
+	"github.com/thomasmitchell/as2as/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 type StringList []string
@@ -20,6 +28,20 @@ func (l StringList) Contains(s string) bool {
 	return false
 }
 
+//stdoutWriter is embedded in commands which write their result to stdout.
+// migrate sets out to write to its step files instead.
+type stdoutWriter struct {
+	out io.Writer
+}
+
+func (s stdoutWriter) output() io.Writer {
+	if s.out == nil {
+		return os.Stdout
+	}
+
+	return s.out
+}
+
 func buildCFClient(host, clientID, clientSecret string) (*cfclient.Client, error) {
 	u := url.URL{
 		Scheme: "https",
@@ -33,12 +55,119 @@ func buildCFClient(host, clientID, clientSecret string) (*cfclient.Client, error
 		UserAgent:    "Go-CF-client/1.1",
 	}
 
-	fmt.Fprintf(os.Stderr, "Authing to CF\n")
+	tracer, err := getTracer()
+	if err != nil {
+		return nil, err
+	}
+	if tracer != nil {
+		//cfclient makes its UAA token requests through this client too
+		cfClientConfig.HttpClient = &http.Client{Transport: tracer.Wrap(nil)}
+	}
+
+	logger.WithFields(logger.Fields{"cf_host": host}).Infof("Authing to CF")
+
+	ret, err := newCFClient(cfClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing CF client: %s", err)
+	}
+
+	return ret, nil
+}
+
+//cfclient.NewClient finds UAA through /v2/info, which targets without the v2
+// API don't serve. For those, UAA is found through the links in the API root
+// instead, and the client is set up with client credentials the same way
+// cfclient would.
+func newCFClient(config *cfclient.Config) (*cfclient.Client, error) {
+	httpClient := config.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
 
-	ret, err := cfclient.NewClient(cfClientConfig)
+	root, err := readCFRoot(httpClient, config.ApiAddress)
 	if err != nil {
-		return nil, fmt.Errorf("Error initializing CF client: %s")
+		logger.Debugf("Error reading CF API root; assuming it serves v2: %s", err)
+	}
+	if err != nil || root.version() != cfAPIV3 {
+		return cfclient.NewClient(config)
+	}
+
+	tokenEndpoint := root.href("uaa")
+	if tokenEndpoint == "" {
+		tokenEndpoint = root.href("login")
+	}
+	if tokenEndpoint == "" {
+		return nil, fmt.Errorf("The CF API root has neither /v2/info nor a UAA link")
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	auth := &clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		TokenURL:     tokenEndpoint + "/oauth/token",
 	}
 
+	ret := &cfclient.Client{
+		Config: *config,
+		Endpoint: cfclient.Endpoint{
+			AuthEndpoint:  root.href("login"),
+			TokenEndpoint: tokenEndpoint,
+		},
+	}
+	ret.Config.TokenSource = auth.TokenSource(ctx)
+	ret.Config.HttpClient = auth.Client(ctx)
 	return ret, nil
 }
+
+var tracer *trace.Tracer
+var traceFile *os.File
+
+//Returns nil if tracing is not enabled
+func getTracer() (*trace.Tracer, error) {
+	if tracer != nil {
+		return tracer, nil
+	}
+
+	if (globalTrace == nil || !*globalTrace) && *globalTraceFile == "" {
+		return nil, nil
+	}
+
+	var out io.Writer = os.Stderr
+	if *globalTraceFile != "" {
+		var err error
+		traceFile, err = os.Create(*globalTraceFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening trace file: %s", err)
+		}
+
+		out = traceFile
+	}
+
+	tracer = trace.New(out, trace.Format(*globalTraceFormat), !*globalTraceUnredacted)
+	tracer.SetCreator(app.Name, version)
+	return tracer, nil
+}
+
+func closeTracer() error {
+	if tracer == nil {
+		return nil
+	}
+
+	err := tracer.Close()
+	if err != nil {
+		return err
+	}
+
+	if traceFile != nil {
+		err = traceFile.Close()
+		if err != nil {
+			return fmt.Errorf("Error closing trace file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func newProgressReporter() *progress.Reporter {
+	return progress.NewReporter(os.Stderr, !*globalNoProgress, *globalProgressInterval)
+}
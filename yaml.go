@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+//YAML documents are converted to and from JSON so that they round-trip
+// through the same json struct tags as every other format.
+
+//JSON is valid YAML, so decoding it into a MapSlice keeps the keys in the
+// order the JSON encoder wrote them.
+func jsonToYAML(in []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	err := yaml.Unmarshal(in, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(doc)
+}
+
+func yamlToJSON(in []byte) ([]byte, error) {
+	var doc interface{}
+	err := yaml.Unmarshal(in, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = yamlValueToJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(doc)
+}
+
+//yaml.v2 decodes mappings as map[interface{}]interface{}, which
+// encoding/json refuses to marshal.
+func yamlValueToJSON(in interface{}) (interface{}, error) {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			keyStr, isString := key.(string)
+			if !isString {
+				return nil, fmt.Errorf("Mapping key `%v' is not a string", key)
+			}
+
+			converted, err := yamlValueToJSON(value)
+			if err != nil {
+				return nil, err
+			}
+
+			ret[keyStr] = converted
+		}
+
+		return ret, nil
+
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			converted, err := yamlValueToJSON(v[i])
+			if err != nil {
+				return nil, err
+			}
+
+			ret[i] = converted
+		}
+
+		return ret, nil
+	}
+
+	return in, nil
+}